@@ -0,0 +1,245 @@
+package command
+
+import (
+	"bluebot/config"
+	"bluebot/store"
+	"bluebot/util"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/exp/slices"
+)
+
+// Names of the permissions commands can require, for denial messages
+var permissionNames = map[int64]string{
+	discordgo.PermissionManageServer:     "Manage Server",
+	discordgo.PermissionManageChannels:   "Manage Channels",
+	discordgo.PermissionManageMessages:   "Manage Messages",
+	discordgo.PermissionVoiceMuteMembers: "Mute Members",
+	discordgo.PermissionVoiceMoveMembers: "Move Members",
+}
+
+/*
+Who is allowed to use a command. Guild admins and bot owners pass every check apart from
+OwnerOnly, which only bot owners pass.
+
+Roles are names or IDs and the user needs any one of them. Guilds can replace the roles
+and permission with roles of their own in settings. Default roles that don't exist in a guild
+are ignored, so a command requiring "DJ" is open to everyone until the guild creates a DJ role,
+unless StrictRoles is set
+*/
+type Requirement struct {
+	Permissions int64
+	Roles       []string
+	OwnerOnly   bool
+	StrictRoles bool // Default roles are needed even before the guild creates them
+}
+
+func (r Requirement) IsEmpty() bool {
+	return r.Permissions == 0 && len(r.Roles) == 0 && !r.OwnerOnly
+}
+
+// Describe the requirement for help output
+func (r Requirement) String() string {
+	parts := []string{}
+	if r.OwnerOnly {
+		parts = append(parts, "bot owner")
+	}
+	if r.Permissions != 0 {
+		parts = append(parts, permissionName(r.Permissions)+" permission")
+	}
+	if len(r.Roles) > 0 {
+		parts = append(parts, "role "+strings.Join(r.Roles, " or "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+Part of a command with its own access check, e.g. editing phrases. Guilds set roles for it by
+name in settings like a command, apart from the roles for the command itself
+*/
+type Action struct {
+	Name        string
+	Description string // What it lets the user do, e.g. "edit phrases"
+	Require     Requirement
+}
+
+// Every action guilds can set roles for
+var actions = []*Action{phraseEditAction, forceSkipAction}
+
+func findAction(name string) (*Action, bool) {
+	for _, action := range actions {
+		if action.Name == name {
+			return action, true
+		}
+	}
+	return nil, false
+}
+
+// Names of the actions guilds can set roles for, for listing in settings
+func actionNames() string {
+	names := []string{}
+	for _, action := range actions {
+		if !action.Require.OwnerOnly {
+			names = append(names, action.Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Bot owners on top of the ones in config, such as the console user
+var ExtraOwnerIDs = []string{}
+
+func IsOwner(userID string) bool {
+	return slices.Contains(config.Get().OwnerIDs, userID) || slices.Contains(ExtraOwnerIDs, userID)
+}
+
+/*
+Check the author of a command is allowed to use it in this guild. Returns a message for
+the user explaining why if not. Every decision on a restricted command is logged
+*/
+func CheckAccess(ctx *util.Context, cmd *Command) (bool, string) {
+	allowed, reason := checkAccess(ctx, cmd.Name, cmd.Require)
+	if allowed {
+		return true, ""
+	}
+	return false, fmt.Sprintf("You can't use %s%s: %s", ctx.Prefix, cmd.Name, reason)
+}
+
+// Check the author of a command is allowed to carry out an action within it, like CheckAccess
+func CheckAction(ctx *util.Context, action *Action) (bool, string) {
+	allowed, reason := checkAccess(ctx, action.Name, action.Require)
+	if allowed {
+		return true, ""
+	}
+	return false, fmt.Sprintf("You can't %s: %s", action.Description, reason)
+}
+
+func checkAccess(ctx *util.Context, name string, require Requirement) (bool, string) {
+	// Guilds can't open up what only the bot owner can do
+	roles, overridden := store.Guild(ctx.GuildID).CommandRoles[name]
+	overridden = overridden && !require.OwnerOnly
+	if overridden {
+		require.Roles = roles
+		require.Permissions = 0
+	}
+	if require.IsEmpty() {
+		return true, ""
+	}
+
+	allowed, reason := checkRequirement(ctx, require, overridden || require.StrictRoles)
+	if allowed {
+		log.Printf(
+			"Access: allowed %s to %s (%s) in guild %s",
+			name, ctx.Author.Username, ctx.Author.ID, ctx.GuildID,
+		)
+		return true, ""
+	}
+	log.Printf(
+		"Access: denied %s to %s (%s) in guild %s: %s",
+		name, ctx.Author.Username, ctx.Author.ID, ctx.GuildID, reason,
+	)
+	return false, reason
+}
+
+func checkRequirement(ctx *util.Context, require Requirement, strictRoles bool) (bool, string) {
+	if IsOwner(ctx.Author.ID) {
+		return true, ""
+	}
+	if require.OwnerOnly {
+		return false, "only the bot owner can use it"
+	}
+	if ctx.GuildID == "" {
+		return false, "it can only be used in a server"
+	}
+
+	perms, err := ctx.Session.UserChannelPermissions(ctx.Author.ID, ctx.ChannelID)
+	if err != nil {
+		log.Printf("Failed to get permissions for %s: %s", ctx.Author.ID, err)
+		return false, "couldn't check your permissions"
+	}
+	if perms&discordgo.PermissionAdministrator != 0 {
+		return true, ""
+	}
+	if perms&require.Permissions != require.Permissions {
+		return false, fmt.Sprintf("you need the %s permission", permissionName(require.Permissions))
+	}
+	// Server managers don't need roles
+	if perms&discordgo.PermissionManageServer != 0 {
+		return true, ""
+	}
+
+	roles := require.Roles
+	if !strictRoles {
+		roles = existingRoles(ctx, roles)
+	}
+	if len(roles) == 0 || hasAnyRole(ctx, roles) {
+		return true, ""
+	}
+	return false, fmt.Sprintf("you need the %s role", strings.Join(roles, " or "))
+}
+
+// Filter role names or IDs down to the ones that exist in the guild
+func existingRoles(ctx *util.Context, roles []string) []string {
+	guildRoles, err := ctx.Session.GuildRoles(ctx.GuildID)
+	if err != nil {
+		return roles
+	}
+	existing := []string{}
+	for _, role := range roles {
+		for _, guildRole := range guildRoles {
+			if roleMatches(guildRole, role) {
+				existing = append(existing, role)
+				break
+			}
+		}
+	}
+	return existing
+}
+
+func hasAnyRole(ctx *util.Context, roles []string) bool {
+	member := ctx.Member
+	if member == nil {
+		var err error
+		if member, err = ctx.Session.GuildMember(ctx.GuildID, ctx.Author.ID); err != nil {
+			return false
+		}
+	}
+	guildRoles, err := ctx.Session.GuildRoles(ctx.GuildID)
+	if err != nil {
+		return false
+	}
+	for _, guildRole := range guildRoles {
+		if !slices.Contains(member.Roles, guildRole.ID) {
+			continue
+		}
+		for _, role := range roles {
+			if roleMatches(guildRole, role) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Roles can be given as names, IDs or mentions
+func roleMatches(guildRole *discordgo.Role, role string) bool {
+	role = strings.TrimSuffix(strings.TrimPrefix(role, "<@&"), ">")
+	return guildRole.ID == role || strings.EqualFold(guildRole.Name, role)
+}
+
+func permissionName(permissions int64) string {
+	names := []string{}
+	for perm, name := range permissionNames {
+		if permissions&perm != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "required"
+	}
+	slices.Sort(names)
+	return strings.Join(names, " and ")
+}
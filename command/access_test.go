@@ -0,0 +1,150 @@
+package command
+
+import (
+	"bluebot/fake"
+	"bluebot/store"
+	"bluebot/util"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Context for a command from "user" in its own guild, starting with the default settings
+func newAccessContext(t *testing.T, session *fake.Session, guildID string) *util.Context {
+	t.Helper()
+	err := store.UpdateGuild(guildID, func(settings *store.GuildSettings) error {
+		*settings = *store.DefaultGuildSettings()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newTestContext(session, "access")
+	ctx.GuildID = guildID
+	return ctx
+}
+
+func assertAccess(t *testing.T, ctx *util.Context, cmd *Command, want bool, wantReason string) {
+	t.Helper()
+	allowed, reason := CheckAccess(ctx, cmd)
+	if allowed != want || reason != wantReason {
+		t.Errorf("CheckAccess(%s) = %t, %q, want %t, %q", cmd.Name, allowed, reason, want, wantReason)
+	}
+}
+
+func TestAccessOwnerOnly(t *testing.T) {
+	session := fake.NewSession()
+	session.Permissions["user"] = discordgo.PermissionAdministrator
+	ctx := newAccessContext(t, session, "access-owner")
+	cmd := &Command{Name: "owner", Require: Requirement{OwnerOnly: true}}
+
+	assertAccess(t, ctx, cmd, false, "You can't use %owner: only the bot owner can use it")
+	old := ExtraOwnerIDs
+	ExtraOwnerIDs = []string{"user"}
+	t.Cleanup(func() { ExtraOwnerIDs = old })
+	assertAccess(t, ctx, cmd, true, "")
+}
+
+func TestAccessPermission(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newAccessContext(t, session, "access-permission")
+	cmd := &Command{Name: "manage", Require: Requirement{Permissions: discordgo.PermissionManageServer}}
+
+	assertAccess(t, ctx, cmd, false, "You can't use %manage: you need the Manage Server permission")
+	session.Permissions["user"] = discordgo.PermissionManageServer
+	assertAccess(t, ctx, cmd, true, "")
+
+	// Administrators pass without the permission itself
+	session.Permissions["user"] = discordgo.PermissionAdministrator
+	assertAccess(t, ctx, cmd, true, "")
+
+	ctx.GuildID = ""
+	session.Permissions["user"] = 0
+	assertAccess(t, ctx, cmd, false, "You can't use %manage: it can only be used in a server")
+}
+
+func TestAccessDefaultRoles(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newAccessContext(t, session, "access-roles")
+	cmd := &Command{Name: "dj", Require: Requirement{Roles: []string{"DJ"}}}
+
+	// Open to everyone until the guild has the role
+	assertAccess(t, ctx, cmd, true, "")
+	session.Roles["access-roles"] = []*discordgo.Role{{ID: "dj-role", Name: "DJ"}}
+	assertAccess(t, ctx, cmd, false, "You can't use %dj: you need the DJ role")
+
+	ctx.Member = &discordgo.Member{Roles: []string{"dj-role"}}
+	assertAccess(t, ctx, cmd, true, "")
+
+	// Server managers and admins don't need the role
+	ctx.Member = &discordgo.Member{}
+	session.Permissions["user"] = discordgo.PermissionManageServer
+	assertAccess(t, ctx, cmd, true, "")
+	session.Permissions["user"] = discordgo.PermissionAdministrator
+	assertAccess(t, ctx, cmd, true, "")
+}
+
+func TestAccessOverriddenRoles(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newAccessContext(t, session, "access-override")
+	cmd := &Command{Name: "dj", Require: Requirement{Roles: []string{"DJ"}}}
+	err := store.UpdateGuild("access-override", func(settings *store.GuildSettings) error {
+		settings.CommandRoles["dj"] = []string{"Mods"}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Roles a guild sets are required even before it creates them
+	assertAccess(t, ctx, cmd, false, "You can't use %dj: you need the Mods role")
+	session.Roles["access-override"] = []*discordgo.Role{{ID: "mods-role", Name: "Mods"}}
+	ctx.Member = &discordgo.Member{Roles: []string{"mods-role"}}
+	assertAccess(t, ctx, cmd, true, "")
+
+	// Roles replace the permission a command needs
+	manage := &Command{Name: "manage", Require: Requirement{Permissions: discordgo.PermissionManageServer}}
+	assertAccess(t, ctx, manage, false, "You can't use %manage: you need the Manage Server permission")
+	err = store.UpdateGuild("access-override", func(settings *store.GuildSettings) error {
+		settings.CommandRoles["manage"] = []string{"Mods"}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAccess(t, ctx, manage, true, "")
+
+	// Setting no roles opens the command to everyone
+	err = store.UpdateGuild("access-override", func(settings *store.GuildSettings) error {
+		settings.CommandRoles["dj"] = []string{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Member = &discordgo.Member{}
+	assertAccess(t, ctx, cmd, true, "")
+}
+
+func TestAccessAction(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newAccessContext(t, session, "access-action")
+	action := &Action{Name: "act", Description: "do things", Require: Requirement{Roles: []string{"Doers"}}}
+	session.Roles["access-action"] = []*discordgo.Role{{ID: "doers", Name: "Doers"}}
+
+	allowed, reason := CheckAction(ctx, action)
+	if allowed || reason != "You can't do things: you need the Doers role" {
+		t.Errorf("CheckAction = %t, %q", allowed, reason)
+	}
+	// Guilds set roles for the action by its name
+	err := store.UpdateGuild("access-action", func(settings *store.GuildSettings) error {
+		settings.CommandRoles["act"] = []string{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, reason = CheckAction(ctx, action); !allowed {
+		t.Errorf("expected the action to be open to everyone: %s", reason)
+	}
+}
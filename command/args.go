@@ -0,0 +1,263 @@
+package command
+
+import (
+	"bluebot/util"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/exp/slices"
+)
+
+type ArgKind int
+
+const (
+	ArgString   ArgKind = iota // A single word (or quoted phrase)
+	ArgInt                     // Whole number, at least Min and at most Max when they're set
+	ArgIntRange                // Two whole numbers as "a-b", each limited like ArgInt
+	ArgEnum                    // One of the values returned by Choices
+	ArgURL                     // http(s) link
+	ArgUser                    // User mention or ID
+	ArgRest                    // Everything left on the line
+	ArgList                    // Everything left on the line as separate arguments
+)
+
+// Limit on the number of choices a slash command option can have
+const maxOptionChoices = 25
+
+var mentionRegex = regexp.MustCompile(`^<@!?(\d+)>$|^(\d+)$`)
+
+// Declaration of one argument a command takes
+type Arg struct {
+	Name        string
+	Description string
+	Kind        ArgKind
+	Required    bool
+	Min         int // No lower limit if 0
+	Max         int // No upper limit if 0
+	Choices     func() []string
+}
+
+// Arguments parsed according to a spec, looked up by name
+type ParsedArgs struct {
+	values map[string]interface{}
+}
+
+// Error for invalid command input, shown to the user along with the command's usage
+type UsageError struct {
+	Message string
+}
+
+func (e *UsageError) Error() string {
+	return e.Message
+}
+
+func usageErrorf(format string, a ...interface{}) *UsageError {
+	return &UsageError{fmt.Sprintf(format, a...)}
+}
+
+/*
+Parse arguments by position according to a spec. Returns a UsageError if any are missing
+or invalid, or if too many are given
+*/
+func ParseArgs(spec []*Arg, args []string) (*ParsedArgs, error) {
+	return parseArgs(spec, args, func(rest []string) string { return strings.Join(rest, " ") })
+}
+
+/*
+Parse arguments like ParseArgs, but with ArgRest taken from the command line as it was typed so
+any quotes and backslashes are kept. Falls back to joining the arguments when they didn't come
+from the line, e.g. for slash commands and buttons
+*/
+func ParseArgsFrom(ctx *util.Context, spec []*Arg, args []string) (*ParsedArgs, error) {
+	return parseArgs(spec, args, func(rest []string) string {
+		if raw, ok := util.RawRest(ctx.Line, rest); ok {
+			return raw
+		}
+		return strings.Join(rest, " ")
+	})
+}
+
+func parseArgs(spec []*Arg, args []string, joinRest func([]string) string) (*ParsedArgs, error) {
+	parsed := &ParsedArgs{make(map[string]interface{}, len(spec))}
+	i := 0
+	for _, arg := range spec {
+		if i >= len(args) {
+			if arg.Required {
+				return nil, usageErrorf("Missing %s", arg.Name)
+			}
+			continue
+		}
+		if arg.Kind == ArgRest {
+			parsed.values[arg.Name] = joinRest(args[i:])
+			i = len(args)
+			continue
+		}
+		if arg.Kind == ArgList {
+			parsed.values[arg.Name] = args[i:]
+			i = len(args)
+			continue
+		}
+		value, err := arg.parse(args[i])
+		if err != nil {
+			return nil, err
+		}
+		parsed.values[arg.Name] = value
+		i++
+	}
+	if i < len(args) {
+		return nil, usageErrorf("Too many arguments given")
+	}
+	return parsed, nil
+}
+
+func (a *Arg) parse(value string) (interface{}, error) {
+	switch a.Kind {
+	case ArgInt:
+		return a.parseInt(value)
+
+	case ArgIntRange:
+		ends := strings.Split(value, "-")
+		if len(ends) != 2 {
+			return nil, usageErrorf("%s must be two numbers like 2-6", a.Name)
+		}
+		start, err := a.parseInt(ends[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := a.parseInt(ends[1])
+		if err != nil {
+			return nil, err
+		}
+		return [2]int{start, end}, nil
+
+	case ArgEnum:
+		choices := a.Choices()
+		if !slices.Contains(choices, value) {
+			return nil, usageErrorf("%s must be one of: %s", a.Name, strings.Join(choices, ", "))
+		}
+		return value, nil
+
+	case ArgURL:
+		if !isLink(value) {
+			return nil, usageErrorf("%s must be a link", a.Name)
+		}
+		return value, nil
+
+	case ArgUser:
+		match := mentionRegex.FindStringSubmatch(value)
+		if match == nil {
+			return nil, usageErrorf("%s must be a user mention", a.Name)
+		}
+		if match[1] != "" {
+			return match[1], nil
+		}
+		return match[2], nil
+
+	default:
+		return value, nil
+	}
+}
+
+// Whether value is an http(s) link, as taken by ArgURL
+func isLink(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (a *Arg) parseInt(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, usageErrorf("%s must be a whole number", a.Name)
+	}
+	switch {
+	case a.Min != 0 && a.Max != 0 && (n < a.Min || n > a.Max):
+		return 0, usageErrorf("%s must be between %d and %d", a.Name, a.Min, a.Max)
+	case a.Min != 0 && n < a.Min:
+		return 0, usageErrorf("%s must be at least %d", a.Name, a.Min)
+	case a.Max != 0 && n > a.Max:
+		return 0, usageErrorf("%s must be at most %d", a.Name, a.Max)
+	}
+	return n, nil
+}
+
+// Usage text for the argument e.g. <name> or [name]
+func (a *Arg) Usage() string {
+	name := a.Name
+	if a.Kind == ArgRest || a.Kind == ArgList {
+		name += "..."
+	}
+	if a.Required {
+		return "<" + name + ">"
+	}
+	return "[" + name + "]"
+}
+
+// Slash command option matching the argument
+func (a *Arg) Option() *discordgo.ApplicationCommandOption {
+	description := a.Description
+	if description == "" {
+		description = a.Name
+	}
+	option := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        a.Name,
+		Description: description,
+		Required:    a.Required,
+	}
+	switch a.Kind {
+	case ArgInt:
+		option.Type = discordgo.ApplicationCommandOptionInteger
+		if a.Min != 0 {
+			min := float64(a.Min)
+			option.MinValue = &min
+		}
+		if a.Max != 0 {
+			option.MaxValue = float64(a.Max)
+		}
+	case ArgUser:
+		option.Type = discordgo.ApplicationCommandOptionUser
+	case ArgEnum:
+		for _, choice := range a.Choices() {
+			if len(option.Choices) == maxOptionChoices {
+				break
+			}
+			option.Choices = append(option.Choices, &discordgo.ApplicationCommandOptionChoice{
+				Name: choice, Value: choice,
+			})
+		}
+	}
+	return option
+}
+
+func (p *ParsedArgs) Has(name string) bool {
+	_, ok := p.values[name]
+	return ok
+}
+
+// Get a string valued argument (string, enum, URL, user ID or rest), empty if not given
+func (p *ParsedArgs) String(name string) string {
+	value, _ := p.values[name].(string)
+	return value
+}
+
+// Get a list argument, nil if not given
+func (p *ParsedArgs) Strings(name string) []string {
+	value, _ := p.values[name].([]string)
+	return value
+}
+
+// Get an integer argument, 0 if not given
+func (p *ParsedArgs) Int(name string) int {
+	value, _ := p.values[name].(int)
+	return value
+}
+
+// Get both ends of an integer range argument
+func (p *ParsedArgs) Range(name string) (int, int) {
+	value, _ := p.values[name].([2]int)
+	return value[0], value[1]
+}
@@ -0,0 +1,129 @@
+package command
+
+import (
+	"bluebot/util"
+	"reflect"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var testArgSpec = []*Arg{
+	{Name: "word", Kind: ArgString, Required: true},
+	{Name: "count", Kind: ArgInt, Min: 1},
+	{Name: "rest", Kind: ArgRest},
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want map[string]interface{}
+	}{
+		{[]string{"a"}, map[string]interface{}{"word": "a"}},
+		{[]string{"a", "3"}, map[string]interface{}{"word": "a", "count": 3}},
+		{[]string{"a", "3", "the", "rest"}, map[string]interface{}{"word": "a", "count": 3, "rest": "the rest"}},
+	}
+	for _, test := range tests {
+		parsed, err := ParseArgs(testArgSpec, test.args)
+		if err != nil || !reflect.DeepEqual(parsed.values, test.want) {
+			t.Errorf("ParseArgs(%q) = %v, %v, want %v", test.args, parsed, err, test.want)
+		}
+	}
+	for _, args := range [][]string{nil, {"a", "x"}, {"a", "0"}, {"a", "-2"}} {
+		if _, err := ParseArgs(testArgSpec, args); err == nil {
+			t.Errorf("expected ParseArgs(%q) to fail", args)
+		} else {
+			assertUsageError(t, err)
+		}
+	}
+}
+
+func TestParseArgsFromLine(t *testing.T) {
+	ctx := newTestContext(nil, "args")
+	ctx.Line = `phrase add say  Today is {{.Time.Format "Monday"}}\n `
+	spec := []*Arg{
+		{Name: "action", Kind: ArgString},
+		{Name: "command", Kind: ArgString},
+		{Name: "text", Kind: ArgRest},
+	}
+	args, err := util.SplitArgs(ctx.Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseArgsFrom(ctx, spec, args[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := parsed.String("text"); text != `Today is {{.Time.Format "Monday"}}\n` {
+		t.Errorf("expected the text as typed, got %q", text)
+	}
+
+	// Arguments that aren't from the line, like slash command options, are joined
+	parsed, err = ParseArgsFrom(ctx, spec, []string{"add", "say", `"quoted"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := parsed.String("text"); text != `"quoted"` {
+		t.Errorf("expected the given text, got %q", text)
+	}
+}
+
+func TestParseArgsLimits(t *testing.T) {
+	spec := []*Arg{
+		{Name: "min", Kind: ArgInt, Min: 1},
+		{Name: "max", Kind: ArgInt, Max: 10},
+		{Name: "range", Kind: ArgIntRange, Min: 1, Max: 8},
+		{Name: "list", Kind: ArgList},
+	}
+	parsed, err := ParseArgs(spec, []string{"100", "-5", "2-8", "x", "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start, end := parsed.Range("range"); parsed.Int("min") != 100 || parsed.Int("max") != -5 || start != 2 || end != 8 {
+		t.Errorf("unexpected values %v", parsed.values)
+	}
+	if list := parsed.Strings("list"); !reflect.DeepEqual(list, []string{"x", "y"}) {
+		t.Errorf("unexpected list %q", list)
+	}
+	for _, args := range [][]string{{"0"}, {"1", "11"}, {"1", "1", "0-8"}, {"1", "1", "2-9"}, {"1", "1", "2"}} {
+		if _, err := ParseArgs(spec, args); err == nil {
+			t.Errorf("expected ParseArgs(%q) to fail", args)
+		}
+	}
+}
+
+func TestParseArgsLinksAndUsers(t *testing.T) {
+	spec := []*Arg{
+		{Name: "link", Kind: ArgURL},
+		{Name: "user", Kind: ArgUser},
+	}
+	for _, args := range [][]string{
+		{"https://youtu.be/abc", "<@123>"},
+		{"http://youtu.be/abc", "<@!123>"},
+		{"https://youtu.be/abc", "123"},
+	} {
+		parsed, err := ParseArgs(spec, args)
+		if err != nil || parsed.String("link") != args[0] || parsed.String("user") != "123" {
+			t.Errorf("ParseArgs(%q) = %v, %v", args, parsed, err)
+		}
+	}
+	for _, args := range [][]string{{"youtu.be/abc"}, {"ftp://youtu.be/abc"}, {"https://"}, {"https://x.com", "@user"}} {
+		if _, err := ParseArgs(spec, args); err == nil {
+			t.Errorf("expected ParseArgs(%q) to fail", args)
+		}
+	}
+	if option := spec[1].Option(); option.Type != discordgo.ApplicationCommandOptionUser {
+		t.Errorf("expected a user option, got %v", option.Type)
+	}
+}
+
+func TestArgOptionLimits(t *testing.T) {
+	option := (&Arg{Name: "page", Kind: ArgInt, Min: 1}).Option()
+	if option.MinValue == nil || *option.MinValue != 1 || option.MaxValue != 0 {
+		t.Errorf("expected only a min value, got %v and %v", option.MinValue, option.MaxValue)
+	}
+	option = (&Arg{Name: "seconds", Kind: ArgInt, Min: 1, Max: 3600}).Option()
+	if option.MinValue == nil || *option.MinValue != 1 || option.MaxValue != 3600 {
+		t.Errorf("expected min and max values, got %v and %v", option.MinValue, option.MaxValue)
+	}
+}
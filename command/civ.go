@@ -2,6 +2,7 @@ package command
 
 import (
 	"bluebot/config"
+	"bluebot/util"
 	"crypto/rand"
 	"encoding/csv"
 	"fmt"
@@ -11,7 +12,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/jellydator/ttlcache/v3"
 )
 
@@ -19,33 +19,47 @@ var (
 	DefaultMaxTier int = 1 // NOTE: tiers are inverse to expected
 	DefaultMinTier int = 8
 	Settings       *ttlcache.Cache[string, *Setting]
-	TTL            = time.Duration(config.Cfg.SettingsDurationS) * time.Second
 )
 
+var tierArgs = []*Arg{
+	{
+		Name:     "range",
+		Kind:     ArgIntRange,
+		Required: true,
+		Min:      DefaultMaxTier,
+		Max:      DefaultMinTier,
+	},
+}
+
 type Setting struct {
 	MaxTier int
 	MinTier int
 	Players []string
 }
 
-func HandleCiv(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
+func HandleCiv(ctx *util.Context, args []string) error {
 	if Settings == nil {
 		CreateSettingsCache()
 	}
 	if len(args) > 0 && args[0] == "tiers" {
-		return setTiers(session, msg, args)
+		return setTiers(ctx, args)
 	} else {
-		return generateCivs(session, msg, args)
+		return generateCivs(ctx, args)
 	}
 }
 
 func CreateSettingsCache() {
 	Settings = ttlcache.New(
-		ttlcache.WithTTL[string, *Setting](TTL),
+		ttlcache.WithTTL[string, *Setting](settingsTTL()),
 	)
 	go Settings.Start()
 }
 
+// How long a channel's civ settings are kept, read from config each time so reloads apply
+func settingsTTL() time.Duration {
+	return time.Duration(config.Get().SettingsDurationS) * time.Second
+}
+
 func NewDefaultSetting() *Setting {
 	return &Setting{DefaultMaxTier, DefaultMinTier, []string{}}
 }
@@ -54,19 +68,18 @@ func NewDefaultSetting() *Setting {
 	Generate a random selection of civs for provided or previously saved players within saved
 	or default min/max tiers
 */
-func generateCivs(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
+func generateCivs(ctx *util.Context, args []string) error {
 	// Check if settings exist and create new if not
-	settings := Settings.Get(msg.ChannelID)
+	settings := Settings.Get(ctx.ChannelID)
 	if settings == nil {
-		settings = Settings.Set(msg.ChannelID, NewDefaultSetting(), TTL)
+		settings = Settings.Set(ctx.ChannelID, NewDefaultSetting(), settingsTTL())
 	}
 	// Don't overwrite preexisting settings
 	if len(args) != 0 {
 		settings.Value().Players = args
 	}
 	if len(settings.Value().Players) == 0 {
-		session.ChannelMessageSend(msg.ChannelID, "Please provide some players")
-		return nil
+		return UserError("Please provide some players")
 	}
 
 	civs, err := readCivList()
@@ -81,9 +94,9 @@ func generateCivs(session *discordgo.Session, msg *discordgo.MessageCreate, args
 			i--
 		}
 	}
-	if len(civs) < config.Cfg.CivSelections*len(settings.Value().Players) {
-		session.ChannelMessageSend(msg.ChannelID, "Not enough civs for the criteria given")
-		return nil
+	selections := config.Get().CivSelections
+	if len(civs) < selections*len(settings.Value().Players) {
+		return UserError("Not enough civs for the criteria given")
 	}
 
 	// Generate random civs
@@ -91,8 +104,8 @@ func generateCivs(session *discordgo.Session, msg *discordgo.MessageCreate, args
 	for _, player := range settings.Value().Players {
 		// Add name in bold and enough spaces to match the longest player name
 		output += fmt.Sprintf("**%s**: ", player)
-		selected := make([]string, 0, config.Cfg.CivSelections)
-		for n := 0; n < config.Cfg.CivSelections; n++ {
+		selected := make([]string, 0, selections)
+		for n := 0; n < selections; n++ {
 			// New rand int
 			max := big.NewInt(int64(len(civs)))
 			r, _ := rand.Int(rand.Reader, max)
@@ -105,7 +118,7 @@ func generateCivs(session *discordgo.Session, msg *discordgo.MessageCreate, args
 		output += strings.Join(selected, ", ") + "\n"
 	}
 
-	session.ChannelMessageSend(msg.ChannelID, output)
+	ctx.Send(output)
 	return nil
 }
 
@@ -113,7 +126,7 @@ func generateCivs(session *discordgo.Session, msg *discordgo.MessageCreate, args
 	Read civ list from CSV
 */
 func readCivList() ([][]string, error) {
-	file, err := os.Open(config.Cfg.CivListPath)
+	file, err := os.Open(config.Get().CivListPath)
 	if err != nil {
 		return nil, err
 	}
@@ -128,26 +141,16 @@ func readCivList() ([][]string, error) {
 /*
 	Set the tiers for this text channel
 */
-func setTiers(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	tiers := strings.Split(args[1], "-")
-	if len(tiers) != 2 {
-		session.ChannelMessageSend(msg.ChannelID, "Wrong number of tiers")
-		return nil
-	}
-	tier1, err := strconv.Atoi(tiers[0])
-	if err != nil || tier1 < DefaultMaxTier || tier1 > DefaultMinTier {
-		session.ChannelMessageSend(msg.ChannelID, "Invalid tier")
-		return nil
-	}
-	tier2, err := strconv.Atoi(tiers[1])
-	if err != nil || tier2 < DefaultMaxTier || tier2 > DefaultMinTier {
-		session.ChannelMessageSend(msg.ChannelID, "Invalid tier")
-		return nil
+func setTiers(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgs(tierArgs, args[1:])
+	if err != nil {
+		return err
 	}
+	tier1, tier2 := parsed.Range("range")
 
-	settings := Settings.Get(msg.ChannelID)
+	settings := Settings.Get(ctx.ChannelID)
 	if settings == nil {
-		settings = Settings.Set(msg.ChannelID, NewDefaultSetting(), TTL)
+		settings = Settings.Set(ctx.ChannelID, NewDefaultSetting(), settingsTTL())
 	}
 	if tier1 < tier2 {
 		settings.Value().MaxTier = tier1
@@ -156,7 +159,7 @@ func setTiers(session *discordgo.Session, msg *discordgo.MessageCreate, args []s
 		settings.Value().MaxTier = tier2
 		settings.Value().MinTier = tier1
 	}
-	session.ChannelMessageSend(msg.ChannelID, fmt.Sprintf(
+	ctx.Send(fmt.Sprintf(
 		"Min and max tiers set to %d and %d",
 		settings.Value().MinTier,
 		settings.Value().MaxTier,
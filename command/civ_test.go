@@ -0,0 +1,88 @@
+package command
+
+import (
+	"bluebot/fake"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var civTierRegex = regexp.MustCompile(`\*\*\*[^*]+\*\*\* \((\d)\)`)
+
+func TestCivRollsForEachPlayer(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newTestContext(session, "civ-roll")
+
+	if err := HandleCiv(ctx, []string{"alice", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(session.LastMessage().Content), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a line per player, got %q", lines)
+	}
+	for i, player := range []string{"alice", "bob"} {
+		if !strings.HasPrefix(lines[i], "**"+player+"**: ") {
+			t.Errorf("line %d should be for %s: %q", i, player, lines[i])
+		}
+		if n := len(civTierRegex.FindAllString(lines[i], -1)); n != 3 {
+			t.Errorf("expected 3 civs for %s, got %d", player, n)
+		}
+	}
+}
+
+func TestCivRemembersPlayers(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newTestContext(session, "civ-remember")
+
+	if err := HandleCiv(ctx, []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := HandleCiv(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(session.LastMessage().Content, "**alice**") {
+		t.Errorf("expected the previous players to be used: %q", session.LastMessage().Content)
+	}
+}
+
+func TestCivNeedsPlayers(t *testing.T) {
+	err := HandleCiv(newTestContext(fake.NewSession(), "civ-empty"), nil)
+	assertErrorKind(t, err, ErrUser)
+}
+
+func TestCivNotEnoughCivs(t *testing.T) {
+	players := make([]string, 20)
+	for i := range players {
+		players[i] = strconv.Itoa(i)
+	}
+	err := HandleCiv(newTestContext(fake.NewSession(), "civ-many"), players)
+	assertErrorKind(t, err, ErrUser)
+}
+
+func TestCivTiers(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newTestContext(session, "civ-tiers")
+
+	if err := HandleCiv(ctx, []string{"tiers", "3-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := session.LastMessage().Content; got != "Min and max tiers set to 3 and 2" {
+		t.Errorf("unexpected reply: %q", got)
+	}
+	if err := HandleCiv(ctx, []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range civTierRegex.FindAllStringSubmatch(session.LastMessage().Content, -1) {
+		if match[1] != "2" && match[1] != "3" {
+			t.Errorf("civ outside of tiers 2-3: %s", match[0])
+		}
+	}
+}
+
+func TestCivInvalidTiers(t *testing.T) {
+	ctx := newTestContext(fake.NewSession(), "civ-invalid")
+	for _, args := range [][]string{{"tiers"}, {"tiers", "0-9"}, {"tiers", "two"}} {
+		assertUsageError(t, HandleCiv(ctx, args))
+	}
+}
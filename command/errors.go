@@ -0,0 +1,197 @@
+package command
+
+import (
+	"bluebot/config"
+	"bluebot/util"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bwmarrin/discordgo"
+	"google.golang.org/api/googleapi"
+)
+
+type ErrorKind int
+
+const (
+	ErrInternal    ErrorKind = iota // A bug or broken setup on our side
+	ErrUser                         // Something the user can fix by changing what they asked for
+	ErrUnavailable                  // An external service failed or took too long
+	ErrQuota                        // An external service's quota has been used up
+)
+
+// Embed colours for each kind of error
+var errorColours = map[ErrorKind]int{
+	ErrInternal:    0xd83c3e,
+	ErrUser:        0xf0b232,
+	ErrUnavailable: 0x5865f2,
+	ErrQuota:       0x5865f2,
+}
+
+/*
+Error returned by a handler to control what the user is told. Message is shown to the user
+and the cause in Err is only logged. An empty message uses a default for the kind
+*/
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Service string // Name of the external service for unavailable and quota errors
+	Err     error
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.defaultMessage()
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", msg, e.Err)
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// What the user is told, without the cause which is only logged
+func (e *Error) userMessage() string {
+	if e.Message == "" {
+		return e.defaultMessage()
+	}
+	return e.Message
+}
+
+func (e *Error) defaultMessage() string {
+	service := e.Service
+	if service == "" {
+		service = "A service I rely on"
+	}
+	switch e.Kind {
+	case ErrUser:
+		return "That didn't work"
+	case ErrUnavailable:
+		return service + " isn't responding right now, try again in a bit"
+	case ErrQuota:
+		return service + " has been used too much today, try again tomorrow"
+	default:
+		return "Something went wrong on my end"
+	}
+}
+
+func (e *Error) title() string {
+	switch e.Kind {
+	case ErrUser:
+		return "Can't do that"
+	case ErrUnavailable:
+		return "Service unavailable"
+	case ErrQuota:
+		return "Quota exceeded"
+	default:
+		return "Internal error"
+	}
+}
+
+func UserError(format string, a ...interface{}) *Error {
+	return &Error{Kind: ErrUser, Message: fmt.Sprintf(format, a...)}
+}
+
+func InternalError(message string, err error) *Error {
+	return &Error{Kind: ErrInternal, Message: message, Err: err}
+}
+
+/*
+Wrap an error from an external service. Google API quota and rate limit responses become
+quota errors and everything else, including timeouts, becomes unavailable
+*/
+func ServiceError(service string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var cmdErr *Error
+	if errors.As(err, &cmdErr) {
+		return err
+	}
+	kind := ErrUnavailable
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && isQuotaError(apiErr) {
+		kind = ErrQuota
+	}
+	e := &Error{Kind: kind, Service: service, Err: err}
+	if errors.Is(err, context.DeadlineExceeded) {
+		e.Message = service + " took too long to respond, try again in a bit"
+	}
+	return e
+}
+
+// What the user is told about an error, for errors reported outside of ReplyError
+func errorMessage(err error) string {
+	var cmdErr *Error
+	if !errors.As(err, &cmdErr) {
+		cmdErr = &Error{Kind: ErrInternal, Err: err}
+	}
+	return cmdErr.userMessage()
+}
+
+func isQuotaError(err *googleapi.Error) bool {
+	if err.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if err.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range err.Errors {
+		switch item.Reason {
+		case "quotaExceeded", "dailyLimitExceeded", "rateLimitExceeded", "userRateLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Tell the user why their command failed and log the full cause. Usage errors include the
+command's usage when cmd is given. Errors that aren't a command Error are treated as internal
+*/
+func ReplyError(ctx *util.Context, cmd *Command, err error) {
+	name := "command"
+	if cmd != nil {
+		name = cmd.Name
+	}
+
+	var usageErr *UsageError
+	if errors.As(err, &usageErr) {
+		message := usageErr.Message
+		if cmd != nil {
+			message += fmt.Sprintf("\nUsage: `%s`", cmd.UsageLine(ctx.Prefix))
+		}
+		sendError(ctx, &Error{Kind: ErrUser, Message: message})
+		return
+	}
+
+	var cmdErr *Error
+	if !errors.As(err, &cmdErr) {
+		cmdErr = &Error{Kind: ErrInternal, Err: err}
+	}
+	if cmdErr.Kind == ErrUser {
+		log.Printf("Command %s rejected: %s", name, err)
+	} else {
+		log.Printf("Command %s failed with error: %s", name, err)
+	}
+	sendError(ctx, cmdErr)
+}
+
+func sendError(ctx *util.Context, err *Error) {
+	message := err.userMessage()
+	if !config.Get().ErrorEmbeds {
+		ctx.Send(message)
+		return
+	}
+	ctx.SendEmbed(&discordgo.MessageEmbed{
+		Title:       err.title(),
+		Description: message,
+		Color:       errorColours[err.Kind],
+	})
+}
@@ -0,0 +1,85 @@
+package command
+
+import (
+	"bluebot/config"
+	"bluebot/fake"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestServiceError(t *testing.T) {
+	quota := func(code int, reason string) error {
+		return fmt.Errorf("search: %w", &googleapi.Error{Code: code, Errors: []googleapi.ErrorItem{{Reason: reason}}})
+	}
+	tests := []struct {
+		err     error
+		kind    ErrorKind
+		message string
+	}{
+		{quota(http.StatusTooManyRequests, ""), ErrQuota, "YouTube has been used too much today, try again tomorrow"},
+		{quota(http.StatusForbidden, "quotaExceeded"), ErrQuota, "YouTube has been used too much today, try again tomorrow"},
+		{quota(http.StatusForbidden, "dailyLimitExceeded"), ErrQuota, "YouTube has been used too much today, try again tomorrow"},
+		{quota(http.StatusForbidden, "forbidden"), ErrUnavailable, "YouTube isn't responding right now, try again in a bit"},
+		{quota(http.StatusInternalServerError, ""), ErrUnavailable, "YouTube isn't responding right now, try again in a bit"},
+		{errors.New("connection reset"), ErrUnavailable, "YouTube isn't responding right now, try again in a bit"},
+		{fmt.Errorf("search: %w", context.DeadlineExceeded), ErrUnavailable, "YouTube took too long to respond, try again in a bit"},
+	}
+	for _, test := range tests {
+		err := ServiceError("YouTube", test.err)
+		assertErrorKind(t, err, test.kind)
+		if message := errorMessage(err); message != test.message {
+			t.Errorf("ServiceError(%v) message = %q, want %q", test.err, message, test.message)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("expected ServiceError(%v) to wrap the cause", test.err)
+		}
+	}
+
+	// Errors that already say what went wrong are kept
+	userErr := UserError("No results")
+	if err := ServiceError("YouTube", userErr); err != error(userErr) {
+		t.Errorf("expected the error to pass through, got %v", err)
+	}
+	if err := ServiceError("YouTube", nil); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	old := config.Get().ErrorEmbeds
+	t.Cleanup(func() { config.Get().ErrorEmbeds = old })
+	cmd := &Command{Name: "page", Args: []*Arg{{Name: "number", Kind: ArgInt}}}
+	tests := []struct {
+		err    error
+		embeds bool
+		want   string
+		title  string
+	}{
+		{usageErrorf("number must be a whole number"), false, "number must be a whole number\nUsage: `%page [number]`", ""},
+		{usageErrorf("number must be a whole number"), true, "number must be a whole number\nUsage: `%page [number]`", "Can't do that"},
+		{UserError("Nothing to show"), false, "Nothing to show", ""},
+		{errors.New("disk full"), false, "Something went wrong on my end", ""},
+		{ServiceError("YouTube", errors.New("down")), true, "YouTube isn't responding right now, try again in a bit", "Service unavailable"},
+	}
+	for _, test := range tests {
+		config.Get().ErrorEmbeds = test.embeds
+		session := fake.NewSession()
+		ReplyError(newTestContext(session, "errors"), cmd, test.err)
+
+		message := session.LastMessage()
+		if !test.embeds {
+			if message.Content != test.want || len(message.Embeds) != 0 {
+				t.Errorf("ReplyError(%v) sent %q with %d embeds, want %q", test.err, message.Content, len(message.Embeds), test.want)
+			}
+			continue
+		}
+		if len(message.Embeds) != 1 || message.Embeds[0].Description != test.want || message.Embeds[0].Title != test.title {
+			t.Errorf("ReplyError(%v) sent %+v, want an embed %q: %q", test.err, message, test.title, test.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package command
+
+import (
+	"bluebot/util"
+	"fmt"
+	"strings"
+)
+
+// Discord's limit on message length
+const MaxMessageLen = 2000
+
+var helpArgs = []*Arg{
+	{Name: "command", Description: "Command to show help for", Kind: ArgString},
+}
+
+// Create the help command, which renders its output from the given registry
+func HelpCommand(registry *Registry) *Command {
+	return &Command{
+		Name:     "help",
+		Aliases:  []string{"commands"},
+		Summary:  "List all commands or show how to use one",
+		Category: "General",
+		Args:     helpArgs,
+		Handler: func(ctx *util.Context, args []string) error {
+			parsed, err := ParseArgs(helpArgs, args)
+			if err != nil {
+				return err
+			}
+			if parsed.Has("command") {
+				return showCommandHelp(ctx, registry, parsed.String("command"))
+			}
+			return listCommands(ctx, registry)
+		},
+	}
+}
+
+func listCommands(ctx *util.Context, registry *Registry) error {
+	lines := []string{}
+	category := ""
+	for _, cmd := range registry.Commands() {
+		if cmd.Category != category {
+			category = cmd.Category
+			lines = append(lines, fmt.Sprintf("\n**%s**", category))
+		}
+		lines = append(lines, fmt.Sprintf("`%s` %s", cmd.UsageLine(ctx.Prefix), cmd.Summary))
+	}
+	lines = append(lines, fmt.Sprintf("\nUse `%shelp <command>` for more details", ctx.Prefix))
+	sendLines(ctx, lines)
+	return nil
+}
+
+func showCommandHelp(ctx *util.Context, registry *Registry, name string) error {
+	cmd, ok := registry.Get(strings.TrimPrefix(name, ctx.Prefix))
+	if !ok {
+		ctx.Send(fmt.Sprintf("No command called %s, use `%shelp` to see them all", name, ctx.Prefix))
+		return nil
+	}
+	output := fmt.Sprintf(
+		"**%s%s**\n%s\nUsage: `%s`", ctx.Prefix, cmd.Name, cmd.Summary, cmd.UsageLine(ctx.Prefix),
+	)
+	if len(cmd.Aliases) > 0 {
+		output += "\nAliases: " + strings.Join(cmd.Aliases, ", ")
+	}
+	if !cmd.Require.IsEmpty() {
+		output += "\nRequires: " + cmd.Require.String()
+	}
+	ctx.Send(output)
+	return nil
+}
+
+// Send lines of text, split over as many messages as needed to fit the length limit
+func sendLines(ctx *util.Context, lines []string) {
+	output := ""
+	for _, line := range lines {
+		if len(output)+len(line)+1 > MaxMessageLen {
+			ctx.Send(output)
+			output = ""
+		}
+		output += line + "\n"
+	}
+	if output != "" {
+		ctx.Send(output)
+	}
+}
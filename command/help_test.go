@@ -0,0 +1,87 @@
+package command
+
+import (
+	"bluebot/fake"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func newHelpRegistry() *Registry {
+	registry := NewRegistry()
+	registry.Register(
+		&Command{
+			Name:     "Queue",
+			Aliases:  []string{"Q"},
+			Summary:  "Add a song to the queue",
+			Category: "Music",
+			Args:     []*Arg{{Name: "terms", Kind: ArgRest, Required: true}},
+		},
+		&Command{
+			Name:     "settings",
+			Summary:  "Change settings",
+			Category: "General",
+			Require:  Requirement{Permissions: discordgo.PermissionManageServer},
+		},
+	)
+	registry.Register(HelpCommand(registry))
+	return registry
+}
+
+func TestRegistryLowercasesNames(t *testing.T) {
+	registry := newHelpRegistry()
+	for _, name := range []string{"queue", "QUEUE", "q", "Q"} {
+		if cmd, ok := registry.Get(name); !ok || cmd.Name != "queue" {
+			t.Errorf("expected %s to find queue, got %+v", name, cmd)
+		}
+	}
+	registry.Unregister("Queue")
+	if _, ok := registry.Get("q"); ok {
+		t.Error("expected unregistering to remove the alias")
+	}
+}
+
+func TestHelpListsCommands(t *testing.T) {
+	session := fake.NewSession()
+	cmd, _ := newHelpRegistry().Get("help")
+	if err := cmd.Handler(newTestContext(session, "help"), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "\n**General**\n" +
+		"`%help [command]` List all commands or show how to use one\n" +
+		"`%settings` Change settings\n" +
+		"\n**Music**\n" +
+		"`%queue <terms...>` Add a song to the queue\n" +
+		"\nUse `%help <command>` for more details\n"
+	if content := session.LastMessage().Content; content != want {
+		t.Errorf("unexpected help:\n%s", content)
+	}
+}
+
+func TestHelpShowsCommand(t *testing.T) {
+	session := fake.NewSession()
+	registry := newHelpRegistry()
+	cmd, _ := registry.Get("help")
+	ctx := newTestContext(session, "help")
+
+	if err := cmd.Handler(ctx, []string{"%Q"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "**%queue**\nAdd a song to the queue\nUsage: `%queue <terms...>`\nAliases: q"
+	if content := session.LastMessage().Content; content != want {
+		t.Errorf("unexpected help:\n%s", content)
+	}
+	if err := cmd.Handler(ctx, []string{"settings"}); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; !strings.HasSuffix(content, "\nRequires: Manage Server permission") {
+		t.Errorf("expected the requirement in help, got:\n%s", content)
+	}
+	if err := cmd.Handler(ctx, []string{"nope"}); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "No command called nope, use `%help` to see them all" {
+		t.Errorf("unexpected reply: %q", content)
+	}
+}
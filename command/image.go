@@ -9,30 +9,35 @@ import (
 	"log"
 	"math/big"
 	"os"
-	"strings"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/fogleman/gg"
 )
 
-func HandleShow(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	files, err := ioutil.ReadDir(config.Cfg.SelfImagePath)
+var ImageArgs = []*Arg{
+	{Name: "text", Description: "Text to write", Kind: ArgRest, Required: true},
+}
+
+func HandleShow(ctx *util.Context, args []string) error {
+	files, err := ioutil.ReadDir(config.Get().SelfImagePath)
 	if err != nil {
 		return err
 	}
+	if len(files) == 0 {
+		return InternalError("I don't have any pictures of myself to show", nil)
+	}
 	// Get a random file from the images directory
 	max := big.NewInt(int64(len(files)))
 	randnum, _ := rand.Int(rand.Reader, max)
 	i := randnum.Int64()
 	name := files[i].Name()
 
-	r, err := os.Open(fmt.Sprintf("%s/%s", config.Cfg.SelfImagePath, name))
+	r, err := os.Open(fmt.Sprintf("%s/%s", config.Get().SelfImagePath, name))
 	if err != nil {
 		return err
 	}
 	defer r.Close()
 
-	session.ChannelFileSend(msg.ChannelID, "pic.png", r)
+	ctx.SendFile("pic.png", r)
 	return nil
 }
 
@@ -42,37 +47,37 @@ func HandleShow(session *discordgo.Session, msg *discordgo.MessageCreate, args [
 	provided in the images.json config.
 */
 func HandleImage(
-	session *discordgo.Session,
-	msg *discordgo.MessageCreate,
+	ctx *util.Context,
 	setting *config.ImageSetting,
 	args []string,
 ) error {
-	if len(args) < 1 {
-		session.ChannelMessageSend(msg.ChannelID, "Need something to write")
-		return nil
+	parsed, err := ParseArgsFrom(ctx, ImageArgs, args)
+	if err != nil {
+		return err
 	}
 
 	log.Println(setting)
-	img, err := gg.LoadImage(config.Cfg.ImagePath + "/" + setting.Filename)
+	cfg := config.Get()
+	img, err := gg.LoadImage(cfg.ImagePath + "/" + setting.Filename)
 	if err != nil {
 		return err
 	}
 
 	dc := gg.NewContext(img.Bounds().Dx(), img.Bounds().Dy())
-	if err := dc.LoadFontFace(config.Cfg.ImageFontPath, 40); err != nil {
+	if err := dc.LoadFontFace(cfg.ImageFontPath, 40); err != nil {
 		return err
 	}
 	// Create the image
 	dc.SetRGB(0, 0, 0)
 	dc.DrawImage(img, 0, 0)
 	dc.DrawStringAnchored(
-		strings.Join(args, " "), float64(setting.TextX), float64(setting.TextY), 0.5, 0.5,
+		parsed.String("text"), float64(setting.TextX), float64(setting.TextY), 0.5, 0.5,
 	)
 	randHex, err := util.RandomHex(8)
 	if err != nil {
 		return err
 	}
-	outFilename := config.Cfg.ImagePath + "/" + randHex + ".png"
+	outFilename := cfg.ImagePath + "/" + randHex + ".png"
 	err = dc.SavePNG(outFilename)
 	if err != nil {
 		return err
@@ -85,6 +90,6 @@ func HandleImage(
 	}
 	defer r.Close()
 
-	session.ChannelFileSend(msg.ChannelID, "pic.png", r)
+	ctx.SendFile("pic.png", r)
 	return nil
 }
@@ -0,0 +1,80 @@
+package command
+
+import (
+	"bluebot/config"
+	"bluebot/fake"
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// Write a blank PNG of the given size
+func writePNG(t *testing.T, path string, width, height int) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err = png.Encode(file, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageWritesText(t *testing.T) {
+	dir := t.TempDir()
+	config.Get().ImagePath = dir
+	config.Get().ImageFontPath = filepath.Join(dir, "font.ttf")
+	if err := os.WriteFile(config.Get().ImageFontPath, goregular.TTF, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writePNG(t, filepath.Join(dir, "base.png"), 200, 100)
+	setting := &config.ImageSetting{Filename: "base.png", TextX: 100, TextY: 50}
+
+	session := fake.NewSession()
+	if err := HandleImage(newTestContext(session, "image"), setting, []string{"hello", "there"}); err != nil {
+		t.Fatal(err)
+	}
+	message := session.LastMessage()
+	if message == nil || len(message.Files) != 1 {
+		t.Fatalf("expected an image to be sent, got %+v", message)
+	}
+	img, err := png.Decode(bytes.NewReader(message.Files[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 200 || size.Y != 100 {
+		t.Errorf("expected a 200x100 image, got %s", size)
+	}
+	// Generated image is cleaned up
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("expected only the base image and font to remain, got %d files", len(files))
+	}
+}
+
+func TestImageNeedsText(t *testing.T) {
+	setting := &config.ImageSetting{Filename: "base.png"}
+	assertUsageError(t, HandleImage(newTestContext(fake.NewSession(), "image"), setting, nil))
+}
+
+func TestShow(t *testing.T) {
+	config.Get().SelfImagePath = t.TempDir()
+	session := fake.NewSession()
+	ctx := newTestContext(session, "show")
+
+	assertErrorKind(t, HandleShow(ctx, nil), ErrInternal)
+
+	writePNG(t, filepath.Join(config.Get().SelfImagePath, "me.png"), 10, 10)
+	if err := HandleShow(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if message := session.LastMessage(); message == nil || len(message.Files) != 1 {
+		t.Fatalf("expected a picture to be sent, got %+v", message)
+	}
+}
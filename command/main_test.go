@@ -0,0 +1,68 @@
+package command
+
+import (
+	"bluebot/config"
+	"bluebot/fake"
+	"bluebot/store"
+	"bluebot/util"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestMain(m *testing.M) {
+	config.Get().CivListPath = "../data/civ_list.csv"
+	config.Get().CivSelections = 3
+	dir, err := os.MkdirTemp("", "bluebot-command-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = store.Open(filepath.Join(dir, "test.db")); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	store.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Context for a text command from "user" in a guild channel
+func newTestContext(session *fake.Session, channelID string) *util.Context {
+	ctx := util.NewMessageContext(session, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ChannelID: channelID,
+		GuildID:   "guild",
+		Author:    &discordgo.User{ID: "user", Username: "user"},
+	}})
+	ctx.Prefix = "%"
+	return ctx
+}
+
+func assertErrorKind(t *testing.T, err error, kind ErrorKind) {
+	t.Helper()
+	var cmdErr *Error
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("expected a command error, got %v", err)
+	}
+	if cmdErr.Kind != kind {
+		t.Fatalf("expected error kind %d, got %d: %s", kind, cmdErr.Kind, err)
+	}
+}
+
+// Check an error's kind without stopping the test, for use in other goroutines
+func isErrorKind(err error, kind ErrorKind) bool {
+	var cmdErr *Error
+	return errors.As(err, &cmdErr) && cmdErr.Kind == kind
+}
+
+func assertUsageError(t *testing.T, err error) {
+	t.Helper()
+	var usageErr *UsageError
+	if !errors.As(err, &usageErr) {
+		t.Fatalf("expected a usage error, got %v", err)
+	}
+}
@@ -1,39 +1,39 @@
 package command
 
 import (
-	"bluebot/config"
+	"bluebot/util"
 	"fmt"
-
-	"github.com/bwmarrin/discordgo"
 )
 
-func HandleSay(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	session.ChannelMessageSend(msg.ChannelID, config.GetPhrase("say"))
+func HandleSay(ctx *util.Context, args []string) error {
+	SendPhrase(ctx, "say")
 	return nil
 }
 
-func HandleTaxes(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	session.ChannelMessageSend(msg.ChannelID, config.GetPhrase("taxes"))
+func HandleTaxes(ctx *util.Context, args []string) error {
+	SendPhrase(ctx, "taxes")
 	return nil
 }
 
-func HandleMemeOfTheDay(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	sck, err := NewWorkerSocket()
+func HandleMemeOfTheDay(ctx *util.Context, args []string) error {
+	sck, err := NewWorkerSocket(ctx)
 	if err != nil {
-		return err
+		return ServiceError("The meme worker", err)
+	}
+	defer sck.Close()
+	if err = sck.Send("memeoftheday", nil); err != nil {
+		return ServiceError("The meme worker", err)
 	}
-	sck.Send("memeoftheday", nil)
 	resp, err := sck.Receive()
 	if err != nil {
-		return err
+		return ServiceError("The meme worker", err)
 	}
 
 	data, ok := resp.(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("failed to decode response: %s", resp)
+		return InternalError("", fmt.Errorf("failed to decode response: %s", resp))
 	}
-	session.ChannelMessageSend(
-		msg.ChannelID,
+	ctx.Send(
 		fmt.Sprintf(
 			"**%s**\n*by %s in %s*\n%s\n[⬆️: **%.0f** ⚖️: **%s**]",
 			data["title"],
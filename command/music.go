@@ -1,137 +1,874 @@
 package command
 
 import (
+	"bluebot/store"
 	"bluebot/util"
 	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
-var MusicCommands = map[string]util.HandlerFunc{
-	"queue":  handleQueue,
-	"list":   handleList,
-	"next":   handleNext,
-	"pause":  handlePause,
-	"resume": handleResume,
-	"stop":   handleStop,
+var queueArgs = []*Arg{
+	{Name: "terms", Description: "YouTube URL or search terms", Kind: ArgRest, Required: true},
+}
+
+var searchArgs = []*Arg{
+	{Name: "terms", Description: "What to search YouTube for", Kind: ArgRest, Required: true},
+}
+
+var pickArgs = []*Arg{
+	{Name: "number", Description: "Number of the search result to queue", Kind: ArgInt, Required: true, Min: 1},
+}
+
+var listArgs = []*Arg{
+	{Name: "page", Description: "Page of the queue to show, 1 if not given", Kind: ArgInt},
+}
+
+var seekArgs = []*Arg{
+	{Name: "position", Description: "Time into the track, e.g. 1:23 or 83", Kind: ArgString, Required: true},
+}
+
+var seekByArgs = []*Arg{
+	{Name: "seconds", Description: "Seconds to jump by, 10 if not given", Kind: ArgInt, Min: 1, Max: 3600},
+}
+
+var positionArgs = []*Arg{
+	{Name: "position", Description: "Track number, as shown by list", Kind: ArgInt, Required: true, Min: 1},
+}
+
+var moveArgs = []*Arg{
+	{Name: "from", Description: "Number of the track to move", Kind: ArgInt, Required: true, Min: 1},
+	{Name: "to", Description: "Number to move it to", Kind: ArgInt, Required: true, Min: 1},
+}
+
+var loopArgs = []*Arg{
+	{
+		Name:        "mode",
+		Description: "What to repeat, shows the current mode if not given",
+		Kind:        ArgEnum,
+		Choices:     func() []string { return []string{LoopOff.String(), LoopTrack.String(), LoopQueue.String()} },
+	},
+}
+
+// Seconds %ff and %rw jump by when not given
+const defaultSeekSeconds = 10
+
+// How often a now playing message is updated while its track plays
+var NowPlayingInterval = 5 * time.Second
+
+// Width of the now playing progress bar in characters
+const progressBarWidth = 20
+
+var MusicCommands = []*Command{
+	{
+		Name:     "queue",
+		Aliases:  []string{"play", "q"},
+		Summary:  "Add a YouTube video or playlist to the queue or start playing, picking from search results",
+		Category: "Music",
+		Args:     queueArgs,
+		Handler:  handleQueue,
+	},
+	{
+		Name:     "queuefirst",
+		Aliases:  []string{"queue!", "play!", "q!"},
+		Summary:  "Add a YouTube video or playlist, or the first search result, to the queue",
+		Category: "Music",
+		Args:     queueArgs,
+		Handler:  handleQueueFirst,
+	},
+	{
+		Name:     "search",
+		Summary:  "Search YouTube and pick one of the top results to queue",
+		Category: "Music",
+		Args:     searchArgs,
+		Handler:  handleSearch,
+	},
+	{
+		Name:     "pick",
+		Summary:  "Queue one of the results of your last search",
+		Category: "Music",
+		Args:     pickArgs,
+		Handler:  handlePick,
+	},
+	{
+		Name:     "list",
+		Aliases:  []string{"ls"},
+		Summary:  "Show the current queue with how long until each track plays",
+		Category: "Music",
+		Args:     listArgs,
+		Handler:  handleList,
+	},
+	{
+		Name:     "np",
+		Aliases:  []string{"nowplaying"},
+		Summary:  "Show the track playing, who queued it and a progress bar, kept up to date",
+		Category: "Music",
+		Handler:  handleNowPlaying,
+	},
+	{
+		Name:     "next",
+		Aliases:  []string{"skip"},
+		Summary:  "Skip forward to the next track, or vote to skip it",
+		Category: "Music",
+		Handler:  handleNext,
+	},
+	{
+		Name:     "pause",
+		Summary:  "Pause the music",
+		Category: "Music",
+		Handler:  handlePause,
+	},
+	{
+		Name:     "resume",
+		Summary:  "Resume the music",
+		Category: "Music",
+		Handler:  handleResume,
+	},
+	{
+		Name:     "remove",
+		Aliases:  []string{"rm"},
+		Summary:  "Remove a track from the queue",
+		Category: "Music",
+		Args:     positionArgs,
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleRemove,
+	},
+	{
+		Name:     "move",
+		Aliases:  []string{"mv"},
+		Summary:  "Move a track to another place in the queue",
+		Category: "Music",
+		Args:     moveArgs,
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleMove,
+	},
+	{
+		Name:     "shuffle",
+		Summary:  "Put the tracks waiting to play in a random order",
+		Category: "Music",
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleShuffle,
+	},
+	{
+		Name:     "clear",
+		Summary:  "Remove every track waiting to play, but keep playing the current one",
+		Category: "Music",
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleClear,
+	},
+	{
+		Name:     "skipto",
+		Summary:  "Skip forward to a track in the queue, removing the ones before it",
+		Category: "Music",
+		Args:     positionArgs,
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleSkipTo,
+	},
+	{
+		Name:     "loop",
+		Aliases:  []string{"repeat"},
+		Summary:  "Repeat the track playing or the whole queue, or turn repeating off",
+		Category: "Music",
+		Args:     loopArgs,
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleLoop,
+	},
+	{
+		Name:     "seek",
+		Summary:  "Jump to a time in the track playing",
+		Category: "Music",
+		Args:     seekArgs,
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleSeek,
+	},
+	{
+		Name:     "ff",
+		Aliases:  []string{"forward"},
+		Summary:  "Jump forward in the track playing",
+		Category: "Music",
+		Args:     seekByArgs,
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleForward,
+	},
+	{
+		Name:     "rw",
+		Aliases:  []string{"rewind"},
+		Summary:  "Jump back in the track playing",
+		Category: "Music",
+		Args:     seekByArgs,
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleRewind,
+	},
+	{
+		Name:     "stop",
+		Summary:  "Stop playing and cancel the whole queue",
+		Category: "Music",
+		Require:  Requirement{Roles: []string{"DJ"}},
+		Handler:  handleStop,
+	},
 }
 
 /*
 Begin the download and playback of audio from a YT video or playlist link or add to the queue
-of an existing subscription
+of an existing subscription. Search terms show the top results to pick from instead
 */
-func handleQueue(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	voiceChannelID := getAuthorVoiceChannel(session, msg)
+func handleQueue(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgsFrom(ctx, queueArgs, args)
+	if err != nil {
+		return err
+	}
+	voiceChannelID := getAuthorVoiceChannel(ctx)
 	if voiceChannelID == "" {
-		session.ChannelMessageSend(msg.ChannelID, "You're not in a voice channel")
-		return nil
+		return UserError("You're not in a voice channel")
 	}
+	terms := parsed.String("terms")
+	if !isLink(terms) {
+		return offerResults(ctx, voiceChannelID, terms)
+	}
+	return queueIn(ctx, voiceChannelID, terms)
+}
 
-	if len(args) < 1 {
-		session.ChannelMessageSend(msg.ChannelID, "No URL given")
-		return nil
+// Queue a link or the first search result straight away, without picking from the results
+func handleQueueFirst(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgsFrom(ctx, queueArgs, args)
+	if err != nil {
+		return err
 	}
+	voiceChannelID := getAuthorVoiceChannel(ctx)
+	if voiceChannelID == "" {
+		return UserError("You're not in a voice channel")
+	}
+	return queueIn(ctx, voiceChannelID, parsed.String("terms"))
+}
 
+// Add to the queue of the player in a voice channel, starting one if none is playing there
+func queueIn(ctx *util.Context, voiceChannelID, query string) error {
 	// Start playing music if none currently being played
-	if _, ok := Subscriptions[voiceChannelID]; !ok {
-		return runPlayer(session, msg, voiceChannelID, args)
+	sub, ok := Subscriptions.Get(voiceChannelID)
+	if !ok {
+		return runPlayer(ctx, voiceChannelID, query)
+	}
+	return sub.AddToQueue(ctx, query)
+}
+
+/*
+Show a page of the queue with each track's length, roughly when it starts and how long the
+queue has left to play. When there's more than one page, buttons switch between them by
+editing the same message
+*/
+func handleList(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgs(listArgs, args)
+	if err != nil {
+		return err
+	}
+	sub, ok := findSubscription(ctx)
+	if !ok {
+		return UserError("No music playing")
+	}
+
+	status := sub.Status()
+	queue := sub.Queue()
+	loop := sub.queue.Loop()
+	pages := (len(queue) + MaxListDisplay - 1) / MaxListDisplay
+	if pages == 0 {
+		pages = 1
+	}
+	// The queue may have shrunk since the buttons were made, so show the last page instead
+	page := 1
+	if parsed.Has("page") {
+		page = parsed.Int("page")
+	}
+	if page > pages {
+		page = pages
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	output := "\\~~\\~~\\~~\\~~\\~~\\~~ Current queue \\~~\\~~\\~~\\~~\\~~\\~~\n"
+	switch loop {
+	case LoopTrack:
+		output += "Looping the current track\n"
+	case LoopQueue:
+		output += "Looping the queue\n"
+	}
+	if status.State == StateBuffering {
+		output += "Downloading the next track...\n"
+	}
+	starts, left, unknown := queueTimes(queue, status)
+	first := (page - 1) * MaxListDisplay
+	for i := first; i < len(queue) && i < first+MaxListDisplay; i++ {
+		output += fmt.Sprintf("%d - %s", i+1, describeTrack(queue[i]))
+		if i == 0 && queue[i] == status.Track {
+			output += " <--"
+			if status.State == StatePaused {
+				output += " (paused)"
+			}
+		} else if starts[i] > 0 && loop != LoopTrack {
+			// A looped track never ends, so nothing after it has a start time
+			output += " - starts in " + formatDuration(starts[i])
+		}
+		output += "\n"
+	}
+	if len(queue) > 0 {
+		footer := fmt.Sprintf("%d tracks", len(queue))
+		if len(queue) == 1 {
+			footer = "1 track"
+		}
+		if pages > 1 {
+			footer = fmt.Sprintf("Page %d of %d, %s", page, pages, footer)
+		}
+		if loop != LoopTrack {
+			if unknown {
+				footer += ", at least " + formatDuration(left) + " to play"
+			} else {
+				footer += ", " + formatDuration(left) + " to play"
+			}
+		}
+		output += footer
+	}
+
+	components := []discordgo.MessageComponent{}
+	if pages > 1 {
+		components = append(components, discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{
+				Label:    "Previous",
+				Style:    discordgo.SecondaryButton,
+				CustomID: fmt.Sprintf("list %d", page-1),
+				Disabled: page == 1,
+			},
+			discordgo.Button{
+				Label:    "Next",
+				Style:    discordgo.SecondaryButton,
+				CustomID: fmt.Sprintf("list %d", page+1),
+				Disabled: page == pages,
+			},
+		}})
 	}
-	sub := Subscriptions[voiceChannelID]
+	_, err = ctx.SendComponents(output, components)
+	return err
+}
 
-	sub.AddToQueue(session, msg.ChannelID, args)
+/*
+Work out how long until each track in the queue starts, 0 for the track playing or if it
+can't be known because a track before it has no length. Also returns how long the queue has
+left to play and whether that leaves out tracks with no length
+*/
+func queueTimes(queue []*Track, status PlayerStatus) ([]time.Duration, time.Duration, bool) {
+	starts := make([]time.Duration, len(queue))
+	var left time.Duration
+	unknown := false
+	for i, track := range queue {
+		if !unknown {
+			starts[i] = left
+		}
+		duration, playing := track.Duration, track == status.Track
+		if playing && status.Duration > 0 {
+			duration = status.Duration
+		}
+		if duration == 0 {
+			unknown = true
+			continue
+		}
+		if playing {
+			// Only what's left of the track playing, which may have run past a rounded length
+			duration -= status.Elapsed
+			if duration < 0 {
+				duration = 0
+			}
+		}
+		left += duration
+	}
+	return starts, left, unknown
+}
+
+/*
+Show the track playing, who queued it and how far into it the player is. The message is
+kept up to date until the track finishes
+*/
+func handleNowPlaying(ctx *util.Context, args []string) error {
+	sub, ok := findSubscription(ctx)
+	if !ok {
+		return UserError("No music playing")
+	}
+	status := sub.Status()
+	switch {
+	case status.Track != nil:
+		message, err := ctx.Send(nowPlayingText(status))
+		if err != nil {
+			return err
+		}
+		ticker := time.NewTicker(NowPlayingInterval)
+		go sub.updateNowPlaying(sub.replaceNowPlaying(), ticker, ctx, message, status.Track)
+	case status.State == StateBuffering:
+		ctx.Send("Nothing is playing yet, the next track is still downloading")
+	default:
+		ctx.Send(fmt.Sprintf("Nothing is playing, add something with `%squeue`", ctx.Prefix))
+	}
 	return nil
 }
 
-func handleList(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	voiceChannelID := getAuthorVoiceChannel(session, msg)
-	if _, ok := Subscriptions[voiceChannelID]; !ok {
-		session.ChannelMessageSend(msg.ChannelID, "No music playing")
-		return nil
+// Stop updating the previous now playing message, returning a context for the new one
+func (sub *Subscription) replaceNowPlaying() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.stopNP != nil {
+		sub.stopNP()
 	}
+	sub.stopNP = cancel
+	return ctx
+}
 
-	sub := Subscriptions[voiceChannelID]
-	output := "\\~~\\~~\\~~\\~~\\~~\\~~ Current queue \\~~\\~~\\~~\\~~\\~~\\~~\n"
-	numTracks := len(sub.QueueView)
-	max := MaxListDisplay
-	if numTracks < max {
-		max = numTracks
+// Edit a now playing message on each tick while its track is playing
+func (sub *Subscription) updateNowPlaying(
+	updateCtx context.Context, ticker *time.Ticker, ctx *util.Context, message *discordgo.Message, track *Track,
+) {
+	defer ticker.Stop()
+	last := message.Content
+	for {
+		select {
+		case <-ticker.C:
+			status := sub.Status()
+			if status.Track != track {
+				return
+			}
+			// Nothing changes while paused
+			if text := nowPlayingText(status); text != last {
+				ctx.Edit(message, text)
+				last = text
+			}
+		case <-updateCtx.Done():
+			return
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+func nowPlayingText(status PlayerStatus) string {
+	text := fmt.Sprintf("Now playing [ %s ]", status.Track.Title)
+	if status.State == StatePaused {
+		text = fmt.Sprintf("Paused [ %s ]", status.Track.Title)
+	}
+	if status.Track.Requester != "" {
+		text += " requested by " + status.Track.Requester
+	}
+	if status.Duration == 0 {
+		return text + "\n" + formatDuration(status.Elapsed)
 	}
-	for i := 0; i < max; i++ {
-		output += fmt.Sprintf("%d - %s", i+1, sub.QueueView[i].Title)
-		if i == 0 {
-			output += " <--\n"
-		} else {
-			output += "\n"
+	return fmt.Sprintf(
+		"%s\n`%s` %s / %s", text, progressBar(status.Elapsed, status.Duration),
+		formatDuration(status.Elapsed), formatDuration(status.Duration),
+	)
+}
+
+// Text progress bar e.g. [=====>--------------]
+func progressBar(elapsed, duration time.Duration) string {
+	filled := int(int64(progressBarWidth) * int64(elapsed) / int64(duration))
+	if filled < 0 {
+		filled = 0
+	} else if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat("-", progressBarWidth-filled-1)
+	}
+	return "[" + bar + "]"
+}
+
+/*
+Skipping straight away without a vote, which servers can give to roles of their own in
+settings. Until a server has a DJ role only its managers can, besides whoever queued the track
+*/
+var forceSkipAction = &Action{
+	Name:        "forceskip",
+	Description: "skip without a vote",
+	Require:     Requirement{Roles: []string{"DJ"}, StrictRoles: true},
+}
+
+/*
+Skip the track playing if the author is a DJ or queued it, otherwise add their vote. The track
+is skipped once enough of the people listening have voted, set by the skipvotes setting
+*/
+func handleNext(ctx *util.Context, args []string) error {
+	sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx))
+	if !ok {
+		return UserError("No music playing")
+	}
+	track := sub.Status().Track
+	if track == nil {
+		return sub.Do(ctx, ActionNext)
+	}
+	percent := store.Guild(ctx.GuildID).SkipVotePercent
+	if allowed, _ := CheckAction(ctx, forceSkipAction); allowed || percent == 0 || track.RequesterID == ctx.Author.ID {
+		if err := sub.Skip(ctx, track); err != nil {
+			return err
 		}
+		ctx.Send("--> Skipped")
+		return nil
+	}
+
+	needed := votesNeeded(percent, countListeners(ctx.Session, ctx.GuildID, sub.ChannelID))
+	voted, votes, added := sub.voteSkip(ctx.Author.ID)
+	if voted == nil {
+		return sub.Do(ctx, ActionNext)
+	}
+	if !added {
+		return UserError("You've already voted to skip [ %s ] (%d/%d votes)", voted.Title, votes, needed)
+	}
+	if votes < needed {
+		ctx.Send(fmt.Sprintf("--> Voted to skip [ %s ] (%d/%d votes)", voted.Title, votes, needed))
+		return nil
+	}
+	if err := sub.Skip(ctx, voted); err != nil {
+		return err
+	}
+	ctx.Send(fmt.Sprintf("--> Skipped [ %s ] (%d/%d votes)", voted.Title, votes, needed))
+	return nil
+}
+
+// Votes needed to skip with a percent of the listeners, at least 1
+func votesNeeded(percent, listeners int) int {
+	needed := (percent*listeners + 99) / 100
+	if needed < 1 {
+		return 1
+	}
+	return needed
+}
+
+func handlePause(ctx *util.Context, args []string) error {
+	return handleAction(ctx, ActionPause, "--> Paused")
+}
+
+func handleResume(ctx *util.Context, args []string) error {
+	return handleAction(ctx, ActionResume, "--> Resumed")
+}
+
+// The player says it's stopping once it has
+func handleStop(ctx *util.Context, args []string) error {
+	return handleAction(ctx, ActionStop, "")
+}
+
+// Have the player in the author's voice channel carry out an action and confirm it
+func handleAction(ctx *util.Context, action PlayerAction, reply string) error {
+	sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx))
+	if !ok {
+		return UserError("No music playing")
+	}
+	if err := sub.Do(ctx, action); err != nil {
+		return err
 	}
-	if numTracks > max {
-		output += fmt.Sprintf("...and %d more tracks", numTracks-max)
+	if reply != "" {
+		ctx.Send(reply)
 	}
-	session.ChannelMessageSend(msg.ChannelID, output)
 	return nil
 }
 
-func handleNext(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	return handleEvent(session, msg, "next")
+func handleRemove(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgs(positionArgs, args)
+	if err != nil {
+		return err
+	}
+	sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx))
+	if !ok {
+		return UserError("No music playing")
+	}
+	track, err := sub.queue.Remove(parsed.Int("position"))
+	if err != nil {
+		return err
+	}
+	deleteTrackFiles([]*Track{track})
+	ctx.Send(fmt.Sprintf("--> Removed [ %s ] from the queue", track.Title))
+	return nil
 }
 
-func handlePause(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	return handleEvent(session, msg, "pause")
+func handleMove(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgs(moveArgs, args)
+	if err != nil {
+		return err
+	}
+	sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx))
+	if !ok {
+		return UserError("No music playing")
+	}
+	track, err := sub.queue.Move(parsed.Int("from"), parsed.Int("to"))
+	if err != nil {
+		return err
+	}
+	ctx.Send(fmt.Sprintf("--> Moved [ %s ] to %d", track.Title, parsed.Int("to")))
+	return nil
 }
 
-func handleResume(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	return handleEvent(session, msg, "resume")
+func handleShuffle(ctx *util.Context, args []string) error {
+	sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx))
+	if !ok {
+		return UserError("No music playing")
+	}
+	count := sub.queue.Shuffle()
+	if count < 2 {
+		return UserError("There aren't enough tracks waiting to shuffle")
+	}
+	ctx.Send(fmt.Sprintf("--> Shuffled %d tracks", count))
+	return nil
 }
 
-func handleStop(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	return handleEvent(session, msg, "stop")
+func handleClear(ctx *util.Context, args []string) error {
+	sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx))
+	if !ok {
+		return UserError("No music playing")
+	}
+	removed := sub.queue.Clear()
+	deleteTrackFiles(removed)
+	message := fmt.Sprintf("--> Removed %d tracks from the queue", len(removed))
+	if n := sub.clearPlaylists(); n > 0 {
+		message += fmt.Sprintf(" and stopped adding %d playlists", n)
+	}
+	ctx.Send(message)
+	return nil
 }
 
-func handleEvent(session *discordgo.Session, msg *discordgo.MessageCreate, event string) error {
-	voiceChannelID := getAuthorVoiceChannel(session, msg)
-	if _, ok := Subscriptions[voiceChannelID]; !ok {
-		session.ChannelMessageSend(msg.ChannelID, "No music playing")
+/*
+Remove the tracks before a position and skip the track playing, so the one at the position
+plays next
+*/
+func handleSkipTo(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgs(positionArgs, args)
+	if err != nil {
+		return err
+	}
+	sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx))
+	if !ok {
+		return UserError("No music playing")
+	}
+	target, playing, removed, err := sub.queue.SkipTo(parsed.Int("position"))
+	if err != nil {
+		return err
+	}
+	deleteTrackFiles(removed)
+	if playing != nil {
+		if err = sub.Skip(ctx, playing); err != nil {
+			return err
+		}
+	}
+	ctx.Send(fmt.Sprintf("--> Skipped to [ %s ]", target.Title))
+	return nil
+}
+
+/*
+Set what's repeated when a track ends. Looped tracks are played from their downloaded file
+again rather than downloaded again
+*/
+func handleLoop(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgs(loopArgs, args)
+	if err != nil {
+		return err
+	}
+	sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx))
+	if !ok {
+		return UserError("No music playing")
+	}
+	if !parsed.Has("mode") {
+		ctx.Send(fmt.Sprintf("Looping is %s, change it with `%sloop off|track|queue`", sub.queue.Loop(), ctx.Prefix))
 		return nil
 	}
-	Subscriptions[voiceChannelID].Events <- event
+	mode := LoopOff
+	switch parsed.String("mode") {
+	case LoopTrack.String():
+		mode = LoopTrack
+	case LoopQueue.String():
+		mode = LoopQueue
+	}
+	sub.queue.SetLoop(mode)
+	switch mode {
+	case LoopTrack:
+		ctx.Send("--> Looping the current track")
+	case LoopQueue:
+		ctx.Send("--> Looping the queue, tracks go back to the end when they finish")
+	default:
+		ctx.Send("--> Stopped looping")
+	}
+	return nil
+}
+
+func handleSeek(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgs(seekArgs, args)
+	if err != nil {
+		return err
+	}
+	position, err := parseTimestamp(parsed.String("position"))
+	if err != nil {
+		return usageErrorf("Give the time to jump to as e.g. 1:23 or 83")
+	}
+	return handleSeekAction(ctx, position, false)
+}
+
+func handleForward(ctx *util.Context, args []string) error {
+	seconds, err := parseSeekSeconds(args)
+	if err != nil {
+		return err
+	}
+	return handleSeekAction(ctx, seconds, true)
+}
+
+func handleRewind(ctx *util.Context, args []string) error {
+	seconds, err := parseSeekSeconds(args)
+	if err != nil {
+		return err
+	}
+	return handleSeekAction(ctx, -seconds, true)
+}
+
+func parseSeekSeconds(args []string) (time.Duration, error) {
+	parsed, err := ParseArgs(seekByArgs, args)
+	if err != nil {
+		return 0, err
+	}
+	seconds := defaultSeekSeconds
+	if parsed.Has("seconds") {
+		seconds = parsed.Int("seconds")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Seek the player in the author's voice channel and say where it jumped to
+func handleSeekAction(ctx *util.Context, position time.Duration, relative bool) error {
+	sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx))
+	if !ok {
+		return UserError("No music playing")
+	}
+	if err := sub.Seek(ctx, position, relative); err != nil {
+		return err
+	}
+	ctx.Send(fmt.Sprintf("--> Jumped to %s", formatDuration(sub.Status().Elapsed)))
 	return nil
 }
 
+/*
+Find the subscription in the author's voice channel, or elsewhere in the guild for commands
+that only show what's playing
+*/
+func findSubscription(ctx *util.Context) (*Subscription, bool) {
+	if sub, ok := Subscriptions.Get(getAuthorVoiceChannel(ctx)); ok {
+		return sub, true
+	}
+	return Subscriptions.ForGuild(ctx.GuildID)
+}
+
+var timestampRegex = regexp.MustCompile(`^(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)s?)?$`)
+
+// Read a time into a track given as seconds, m:ss, h:mm:ss or YouTube's 1h2m3s
+func parseTimestamp(timestamp string) (time.Duration, error) {
+	units := []time.Duration{time.Hour, time.Minute, time.Second}
+	var parts []string
+	if strings.Contains(timestamp, ":") {
+		parts = strings.Split(timestamp, ":")
+		if len(parts) > 3 {
+			return 0, fmt.Errorf("too many parts in %s", timestamp)
+		}
+		units = units[3-len(parts):]
+	} else if match := timestampRegex.FindStringSubmatch(timestamp); match != nil && timestamp != "" {
+		parts = match[1:]
+	} else {
+		return 0, fmt.Errorf("invalid timestamp %s", timestamp)
+	}
+
+	var total time.Duration
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid timestamp %s", timestamp)
+		}
+		total += time.Duration(n) * units[i]
+	}
+	return total, nil
+}
+
+/*
+Longest title shown in the queue, so a full page still fits in a message along with each
+track's details and link
+*/
+const maxListTitleLen = 50
+
+// A track's title with its length, who queued it and its link, as shown in the queue
+func describeTrack(track *Track) string {
+	details := []string{}
+	if track.Duration > 0 {
+		details = append(details, formatDuration(track.Duration))
+	}
+	if track.Requester != "" {
+		details = append(details, "queued by "+track.Requester)
+	}
+	description := util.Truncate(track.Title, maxListTitleLen)
+	if len(details) > 0 {
+		description += " (" + strings.Join(details, ", ") + ")"
+	}
+	if track.URL != "" {
+		// Angle brackets stop Discord showing a preview of every link
+		description += " <" + track.URL + ">"
+	}
+	return description
+}
+
+// Format a duration as m:ss, or h:mm:ss if it's an hour or longer
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
 /*
 Run a music player for a voice channel, from start to finish
 */
-func runPlayer(session *discordgo.Session, msg *discordgo.MessageCreate, voiceChannelID string, terms []string) error {
-	defer session.ChannelMessageSend(msg.ChannelID, "Stopping playing")
-	defer log.Printf("Removing subscription for user %s", msg.Author.Username)
+func runPlayer(ctx *util.Context, voiceChannelID string, query string) error {
+	// The player outlives the interaction token so post status to the channel directly
+	session := ctx.Session
 	// Make subscription object
-	sub, err := NewSubscription()
+	sub, err := Subscriptions.Start(ctx.GuildID, voiceChannelID, store.Guild(ctx.GuildID).MaxQueueLen)
 	if err != nil {
 		return err
 	}
-	Subscriptions[voiceChannelID] = sub
-	defer delete(Subscriptions, voiceChannelID)
-	defer delete(UsedIDs, sub.ID)
-	log.Printf("Created subscription %s for user %s", sub.ID, msg.Author.Username)
+	defer session.ChannelMessageSend(ctx.ChannelID, "Stopping playing")
+	defer log.Printf("Removing subscription for user %s", ctx.Author.Username)
+	defer Subscriptions.Remove(sub)
+	// In case the player never started
+	defer sub.stopped()
+	log.Printf("Created subscription %s for user %s", sub.ID, ctx.Author.Username)
 
 	// Make folder for files
 	if err = os.Mkdir(sub.Folder, 0755); err != nil && !errors.Is(err, os.ErrExist) {
 		return err
 	}
 	defer os.RemoveAll(sub.Folder)
-	go sub.AddToQueue(session, msg.ChannelID, terms)
+	go func() {
+		if err := sub.AddToQueue(ctx, query); err != nil {
+			ReplyError(ctx, nil, err)
+		}
+	}()
 
 	// File download manager
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
+	playCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go sub.ManageDownloads(ctx)
+	go sub.ManageDownloads(playCtx)
+	// Adds more of long playlists as the queue plays
+	go sub.ManagePlaylists(playCtx, session)
 	// Join voice channel and start websocket audio communication
-	vc, err := session.ChannelVoiceJoin(msg.GuildID, voiceChannelID, false, true)
+	vc, err := session.ChannelVoiceJoin(ctx.GuildID, voiceChannelID, false, true)
 	if err != nil {
 		return err
 	}
@@ -139,22 +876,22 @@ func runPlayer(session *discordgo.Session, msg *discordgo.MessageCreate, voiceCh
 	// Any error handling past here must close the voice channel connection
 	vc.Speaking(true)
 	defer vc.Speaking(false)
-	log.Printf("Starting playing for user %s", msg.Author.Username)
-	go sub.ManagePlayback(session, msg.ChannelID, vc, ctx, cancel)
+	log.Printf("Starting playing for user %s", ctx.Author.Username)
+	go sub.ManagePlayback(session, ctx.ChannelID, vc, playCtx, cancel)
 
 	start := time.Now()
 
 	for {
 		select {
-		case <-ctx.Done():
+		case <-playCtx.Done():
 			return nil
 
 		default:
 			time.Sleep(2 * time.Second)
 			// Wait for 1 track at least downloaded
-			if len(sub.QueueView) == 0 && time.Since(start) > 60*time.Second {
+			if sub.QueueLen() == 0 && time.Since(start) > 60*time.Second {
 				// Nothing was added
-				log.Printf("No new tracks for a while for user %s", msg.Author.Username)
+				log.Printf("No new tracks for a while for user %s", ctx.Author.Username)
 				return nil
 			}
 			if time.Since(start) > 12*time.Hour {
@@ -167,16 +904,42 @@ func runPlayer(session *discordgo.Session, msg *discordgo.MessageCreate, voiceCh
 /*
 Find if a the message author is in a channel and join it
 */
-func getAuthorVoiceChannel(session *discordgo.Session, msg *discordgo.MessageCreate) string {
+func getAuthorVoiceChannel(ctx *util.Context) string {
 	// Find sender's voice channel
-	guild, err := session.State.Guild(msg.GuildID)
+	guild, err := ctx.Session.StateGuild(ctx.GuildID)
 	if err != nil {
 		return ""
 	}
 	for _, vs := range guild.VoiceStates {
-		if vs.UserID == msg.Author.ID {
+		if vs.UserID == ctx.Author.ID {
 			return vs.ChannelID
 		}
 	}
 	return ""
 }
+
+// Number of people in a voice channel, not counting bots
+func countListeners(session util.Session, guildID, channelID string) int {
+	guild, err := session.StateGuild(guildID)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID == channelID && vs.UserID != session.BotUserID() && !isBot(guild, vs) {
+			count++
+		}
+	}
+	return count
+}
+
+// Voice states from a guild's initial state don't have the member, but the guild's members do
+func isBot(guild *discordgo.Guild, vs *discordgo.VoiceState) bool {
+	member := vs.Member
+	for i := 0; member == nil && i < len(guild.Members); i++ {
+		if guild.Members[i].User != nil && guild.Members[i].User.ID == vs.UserID {
+			member = guild.Members[i]
+		}
+	}
+	return member != nil && member.User != nil && member.User.Bot
+}
@@ -0,0 +1,205 @@
+package command
+
+import (
+	"bluebot/fake"
+	"bluebot/util"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Add a subscription playing in a voice channel the test user is in
+func addTestSubscription(t *testing.T, session *fake.Session, voiceChannelID string, titles ...string) *Subscription {
+	t.Helper()
+	session.AddGuild("guild", map[string]string{"user": voiceChannelID})
+	sub, err := Subscriptions.Start("guild", voiceChannelID, len(titles)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range titles {
+		sub.queue.Add(&Track{ID: title, Title: title}, QueuePolicy{MaxLen: sub.MaxQueueLen})
+	}
+	t.Cleanup(func() { Subscriptions.Remove(sub) })
+	return sub
+}
+
+func TestMusicNeedsVoiceChannel(t *testing.T) {
+	session := fake.NewSession()
+	session.AddGuild("guild", nil)
+	ctx := newTestContext(session, "music")
+
+	assertErrorKind(t, handleQueue(ctx, []string{"some", "song"}), ErrUser)
+	assertUsageError(t, handleQueue(ctx, nil))
+}
+
+func TestMusicNothingPlaying(t *testing.T) {
+	session := fake.NewSession()
+	session.AddGuild("guild", map[string]string{"user": "voice"})
+	ctx := newTestContext(session, "music")
+
+	assertErrorKind(t, handleList(ctx, nil), ErrUser)
+	assertErrorKind(t, handleNext(ctx, nil), ErrUser)
+	assertErrorKind(t, handleStop(ctx, nil), ErrUser)
+}
+
+func TestMusicList(t *testing.T) {
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-list", "first", "second")
+	sub.setStatus(StatePlaying, sub.Queue()[0], 0)
+
+	if err := handleList(newTestContext(session, "music"), nil); err != nil {
+		t.Fatal(err)
+	}
+	content := session.LastMessage().Content
+	if !strings.Contains(content, "1 - first <--\n") || !strings.Contains(content, "2 - second\n") {
+		t.Errorf("unexpected queue listing: %q", content)
+	}
+}
+
+func TestMusicQueueFull(t *testing.T) {
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-full", "first")
+	sub.MaxQueueLen = 1
+
+	err := handleQueue(newTestContext(session, "music"), []string{"another", "song"})
+	assertErrorKind(t, err, ErrUser)
+}
+
+func TestMusicListDetails(t *testing.T) {
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-details")
+	sub.queue.Add(&Track{
+		ID: "abc", Title: "song", URL: videoURL("abc"), Duration: 3*time.Minute + 25*time.Second, Requester: "alice",
+	}, QueuePolicy{MaxLen: 1})
+	ctx := newTestContext(session, "music")
+
+	if err := handleList(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "1 - song (3:25, queued by alice) <https://www.youtube.com/watch?v=abc>\n"
+	if content := session.LastMessage().Content; !strings.Contains(content, want) {
+		t.Errorf("unexpected queue listing: %q", content)
+	}
+}
+
+func TestMusicListPages(t *testing.T) {
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-pages")
+	sub.MaxQueueLen = 25
+	for i := 1; i <= 25; i++ {
+		track := &Track{ID: fmt.Sprint(i), Title: fmt.Sprintf("t%d", i), Duration: time.Minute}
+		if err := sub.queue.Add(track, QueuePolicy{MaxLen: sub.MaxQueueLen}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracks := sub.Queue()
+	sub.queue.SetDownloaded(tracks[0], "1.weba")
+	sub.queue.Next()
+	sub.setStatus(StatePlaying, tracks[0], 30*time.Second)
+	ctx := newTestContext(session, "music")
+
+	if err := handleList(ctx, []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+	message := session.LastMessage()
+	for _, want := range []string{
+		"11 - t11 (1:00) - starts in 9:30\n", "20 - t20", "Page 2 of 3, 25 tracks, 24:30 to play",
+	} {
+		if !strings.Contains(message.Content, want) {
+			t.Errorf("expected %q in queue listing: %q", want, message.Content)
+		}
+	}
+	if strings.Contains(message.Content, "10 - ") || strings.Contains(message.Content, "21 - ") {
+		t.Errorf("expected only tracks 11 to 20: %q", message.Content)
+	}
+	assertPageButtons(t, message, "list 1", false, "list 3", false)
+
+	// Past the end shows the last page
+	if err := handleList(ctx, []string{"9"}); err != nil {
+		t.Fatal(err)
+	}
+	message = session.LastMessage()
+	if !strings.Contains(message.Content, "25 - t25") || !strings.Contains(message.Content, "Page 3 of 3") {
+		t.Errorf("expected the last page: %q", message.Content)
+	}
+	assertPageButtons(t, message, "list 2", false, "list 4", true)
+
+	// Without a length the start of every later track is unknown
+	tracks[2].Duration = 0
+	if err := handleList(ctx, []string{"0"}); err != nil {
+		t.Fatal(err)
+	}
+	message = session.LastMessage()
+	if !strings.Contains(message.Content, "2 - t2 (1:00) - starts in 0:30\n3 - t3 - starts in 1:30\n4 - t4 (1:00)\n") {
+		t.Errorf("unexpected start times: %q", message.Content)
+	}
+	if !strings.Contains(message.Content, "at least 23:30 to play") {
+		t.Errorf("expected the total to be a minimum: %q", message.Content)
+	}
+	assertPageButtons(t, message, "list 0", true, "list 2", false)
+}
+
+func TestMusicListFitsMessage(t *testing.T) {
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-long-titles")
+	sub.MaxQueueLen = 11
+	for i := 0; i < 11; i++ {
+		track := &Track{
+			ID:        fmt.Sprint(i),
+			Title:     strings.Repeat("é", 300),
+			URL:       "https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+			Requester: strings.Repeat("n", 32),
+			Duration:  10 * time.Hour,
+		}
+		if err := sub.queue.Add(track, QueuePolicy{MaxLen: sub.MaxQueueLen}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub.queue.SetLoop(LoopQueue)
+	ctx := newTestContext(session, "music")
+
+	if err := handleList(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	content := session.LastMessage().Content
+	if n := utf8.RuneCountInString(content); n > MaxMessageLen {
+		t.Errorf("queue page is %d characters, over the message limit", n)
+	}
+	if !strings.Contains(content, strings.Repeat("é", maxListTitleLen-3)+"...") {
+		t.Errorf("expected long titles to be cut off: %q", content)
+	}
+
+	// A failed reply is returned, e.g. when the message with the buttons was deleted
+	ctx = util.NewInteractionContext(session, &discordgo.Interaction{
+		Type:      discordgo.InteractionMessageComponent,
+		GuildID:   "guild",
+		ChannelID: "music",
+		Message:   &discordgo.Message{ID: "deleted", ChannelID: "music"},
+		Member:    &discordgo.Member{User: &discordgo.User{ID: "user", Username: "user"}},
+	})
+	if err := handleList(ctx, []string{"2"}); err == nil {
+		t.Error("expected the failed edit to be returned")
+	}
+}
+
+func assertPageButtons(t *testing.T, message *fake.Message, prev string, prevDisabled bool, next string, nextDisabled bool) {
+	t.Helper()
+	if len(message.Components) != 1 {
+		t.Fatalf("expected a row of buttons, got %v", message.Components)
+	}
+	buttons := message.Components[0].(discordgo.ActionsRow).Components
+	if len(buttons) != 2 {
+		t.Fatalf("expected 2 buttons, got %v", buttons)
+	}
+	for i, want := range []discordgo.Button{{CustomID: prev, Disabled: prevDisabled}, {CustomID: next, Disabled: nextDisabled}} {
+		button := buttons[i].(discordgo.Button)
+		if button.CustomID != want.CustomID || button.Disabled != want.Disabled {
+			t.Errorf("button %d is %q disabled %t, expected %q disabled %t",
+				i, button.CustomID, button.Disabled, want.CustomID, want.Disabled)
+		}
+	}
+}
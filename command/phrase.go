@@ -0,0 +1,113 @@
+package command
+
+import (
+	"bluebot/config"
+	"bluebot/util"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var PhraseArgs = []*Arg{
+	{
+		Name:        "action",
+		Description: "Whether to list, add or remove phrases",
+		Kind:        ArgEnum,
+		Required:    true,
+		Choices:     func() []string { return []string{"list", "add", "remove"} },
+	},
+	{
+		Name:        "category",
+		Description: "Phrase category",
+		Kind:        ArgEnum,
+		Required:    true,
+		Choices:     config.PhraseCategories,
+	},
+	{Name: "text", Description: "Phrase to add, or its number to remove", Kind: ArgRest},
+}
+
+/*
+Phrases are shared by every server, so changing them needs more than using the command.
+Servers can give it to roles of their own in settings instead
+*/
+var phraseEditAction = &Action{
+	Name:        "editphrases",
+	Description: "add or remove phrases",
+	Require:     Requirement{OwnerOnly: true},
+}
+
+// Reply with a random phrase from a category, filled in for where the command was used
+func SendPhrase(ctx *util.Context, category string) {
+	ctx.Send(config.GetPhrase(category, ctx.ChannelID, phraseData(ctx)))
+}
+
+func phraseData(ctx *util.Context) *config.PhraseData {
+	data := &config.PhraseData{User: ctx.AuthorName(), Time: config.PhraseTime{Time: time.Now()}}
+	if channel, err := ctx.Session.StateChannel(ctx.ChannelID); err == nil {
+		data.Channel = channel.Name
+	}
+	if guild, err := ctx.Session.StateGuild(ctx.GuildID); err == nil {
+		data.MemberCount = guild.MemberCount
+	}
+	return data
+}
+
+/*
+List the phrases in a category, or add or remove one and save the change
+*/
+func HandlePhrase(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgsFrom(ctx, PhraseArgs, args)
+	if err != nil {
+		return err
+	}
+	category := parsed.String("category")
+	text := parsed.String("text")
+
+	if parsed.String("action") == "list" {
+		phrases := config.GetPhrases(category)
+		if len(phrases) == 0 {
+			ctx.Send(fmt.Sprintf("No phrases for %s yet, add one with `%sphrase add %s <text>`", category, ctx.Prefix, category))
+			return nil
+		}
+		lines := []string{fmt.Sprintf("**Phrases for %s**", category)}
+		for i, phrase := range phrases {
+			lines = append(lines, fmt.Sprintf("%d. %s", i+1, phrase))
+		}
+		sendLines(ctx, lines)
+		return nil
+	}
+
+	if allowed, reason := CheckAction(ctx, phraseEditAction); !allowed {
+		return UserError("%s", reason)
+	}
+	if text == "" {
+		return usageErrorf("Need a phrase to add or the number of one to remove")
+	}
+
+	if parsed.String("action") == "add" {
+		phrase, err := config.ParsePhrase(text, 1)
+		if err != nil {
+			return UserError("That phrase can't be used: %s", err)
+		}
+		number, err := config.AddPhrase(category, phrase)
+		if err != nil {
+			return InternalError("Couldn't save the phrase", err)
+		}
+		ctx.Send(fmt.Sprintf("Added phrase %d to %s", number, category))
+		return nil
+	}
+
+	number, err := strconv.Atoi(text)
+	if err != nil {
+		return usageErrorf("Give the number of the phrase to remove, from `%sphrase list %s`", ctx.Prefix, category)
+	}
+	if count := len(config.GetPhrases(category)); number < 1 || number > count {
+		return UserError("There's no phrase %d for %s, it has %d", number, category, count)
+	}
+	removed, err := config.RemovePhrase(category, number)
+	if err != nil {
+		return InternalError("Couldn't remove the phrase", err)
+	}
+	ctx.Send(fmt.Sprintf("Removed from %s: %s", category, removed.Text))
+	return nil
+}
@@ -0,0 +1,141 @@
+package command
+
+import (
+	"bluebot/config"
+	"bluebot/fake"
+	"bluebot/store"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Use an empty temporary phrases folder for the test
+func setupTestPhrases(t *testing.T) {
+	t.Helper()
+	oldPath, oldPhrases := config.Get().PhrasesPath, config.Phrases
+	t.Cleanup(func() { config.Get().PhrasesPath, config.Phrases = oldPath, oldPhrases })
+	config.Get().PhrasesPath = t.TempDir()
+	config.Phrases = map[string][]*config.Phrase{}
+}
+
+// Make "user" a bot owner for the test, as only owners can edit phrases
+func asOwner(t *testing.T) {
+	t.Helper()
+	old := ExtraOwnerIDs
+	ExtraOwnerIDs = []string{"user"}
+	t.Cleanup(func() { ExtraOwnerIDs = old })
+}
+
+func TestPhraseAddListRemove(t *testing.T) {
+	setupTestPhrases(t)
+	session := fake.NewSession()
+	asOwner(t)
+	ctx := newTestContext(session, "phrase")
+
+	for _, text := range []string{"first", "second"} {
+		if err := HandlePhrase(ctx, []string{"add", "say", text, "one"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := HandlePhrase(ctx, []string{"remove", "say", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := HandlePhrase(ctx, []string{"list", "say"}); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; !strings.Contains(content, "1. second one") ||
+		strings.Contains(content, "first") {
+		t.Errorf("unexpected list: %q", content)
+	}
+	if phrase := config.GetPhrase("say", "phrase", &config.PhraseData{}); phrase != "second one" {
+		t.Errorf("expected the remaining phrase to be used, got %q", phrase)
+	}
+}
+
+func TestPhraseAddInvalidTemplate(t *testing.T) {
+	setupTestPhrases(t)
+	session := fake.NewSession()
+	asOwner(t)
+	ctx := newTestContext(session, "phrase-template")
+
+	assertErrorKind(t, HandlePhrase(ctx, []string{"add", "say", "hi {{.Nobody}}"}), ErrUser)
+	if len(config.GetPhrases("say")) != 0 {
+		t.Error("invalid phrase was added")
+	}
+}
+
+func TestSendPhraseFillsInVariables(t *testing.T) {
+	setupTestPhrases(t)
+	session := fake.NewSession()
+	session.Channels["phrase-send"] = &discordgo.Channel{ID: "phrase-send", Name: "general"}
+	session.AddGuild("guild", nil).MemberCount = 7
+	asOwner(t)
+	ctx := newTestContext(session, "phrase-send")
+
+	if err := HandlePhrase(ctx, []string{"add", "taxes", "{{.User}} in {{.Channel}} with {{.MemberCount}}"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := HandleTaxes(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "user in general with 7" {
+		t.Errorf("unexpected phrase: %q", content)
+	}
+}
+
+func TestPhraseEditOwnerOnly(t *testing.T) {
+	setupTestPhrases(t)
+	session := fake.NewSession()
+	session.Permissions["user"] = discordgo.PermissionAdministrator
+	ctx := newTestContext(session, "phrase-denied")
+
+	// Phrases are shared by every server, so server admins can't edit them
+	err := HandlePhrase(ctx, []string{"add", "say", "hi"})
+	assertErrorKind(t, err, ErrUser)
+	if !strings.Contains(err.Error(), "only the bot owner") {
+		t.Errorf("unexpected denial: %s", err)
+	}
+	if len(config.GetPhrases("say")) != 0 {
+		t.Error("phrase added without permission")
+	}
+	if err = HandlePhrase(ctx, []string{"list", "say"}); err != nil {
+		t.Errorf("anyone should be able to list phrases: %v", err)
+	}
+}
+
+func TestPhraseEditRolesRefused(t *testing.T) {
+	setupTestPhrases(t)
+	session := fake.NewSession()
+	ctx := newAccessContext(t, session, "phrase-guild")
+	registry := NewRegistry()
+	registry.Register(&Command{Name: "phrase", Handler: HandlePhrase})
+
+	err := store.UpdateGuild("phrase-guild", func(settings *store.GuildSettings) error {
+		return guildSettings["roles"].Set(settings, []string{"editphrases", "none"}, registry)
+	})
+	assertUsageError(t, err)
+	// Roles saved before editing was limited to the owner are ignored
+	err = store.UpdateGuild("phrase-guild", func(settings *store.GuildSettings) error {
+		settings.CommandRoles["editphrases"] = []string{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertErrorKind(t, HandlePhrase(ctx, []string{"add", "say", "hi"}), ErrUser)
+	if allowed, reason := CheckAccess(ctx, &Command{Name: "phrase"}); !allowed {
+		t.Errorf("expected the phrase command to stay open: %s", reason)
+	}
+}
+
+func TestPhraseRemoveInvalid(t *testing.T) {
+	setupTestPhrases(t)
+	session := fake.NewSession()
+	asOwner(t)
+	ctx := newTestContext(session, "phrase-invalid")
+
+	assertUsageError(t, HandlePhrase(ctx, []string{"remove", "say", "first"}))
+	assertErrorKind(t, HandlePhrase(ctx, []string{"remove", "say", "3"}), ErrUser)
+	assertUsageError(t, HandlePhrase(ctx, []string{"add", "nonsense", "hi"}))
+}
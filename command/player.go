@@ -0,0 +1,418 @@
+package command
+
+import (
+	"bluebot/util"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ebml-go/webm"
+)
+
+// What a subscription's player is doing
+type PlayerState int
+
+const (
+	StateIdle      PlayerState = iota // Waiting for a track to be queued
+	StateBuffering                    // Waiting for the next track to download
+	StatePlaying
+	StatePaused
+	StateStopped // Finished, the player won't accept any more actions
+)
+
+func (s PlayerState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateBuffering:
+		return "buffering"
+	case StatePlaying:
+		return "playing"
+	case StatePaused:
+		return "paused"
+	default:
+		return "stopped"
+	}
+}
+
+// Something a user asks the player to do
+type PlayerAction int
+
+const (
+	ActionNext PlayerAction = iota
+	ActionPause
+	ActionResume
+	ActionStop
+	ActionSeek   // Jump to position
+	ActionSeekBy // Jump forward by position, or back if it's negative
+)
+
+// An action sent to the player, which replies with nil or why it couldn't be done
+type playerCommand struct {
+	action   PlayerAction
+	position time.Duration // For seeking
+	track    *Track        // For next, only skip if this track is still playing
+	reply    chan error
+}
+
+// Snapshot of what the player is doing
+type PlayerStatus struct {
+	State    PlayerState
+	Track    *Track        // Track playing or paused, nil otherwise
+	Elapsed  time.Duration // How far into the track, from the last packet sent
+	Duration time.Duration // Length of the track, 0 if unknown
+}
+
+// Longest to wait for the next packet of a track before giving up on it
+const packetTimeout = 2 * time.Second
+
+// Opus audio of a downloaded track
+type trackAudio interface {
+	// Packets in order, ending with a packet with a BadTC timecode or the channel closing
+	Packets() <-chan webm.Packet
+	// Length of the track, 0 if unknown
+	Duration() time.Duration
+	// Continue from a position, sending an empty packet with the position as its timecode once
+	// packets come from there. They may start a little before it
+	Seek(position time.Duration)
+	Close() error
+}
+
+// Opens a downloaded track's audio, replaced in tests
+var openTrack = openWebM
+
+type webmAudio struct {
+	file     *os.File
+	reader   *webm.Reader
+	duration time.Duration
+}
+
+func openWebM(filename string) (trackAudio, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	var w webm.WebM
+	reader, err := webm.Parse(file, &w)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &webmAudio{file, reader, w.Segment.GetDurationMs()}, nil
+}
+
+func (a *webmAudio) Packets() <-chan webm.Packet {
+	return a.reader.Chan
+}
+
+func (a *webmAudio) Duration() time.Duration {
+	return a.duration
+}
+
+func (a *webmAudio) Seek(position time.Duration) {
+	a.reader.Seek(position)
+}
+
+// Stop the reader and let it finish sending, so its goroutine exits
+func (a *webmAudio) Close() error {
+	a.reader.Shutdown()
+	go func() {
+		for range a.reader.Chan {
+		}
+	}()
+	return a.file.Close()
+}
+
+/*
+Ask the player to do something and wait for it to reply. Returns a user error if the action
+doesn't apply in the player's current state, e.g. resuming when not paused
+*/
+func (sub *Subscription) Do(ctx context.Context, action PlayerAction) error {
+	return sub.send(ctx, playerCommand{action: action})
+}
+
+// Skip a track if it's still playing, otherwise do nothing
+func (sub *Subscription) Skip(ctx context.Context, track *Track) error {
+	return sub.send(ctx, playerCommand{action: ActionNext, track: track})
+}
+
+/*
+Jump to a position in the track playing, or by an offset from where it is if relative is set.
+Positions before the start play from the start
+*/
+func (sub *Subscription) Seek(ctx context.Context, position time.Duration, relative bool) error {
+	cmd := playerCommand{action: ActionSeek, position: position}
+	if relative {
+		cmd.action = ActionSeekBy
+	}
+	return sub.send(ctx, cmd)
+}
+
+func (sub *Subscription) send(ctx context.Context, cmd playerCommand) error {
+	cmd.reply = make(chan error, 1)
+	select {
+	case sub.commands <- cmd:
+	case <-sub.done:
+		return UserError("No music playing")
+	case <-ctx.Done():
+		return InternalError("The music player didn't respond", ctx.Err())
+	}
+	select {
+	case err := <-cmd.reply:
+		return err
+	case <-sub.done:
+		return nil
+	case <-ctx.Done():
+		return InternalError("The music player didn't respond", ctx.Err())
+	}
+}
+
+// What the player is doing right now
+func (sub *Subscription) Status() PlayerStatus {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	status := PlayerStatus{State: sub.state, Track: sub.current, Elapsed: sub.elapsed, Duration: sub.duration}
+	if status.State == StateIdle && sub.queue.Len() > 0 {
+		status.State = StateBuffering
+	}
+	return status
+}
+
+// Mark the player as stopped, so actions sent to it fail straight away
+func (sub *Subscription) stopped() {
+	sub.stopOnce.Do(func() {
+		sub.setStatus(StateStopped, nil, 0)
+		close(sub.done)
+	})
+}
+
+func (sub *Subscription) setStatus(state PlayerState, track *Track, elapsed time.Duration) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if track != sub.current {
+		sub.duration = 0
+		sub.votes = map[string]bool{}
+	}
+	sub.state, sub.current, sub.elapsed = state, track, elapsed
+}
+
+/*
+Add a user's vote to skip the track playing. Returns the track, nil if none is playing, the
+number of votes for it and whether the vote is new
+*/
+func (sub *Subscription) voteSkip(userID string) (*Track, int, bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.current == nil {
+		return nil, 0, false
+	}
+	if sub.votes[userID] {
+		return sub.current, len(sub.votes), false
+	}
+	sub.votes[userID] = true
+	return sub.current, len(sub.votes), true
+}
+
+func (sub *Subscription) setDuration(duration time.Duration) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.duration = duration
+}
+
+func (sub *Subscription) setElapsed(elapsed time.Duration) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.elapsed = elapsed
+}
+
+/*
+Play the tracks at the front of the queue once they're downloaded by sending their opus
+packets, deleting each track's file after it's finished. Actions from handlers are answered
+in every state, so they never wait on the player
+*/
+func (sub *Subscription) ManagePlayback(
+	session util.Session, chID string, vc util.VoiceConnection, ctx context.Context, cancel context.CancelFunc,
+) {
+	defer cancel()
+	defer sub.stopped()
+	for {
+		sub.setStatus(StateIdle, nil, 0)
+		track, changed := sub.queue.Next()
+		if track != nil {
+			if stop := sub.play(session, chID, vc, ctx, track); stop {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-changed:
+
+		case cmd := <-sub.commands:
+			switch {
+			case cmd.action == ActionStop:
+				cmd.reply <- nil
+				return
+			case cmd.action == ActionNext && cmd.track != nil:
+				// The track to skip has already finished
+				cmd.reply <- nil
+			default:
+				cmd.reply <- sub.waitingError(cmd.action)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Why an action can't be done while waiting for a track
+func (sub *Subscription) waitingError(action PlayerAction) error {
+	if action == ActionResume {
+		return UserError("The music isn't paused")
+	}
+	if action == ActionSeek || action == ActionSeekBy {
+		if sub.QueueLen() == 0 {
+			return UserError("Nothing is playing to jump around in")
+		}
+	}
+	if sub.QueueLen() == 0 {
+		return UserError("Nothing is playing, queue something first")
+	}
+	return UserError("The next track is still downloading")
+}
+
+/*
+Play a track until it ends or is skipped, from the track's start offset if it has one. The
+track's file is kept if it's looped. Returns true if the player should stop
+*/
+func (sub *Subscription) play(
+	session util.Session, chID string, vc util.VoiceConnection, ctx context.Context, track *Track,
+) bool {
+	end := trackSkipped
+	defer func() {
+		if !sub.queue.Finish(track, end) {
+			os.Remove(track.Filename)
+		}
+	}()
+	audio, err := openTrack(track.Filename)
+	if err != nil {
+		end = trackFailed
+		log.Printf("An error occurred opening [ %s ] for subscription %s: %s", track.Title, sub.ID, err)
+		session.ChannelMessageSend(chID, fmt.Sprintf("Failed to play [ %s ], skipping", track.Title))
+		return false
+	}
+	defer audio.Close()
+
+	session.ChannelMessageSend(chID, fmt.Sprintf("--> Playing track [ %s ]", track.Title))
+	log.Printf("Playing track [ %s ] for subscription %s", track.Title, sub.ID)
+	sub.setStatus(StatePlaying, track, 0)
+	sub.setDuration(audio.Duration())
+	paused := false
+	// While seeking, packets are dropped until the reader marks it has reached the target
+	seeking := false
+	var target time.Duration
+	seek := func(position time.Duration) error {
+		if seeking {
+			return UserError("Still jumping to %s, try again in a moment", formatDuration(target))
+		}
+		if position < 0 {
+			position = 0
+		}
+		if duration := audio.Duration(); duration > 0 && position >= duration {
+			return UserError("The track is only %s long", formatDuration(duration))
+		}
+		audio.Seek(position)
+		seeking, target = true, position
+		sub.setElapsed(position)
+		return nil
+	}
+	if track.Start > 0 {
+		if err := seek(track.Start); err != nil {
+			session.ChannelMessageSend(chID, fmt.Sprintf("Couldn't start from %s: %s", formatDuration(track.Start), err))
+		}
+	}
+
+	for {
+		// Nothing is read from the track while paused, unless it's needed to finish seeking
+		var packets <-chan webm.Packet
+		var timeout <-chan time.Time
+		if !paused || seeking {
+			packets = audio.Packets()
+			timeout = time.After(packetTimeout)
+		}
+
+		select {
+		case cmd := <-sub.commands:
+			switch cmd.action {
+			case ActionNext:
+				cmd.reply <- nil
+				if cmd.track != nil && cmd.track != track {
+					continue
+				}
+				return false
+			case ActionStop:
+				cmd.reply <- nil
+				return true
+			case ActionPause:
+				if paused {
+					cmd.reply <- UserError("The music is already paused")
+					continue
+				}
+				paused = true
+				sub.setStatus(StatePaused, track, sub.Status().Elapsed)
+				cmd.reply <- nil
+			case ActionResume:
+				if !paused {
+					cmd.reply <- UserError("The music isn't paused")
+					continue
+				}
+				paused = false
+				sub.setStatus(StatePlaying, track, sub.Status().Elapsed)
+				cmd.reply <- nil
+			case ActionSeek:
+				cmd.reply <- seek(cmd.position)
+			case ActionSeekBy:
+				cmd.reply <- seek(sub.Status().Elapsed + cmd.position)
+			}
+
+		case packet, ok := <-packets:
+			if !ok {
+				end = trackEnded
+				return false
+			}
+			if seeking {
+				if len(packet.Data) == 0 && packet.Timecode == target {
+					seeking = false
+				}
+				continue
+			}
+			// Laced packets after the first in a block have no timecode of their own
+			if packet.Timecode == webm.BadTC && len(packet.Data) == 0 {
+				end = trackEnded
+				return false
+			}
+			if len(packet.Data) == 0 || (packet.Timecode != webm.BadTC && packet.Timecode < target) {
+				continue
+			}
+			select {
+			case vc.Opus() <- packet.Data:
+				if packet.Timecode != webm.BadTC {
+					sub.setElapsed(packet.Timecode)
+				}
+			case <-ctx.Done():
+				return true
+			}
+
+		case <-timeout:
+			log.Printf("Failed to read any packets for subscription %s", sub.ID)
+			end = trackFailed
+			return false
+
+		case <-ctx.Done():
+			return true
+		}
+	}
+}
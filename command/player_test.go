@@ -0,0 +1,537 @@
+package command
+
+import (
+	"bluebot/fake"
+	"bluebot/store"
+	"bluebot/util"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ebml-go/webm"
+)
+
+/*
+Track audio of length 20ms packets, sent as fast as they're read or one per pace, until
+closed. Seeking sends a marker packet then continues from the packet at the position
+*/
+type fakeAudio struct {
+	packets chan webm.Packet
+	seeks   chan time.Duration
+	done    chan struct{}
+	length  int
+}
+
+const fakePacketLen = 20 * time.Millisecond
+
+func newFakeAudio(length int, pace time.Duration) *fakeAudio {
+	audio := &fakeAudio{
+		packets: make(chan webm.Packet),
+		seeks:   make(chan time.Duration, 4),
+		done:    make(chan struct{}),
+		length:  length,
+	}
+	go func() {
+		defer close(audio.packets)
+		for i := 0; ; i++ {
+			packet := webm.Packet{Timecode: webm.BadTC}
+			if i < length {
+				time.Sleep(pace)
+				packet = webm.Packet{Data: []byte{byte(i)}, Timecode: time.Duration(i) * fakePacketLen}
+			}
+			select {
+			case position := <-audio.seeks:
+				packet = webm.Packet{Timecode: position}
+				i = int(position/fakePacketLen) - 1
+			default:
+			}
+			select {
+			case audio.packets <- packet:
+				if packet.Timecode == webm.BadTC {
+					return
+				}
+			case <-audio.done:
+				return
+			}
+		}
+	}()
+	return audio
+}
+
+func (a *fakeAudio) Packets() <-chan webm.Packet {
+	return a.packets
+}
+
+func (a *fakeAudio) Duration() time.Duration {
+	return time.Duration(a.length) * fakePacketLen
+}
+
+func (a *fakeAudio) Seek(position time.Duration) {
+	a.seeks <- position
+}
+
+func (a *fakeAudio) Close() error {
+	close(a.done)
+	return nil
+}
+
+// Use fake audio for every track played in the test
+func useFakeAudio(t *testing.T, length int, pace time.Duration) {
+	t.Helper()
+	old := openTrack
+	openTrack = func(filename string) (trackAudio, error) { return newFakeAudio(length, pace), nil }
+	t.Cleanup(func() { openTrack = old })
+}
+
+// Let the player take a track without downloading it, the fake audio is used instead
+func markDownloaded(sub *Subscription, track *Track) {
+	sub.queue.SetDownloaded(track, track.ID+".weba")
+}
+
+// Run the player for a subscription against the fake session until the test ends
+func startTestPlayer(t *testing.T, session *fake.Session, sub *Subscription) *fake.VoiceConnection {
+	t.Helper()
+	vc, _ := session.ChannelVoiceJoin("guild", sub.ChannelID, false, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	go sub.ManagePlayback(session, "music", vc, ctx, cancel)
+	t.Cleanup(func() {
+		cancel()
+		<-sub.done
+	})
+	return vc.(*fake.VoiceConnection)
+}
+
+func waitForState(t *testing.T, sub *Subscription, state PlayerState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for sub.Status().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("player is %s, expected %s", sub.Status().State, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPlayerWhileBuffering(t *testing.T) {
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-buffering", "first")
+	startTestPlayer(t, session, sub)
+	ctx := newTestContext(session, "music")
+
+	waitForState(t, sub, StateBuffering)
+	assertErrorKind(t, handlePause(ctx, nil), ErrUser)
+	assertErrorKind(t, handleResume(ctx, nil), ErrUser)
+	assertErrorKind(t, handleNext(ctx, nil), ErrUser)
+	if err := handleNowPlaying(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; !strings.Contains(content, "still downloading") {
+		t.Errorf("unexpected now playing: %q", content)
+	}
+}
+
+func TestPlayerActions(t *testing.T) {
+	useFakeAudio(t, 1000, 0)
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-actions", "first", "second")
+	vc := startTestPlayer(t, session, sub)
+	ctx := newTestContext(session, "music")
+
+	queue := sub.Queue()
+	markDownloaded(sub, queue[0])
+	waitForState(t, sub, StatePlaying)
+	if !vc.WaitForFrames(5, time.Second) {
+		t.Fatal("no audio played")
+	}
+
+	if err := handlePause(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if status := sub.Status(); status.State != StatePaused || status.Track != queue[0] {
+		t.Errorf("expected the first track to be paused, got %+v", status)
+	}
+	assertErrorKind(t, handlePause(ctx, nil), ErrUser)
+	if err := handleNowPlaying(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; !strings.HasPrefix(content, "Paused [ first ]\n`[") {
+		t.Errorf("unexpected now playing: %q", content)
+	}
+	if err := handleList(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; !strings.Contains(content, "1 - first <-- (paused)\n") {
+		t.Errorf("unexpected queue listing: %q", content)
+	}
+
+	if err := handleResume(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertErrorKind(t, handleResume(ctx, nil), ErrUser)
+	if err := handleNext(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, sub, StateBuffering)
+	if queue := sub.Queue(); len(queue) != 1 || queue[0].Title != "second" {
+		t.Errorf("expected the skipped track to leave the queue, got %v", queue)
+	}
+
+	if err := handleStop(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.done:
+	case <-time.After(time.Second):
+		t.Fatal("player didn't stop")
+	}
+	if sub.Status().State != StateStopped {
+		t.Errorf("expected the player to be stopped, got %s", sub.Status().State)
+	}
+	assertErrorKind(t, handleNext(ctx, nil), ErrUser)
+}
+
+func TestPlayerTrackEnds(t *testing.T) {
+	useFakeAudio(t, 10, 0)
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-ends", "short")
+	vc := startTestPlayer(t, session, sub)
+
+	markDownloaded(sub, sub.Queue()[0])
+	if !vc.WaitForFrames(10, time.Second) {
+		t.Fatalf("expected every packet to be played, got %d", len(vc.Frames()))
+	}
+	waitForState(t, sub, StateIdle)
+	if sub.QueueLen() != 0 {
+		t.Error("finished track left in the queue")
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	durations := map[time.Duration]string{
+		0:                                     "0:00",
+		83 * time.Second:                      "1:23",
+		time.Hour + 2*time.Minute + 3e9:       "1:02:03",
+		59*time.Second + 600*time.Millisecond: "1:00",
+	}
+	for d, want := range durations {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%s) = %s, want %s", d, got, want)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	timestamps := map[string]time.Duration{
+		"83":      83 * time.Second,
+		"1:23":    83 * time.Second,
+		"0:05":    5 * time.Second,
+		"1:02:03": time.Hour + 2*time.Minute + 3*time.Second,
+		"83s":     83 * time.Second,
+		"1m23s":   83 * time.Second,
+		"1h2m3s":  time.Hour + 2*time.Minute + 3*time.Second,
+		"2m":      2 * time.Minute,
+	}
+	for timestamp, want := range timestamps {
+		if got, err := parseTimestamp(timestamp); err != nil || got != want {
+			t.Errorf("parseTimestamp(%q) = %s, %v, want %s", timestamp, got, err, want)
+		}
+	}
+	for _, timestamp := range []string{"", "abc", "1:2:3:4", "1:-5", "1m2h", "1.5"} {
+		if _, err := parseTimestamp(timestamp); err == nil {
+			t.Errorf("expected parseTimestamp(%q) to fail", timestamp)
+		}
+	}
+}
+
+// Wait until the player has played past a position
+func waitForElapsed(t *testing.T, sub *Subscription, position time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for sub.Status().Elapsed <= position {
+		if time.Now().After(deadline) {
+			t.Fatalf("player is at %s, expected to pass %s", sub.Status().Elapsed, position)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPlayerSeek(t *testing.T) {
+	useFakeAudio(t, 1000, time.Millisecond)
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-seek", "first")
+	startTestPlayer(t, session, sub)
+	ctx := newTestContext(session, "music")
+
+	markDownloaded(sub, sub.Queue()[0])
+	waitForState(t, sub, StatePlaying)
+	if err := handleSeek(ctx, []string{"0:10"}); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Jumped to 0:10" {
+		t.Errorf("unexpected seek reply: %q", content)
+	}
+	waitForElapsed(t, sub, 10*time.Second)
+	if elapsed := sub.Status().Elapsed; elapsed > 12*time.Second {
+		t.Errorf("expected to play from 0:10, at %s", elapsed)
+	}
+
+	before := sub.Status().Elapsed
+	if err := handleForward(ctx, []string{"5"}); err != nil {
+		t.Fatal(err)
+	}
+	jumped := sub.Status().Elapsed
+	if jumped < before+5*time.Second {
+		t.Errorf("expected to jump forward 5s from %s, at %s", before, jumped)
+	}
+	waitForElapsed(t, sub, jumped)
+
+	if err := handleRewind(ctx, []string{"60"}); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Jumped to 0:00" {
+		t.Errorf("expected rewinding past the start to go to the start, got %q", content)
+	}
+	waitForElapsed(t, sub, 0)
+
+	assertErrorKind(t, handleSeek(ctx, []string{"1:00"}), ErrUser)
+	if _, ok := handleSeek(ctx, []string{"soon"}).(*UsageError); !ok {
+		t.Error("expected an invalid position to be a usage error")
+	}
+}
+
+func TestPlayerStartOffset(t *testing.T) {
+	useFakeAudio(t, 1000, time.Millisecond)
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-start", "first")
+	vc := startTestPlayer(t, session, sub)
+
+	track := sub.Queue()[0]
+	track.Start = 15 * time.Second
+	markDownloaded(sub, track)
+	if !vc.WaitForFrames(1, time.Second) {
+		t.Fatal("no audio played")
+	}
+	if first := vc.Frames()[0][0]; first != byte(track.Start/fakePacketLen) {
+		t.Errorf("expected to start at the packet for 0:15, started at %d", first)
+	}
+	if elapsed := sub.Status().Elapsed; elapsed < track.Start {
+		t.Errorf("expected to start from 0:15, at %s", elapsed)
+	}
+}
+
+func TestNowPlayingUpdates(t *testing.T) {
+	useFakeAudio(t, 2000, time.Millisecond)
+	oldInterval := NowPlayingInterval
+	NowPlayingInterval = 5 * time.Millisecond
+	t.Cleanup(func() { NowPlayingInterval = oldInterval })
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-np", "first", "second")
+	startTestPlayer(t, session, sub)
+	ctx := newTestContext(session, "music")
+
+	track := sub.Queue()[0]
+	track.Requester = "alice"
+	markDownloaded(sub, track)
+	waitForState(t, sub, StatePlaying)
+	if err := handleNowPlaying(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	message := session.LastMessage()
+	first := session.MessageContent(message.ID)
+	if !strings.HasPrefix(first, "Now playing [ first ] requested by alice\n`[") || !strings.HasSuffix(first, " / 0:40") {
+		t.Fatalf("unexpected now playing: %q", first)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if session.LastMessage() != message {
+		t.Error("expected the now playing message to be edited rather than a new one sent")
+	}
+	if session.MessageContent(message.ID) == first {
+		t.Error("now playing message wasn't updated")
+	}
+
+	if err := handleNext(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	final := session.MessageContent(message.ID)
+	time.Sleep(50 * time.Millisecond)
+	if session.MessageContent(message.ID) != final {
+		t.Error("now playing message still updated after its track was skipped")
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	bars := map[time.Duration]string{
+		0:                "[>-------------------]",
+		30 * time.Second: "[==========>---------]",
+		time.Minute:      "[====================]",
+		2 * time.Minute:  "[====================]",
+	}
+	for elapsed, want := range bars {
+		if got := progressBar(elapsed, time.Minute); got != want {
+			t.Errorf("progressBar(%s) = %s, want %s", elapsed, got, want)
+		}
+	}
+}
+
+func TestMusicVoteSkip(t *testing.T) {
+	useFakeAudio(t, 1000, time.Millisecond)
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-vote", "first", "second")
+	guild := session.Guilds["guild"]
+	for _, userID := range []string{"user2", "user3", "other-bot", session.UserID} {
+		guild.VoiceStates = append(guild.VoiceStates, &discordgo.VoiceState{UserID: userID, ChannelID: "voice-vote"})
+	}
+	guild.Members = []*discordgo.Member{{User: &discordgo.User{ID: "other-bot", Bot: true}}}
+	session.Roles["guild"] = []*discordgo.Role{{ID: "dj", Name: "DJ"}}
+	startTestPlayer(t, session, sub)
+	contextFor := func(userID string) *util.Context {
+		ctx := newTestContext(session, "music")
+		ctx.Author = &discordgo.User{ID: userID, Username: userID}
+		return ctx
+	}
+
+	queue := sub.Queue()
+	queue[0].RequesterID = "user3"
+	markDownloaded(sub, queue[0])
+	waitForState(t, sub, StatePlaying)
+
+	// Half of the 3 people listening is 2 votes
+	if err := handleNext(contextFor("user"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Voted to skip [ first ] (1/2 votes)" {
+		t.Errorf("unexpected vote reply: %q", content)
+	}
+	assertErrorKind(t, handleNext(contextFor("user"), nil), ErrUser)
+	if sub.Status().Track != queue[0] {
+		t.Fatal("skipped before enough votes")
+	}
+	if err := handleNext(contextFor("user2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Skipped [ first ] (2/2 votes)" {
+		t.Errorf("unexpected skip reply: %q", content)
+	}
+	waitForState(t, sub, StateBuffering)
+
+	// Votes start again for the next track, and whoever queued it can skip it
+	queue[1].RequesterID = "user3"
+	markDownloaded(sub, queue[1])
+	waitForState(t, sub, StatePlaying)
+	if err := handleNext(contextFor("user"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; !strings.Contains(content, "(1/2 votes)") {
+		t.Errorf("expected votes to reset for a new track, got %q", content)
+	}
+	if err := handleNext(contextFor("user3"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Skipped" {
+		t.Errorf("expected the requester to skip straight away, got %q", content)
+	}
+	waitForState(t, sub, StateIdle)
+}
+
+/*
+Start playing "first" then "second" in a voice channel with user, user2 and user3 listening.
+Returns a context for a command from each of them
+*/
+func startVoteTest(t *testing.T, session *fake.Session, voiceChannelID string) (*Subscription, func(string) *util.Context) {
+	t.Helper()
+	useFakeAudio(t, 1000, time.Millisecond)
+	sub := addTestSubscription(t, session, voiceChannelID, "first", "second")
+	guild := session.Guilds["guild"]
+	for _, userID := range []string{"user2", "user3"} {
+		guild.VoiceStates = append(guild.VoiceStates, &discordgo.VoiceState{UserID: userID, ChannelID: voiceChannelID})
+	}
+	startTestPlayer(t, session, sub)
+	markDownloaded(sub, sub.Queue()[0])
+	waitForState(t, sub, StatePlaying)
+	return sub, func(userID string) *util.Context {
+		ctx := newTestContext(session, "music")
+		ctx.Author = &discordgo.User{ID: userID, Username: userID}
+		ctx.Member = &discordgo.Member{}
+		return ctx
+	}
+}
+
+func TestMusicVoteSkipWithoutDJRole(t *testing.T) {
+	session := fake.NewSession()
+	sub, contextFor := startVoteTest(t, session, "voice-vote-no-dj")
+
+	// Without a DJ role nobody skips straight away, apart from server managers
+	if err := handleNext(contextFor("user"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Voted to skip [ first ] (1/2 votes)" {
+		t.Errorf("expected a vote without a DJ role, got %q", content)
+	}
+	session.Permissions["user2"] = discordgo.PermissionManageServer
+	if err := handleNext(contextFor("user2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Skipped" {
+		t.Errorf("expected a server manager to skip straight away, got %q", content)
+	}
+	waitForState(t, sub, StateBuffering)
+}
+
+func TestMusicForceSkipRoles(t *testing.T) {
+	session := fake.NewSession()
+	sub, contextFor := startVoteTest(t, session, "voice-vote-roles")
+	session.Roles["guild"] = []*discordgo.Role{{ID: "dj", Name: "DJ"}, {ID: "mydj", Name: "MyDJ"}}
+	registry := NewRegistry()
+	registry.Register(&Command{Name: "next", Handler: handleNext})
+	setRoles := func(values ...string) {
+		t.Helper()
+		err := store.UpdateGuild("guild", func(settings *store.GuildSettings) error {
+			return guildSettings["roles"].Set(settings, values, registry)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		setRoles("next", "default")
+		setRoles("forceskip", "default")
+	})
+	ctx := contextFor("user")
+	ctx.Member.Roles = []string{"mydj"}
+
+	// Roles for the next command only decide who can use it, not who skips straight away
+	setRoles("next", "MyDJ")
+	if allowed, reason := CheckAccess(ctx, &Command{Name: "next"}); !allowed {
+		t.Fatalf("expected MyDJ to be able to use next: %s", reason)
+	}
+	if err := handleNext(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Voted to skip [ first ] (1/2 votes)" {
+		t.Errorf("expected a vote from MyDJ, got %q", content)
+	}
+
+	setRoles("forceskip", "MyDJ")
+	if err := handleNext(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Skipped" {
+		t.Errorf("expected MyDJ to skip straight away, got %q", content)
+	}
+	waitForState(t, sub, StateBuffering)
+}
+
+func TestVotesNeeded(t *testing.T) {
+	cases := []struct{ percent, listeners, want int }{
+		{50, 3, 2}, {50, 4, 2}, {100, 3, 3}, {1, 10, 1}, {50, 0, 1}, {34, 3, 2},
+	}
+	for _, c := range cases {
+		if got := votesNeeded(c.percent, c.listeners); got != c.want {
+			t.Errorf("votesNeeded(%d, %d) = %d, want %d", c.percent, c.listeners, got, c.want)
+		}
+	}
+}
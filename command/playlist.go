@@ -0,0 +1,255 @@
+package command
+
+import (
+	"bluebot/config"
+	"bluebot/util"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"google.golang.org/api/option"
+	"google.golang.org/api/youtube/v3"
+)
+
+// Most items YouTube returns for one request
+const youtubePageSize = 50
+
+// Longest to spend fetching more of a playlist once the queue has room for it
+const playlistLoadTimeout = 30 * time.Second
+
+// Gets a page of a playlist's video IDs, replaced in tests
+var playlistPage = fetchPlaylistPage
+
+// Looks up the tracks for video IDs, replaced in tests
+var lookupTracks = tracksFromIDs
+
+/*
+A playlist being added to a queue. Only as many of its videos are looked up as there's room
+for, and the rest are fetched as the queue plays, so huge playlists don't use up API quota
+on tracks that may never play
+*/
+type playlistFeed struct {
+	ID          string
+	Requester   string
+	RequesterID string
+	ChannelID   string   // Text channel it was queued from, to report to
+	ids         []string // Fetched but not looked up yet
+	ready       []*Track // Looked up but not added yet
+	pageToken   string
+	morePages   bool
+	total       int // Videos in the playlist according to YouTube, 0 if unknown
+	added       int
+	skipped     int // Private or deleted videos
+}
+
+func newPlaylistFeed(ctx *util.Context, ID string) *playlistFeed {
+	return &playlistFeed{
+		ID: ID, Requester: ctx.AuthorName(), RequesterID: ctx.Author.ID, ChannelID: ctx.ChannelID, morePages: true,
+	}
+}
+
+// Whether every video in the playlist has been added or skipped
+func (f *playlistFeed) done() bool {
+	return !f.morePages && len(f.ids) == 0 && len(f.ready) == 0
+}
+
+// e.g. ", skipped 2 private or deleted videos", or nothing if none were
+func (f *playlistFeed) skippedNote() string {
+	if f.skipped == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", skipped %d private or deleted videos", f.skipped)
+}
+
+/*
+Get a page of up to 50 video IDs from a playlist, starting from a page token or the start if
+it's empty. Also returns the token for the next page, empty on the last page, and how many
+videos the playlist has
+*/
+func fetchPlaylistPage(ctx context.Context, ID, pageToken string) ([]string, string, int, error) {
+	service, err := youtube.NewService(ctx, option.WithCredentialsFile(config.Get().GoogleKeyPath))
+	if err != nil {
+		return nil, "", 0, ServiceError("YouTube", err)
+	}
+	call := service.PlaylistItems.List([]string{"contentDetails"}).PlaylistId(ID).MaxResults(youtubePageSize)
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	results, err := call.Context(ctx).Do()
+	if err != nil {
+		return nil, "", 0, ServiceError("YouTube", err)
+	}
+	ids := make([]string, 0, len(results.Items))
+	for _, item := range results.Items {
+		if item.ContentDetails != nil && item.ContentDetails.VideoId != "" {
+			ids = append(ids, item.ContentDetails.VideoId)
+		}
+	}
+	total := 0
+	if results.PageInfo != nil {
+		total = int(results.PageInfo.TotalResults)
+	}
+	return ids, results.NextPageToken, total, nil
+}
+
+/*
+Add a playlist to the queue, as much of it as there's room for now and the rest as the queue
+plays
+*/
+func (sub *Subscription) addPlaylist(ctx *util.Context, ID string) error {
+	feed := newPlaylistFeed(ctx, ID)
+	message, err := ctx.Send("--> Adding playlist to the queue...")
+	if err != nil {
+		return err
+	}
+	err = sub.loadPlaylist(ctx, feed)
+	ctx.Delete(message)
+	if err != nil && feed.added == 0 {
+		return err
+	}
+
+	summary := fmt.Sprintf("--> Added %d tracks to the queue", feed.added)
+	if err != nil {
+		ctx.Send(fmt.Sprintf("%s, then stopped: %s", summary, errorMessage(err)))
+		return nil
+	}
+	summary += feed.skippedNote()
+	if !feed.done() {
+		sub.mu.Lock()
+		sub.playlists = append(sub.playlists, feed)
+		sub.mu.Unlock()
+		rest := "the rest"
+		if n := feed.total - feed.added - feed.skipped; n > 0 {
+			rest = fmt.Sprintf("the other %d", n)
+		}
+		summary += fmt.Sprintf(", %s will be added as the queue plays", rest)
+	}
+	ctx.Send(summary)
+	return nil
+}
+
+/*
+Add as much of a playlist to the queue as there's room for, fetching and looking up more of
+it as needed. Stops without an error once the queue or the requester's share of it is full
+*/
+func (sub *Subscription) loadPlaylist(ctx context.Context, feed *playlistFeed) error {
+	policy := sub.queuePolicy()
+	for {
+		for len(feed.ready) > 0 {
+			if err := sub.queue.Add(feed.ready[0], policy); err != nil {
+				return nil
+			}
+			feed.ready = feed.ready[1:]
+			feed.added++
+		}
+		space := policy.MaxLen - sub.QueueLen()
+		if space <= 0 || feed.done() {
+			return nil
+		}
+
+		if len(feed.ids) == 0 {
+			ids, next, total, err := playlistPage(ctx, feed.ID, feed.pageToken)
+			if err != nil {
+				return err
+			}
+			feed.ids, feed.pageToken, feed.morePages = ids, next, next != ""
+			if total > 0 {
+				feed.total = total
+			}
+			continue
+		}
+		n := len(feed.ids)
+		if n > space {
+			n = space
+		}
+		if n > youtubePageSize {
+			n = youtubePageSize
+		}
+		// Videos that can't be found are private or deleted
+		tracks, err := lookupTracks(ctx, feed.ids[:n])
+		if err != nil {
+			return err
+		}
+		feed.skipped += n - len(tracks)
+		feed.ids = feed.ids[n:]
+		for _, track := range tracks {
+			track.Requester, track.RequesterID = feed.Requester, feed.RequesterID
+		}
+		feed.ready = tracks
+	}
+}
+
+/*
+Add more of the playlists still being added whenever the queue changes, as there may be room
+for them. Each playlist gets a turn in the order queued, so one that can't add more, e.g.
+because its requester has as many tracks queued as allowed, doesn't hold up the others. The
+channel each was queued from is told once it's all added
+*/
+func (sub *Subscription) ManagePlaylists(ctx context.Context, session util.Session) {
+	for ctx.Err() == nil {
+		changed := sub.queue.Changed()
+		for _, feed := range sub.pendingPlaylists() {
+			// Cleared while an earlier playlist was loading
+			if !sub.hasPlaylist(feed) {
+				continue
+			}
+			loadCtx, cancel := context.WithTimeout(ctx, playlistLoadTimeout)
+			err := sub.loadPlaylist(loadCtx, feed)
+			cancel()
+			if ctx.Err() != nil {
+				break
+			}
+			if err != nil {
+				log.Printf("Failed to add more of playlist %s for subscription %s: %s", feed.ID, sub.ID, err)
+				sub.removePlaylist(feed)
+				session.ChannelMessageSend(feed.ChannelID, fmt.Sprintf(
+					"--> Stopped adding a playlist queued by %s after %d tracks: %s",
+					feed.Requester, feed.added, errorMessage(err),
+				))
+			} else if feed.done() {
+				sub.removePlaylist(feed)
+				session.ChannelMessageSend(feed.ChannelID, fmt.Sprintf(
+					"--> Finished adding a playlist queued by %s, %d tracks added%s",
+					feed.Requester, feed.added, feed.skippedNote(),
+				))
+			}
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+	}
+	log.Println("Closing playlist manager")
+}
+
+// The playlists still being added, in the order they were queued
+func (sub *Subscription) pendingPlaylists() []*playlistFeed {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return append([]*playlistFeed{}, sub.playlists...)
+}
+
+func (sub *Subscription) hasPlaylist(feed *playlistFeed) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return slices.Contains(sub.playlists, feed)
+}
+
+func (sub *Subscription) removePlaylist(feed *playlistFeed) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if i := slices.Index(sub.playlists, feed); i >= 0 {
+		sub.playlists = slices.Delete(sub.playlists, i, i+1)
+	}
+}
+
+// Stop adding every playlist still being added, returning how many there were
+func (sub *Subscription) clearPlaylists() int {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	n := len(sub.playlists)
+	sub.playlists = nil
+	return n
+}
@@ -0,0 +1,201 @@
+package command
+
+import (
+	"bluebot/fake"
+	"bluebot/store"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+/*
+Serve a playlist of the given video IDs in pages instead of calling YouTube. IDs starting with
+private can't be looked up. Returns the number of IDs in each lookup
+*/
+func useFakePlaylist(t *testing.T, ids []string) func() []int {
+	t.Helper()
+	oldPage, oldLookup := playlistPage, lookupTracks
+	t.Cleanup(func() { playlistPage, lookupTracks = oldPage, oldLookup })
+
+	playlistPage = func(ctx context.Context, ID, pageToken string) ([]string, string, int, error) {
+		start, _ := strconv.Atoi(pageToken)
+		end := start + youtubePageSize
+		if end >= len(ids) {
+			return ids[start:], "", len(ids), nil
+		}
+		return ids[start:end], strconv.Itoa(end), len(ids), nil
+	}
+	var mu sync.Mutex
+	lookups := []int{}
+	lookupTracks = func(ctx context.Context, ids []string) ([]*Track, error) {
+		mu.Lock()
+		lookups = append(lookups, len(ids))
+		mu.Unlock()
+		tracks := []*Track{}
+		for _, id := range ids {
+			if !strings.HasPrefix(id, "private") {
+				tracks = append(tracks, &Track{ID: id, Title: id})
+			}
+		}
+		return tracks, nil
+	}
+	return func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int{}, lookups...)
+	}
+}
+
+func TestPlaylistAddedAsQueuePlays(t *testing.T) {
+	ids := make([]string, 120)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("v%d", i)
+		if i%10 == 0 {
+			ids[i] = fmt.Sprintf("private%d", i)
+		}
+	}
+	lookups := useFakePlaylist(t, ids)
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-playlist")
+	sub.MaxQueueLen = 10
+	ctx := newTestContext(session, "music")
+
+	if err := sub.addPlaylist(ctx, "list"); err != nil {
+		t.Fatal(err)
+	}
+	want := "--> Added 10 tracks to the queue, skipped 2 private or deleted videos, the other 108 will be added as the queue plays"
+	if content := session.LastMessage().Content; content != want {
+		t.Errorf("unexpected playlist reply: %q", content)
+	}
+	// Only enough videos to fill the queue are looked up
+	if got := lookups(); fmt.Sprint(got) != "[10 1 1]" {
+		t.Errorf("unexpected lookups %v", got)
+	}
+
+	playCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go sub.ManagePlaylists(playCtx, session)
+	played := 0
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.HasPrefix(session.LastMessage().Content, "--> Finished") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the playlist to finish, %d tracks played", played)
+		}
+		if sub.QueueLen() == sub.MaxQueueLen {
+			played += len(sub.queue.Clear())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	played += sub.QueueLen()
+	want = "--> Finished adding a playlist queued by user, 108 tracks added, skipped 12 private or deleted videos"
+	if content := session.LastMessage().Content; content != want || played != 108 {
+		t.Errorf("unexpected finish after %d tracks: %q", played, content)
+	}
+	if len(sub.pendingPlaylists()) != 0 {
+		t.Error("expected the finished playlist to be removed")
+	}
+}
+
+func TestPlaylistsTakeTurns(t *testing.T) {
+	ids := make([]string, 10)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("v%d", i)
+	}
+	useFakePlaylist(t, ids)
+	setMaxUserTracks := func(n int) {
+		t.Helper()
+		err := store.UpdateGuild("guild", func(settings *store.GuildSettings) error {
+			settings.MaxUserTracks = n
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setMaxUserTracks(2)
+	t.Cleanup(func() { setMaxUserTracks(0) })
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-playlist-turns")
+	sub.MaxQueueLen = 10
+	queuedBy := func(userID string) []*Track {
+		tracks := []*Track{}
+		for _, track := range sub.Queue() {
+			if track.RequesterID == userID {
+				tracks = append(tracks, track)
+			}
+		}
+		return tracks
+	}
+
+	for _, userID := range []string{"alice", "bob"} {
+		ctx := newTestContext(session, "music")
+		ctx.Author = &discordgo.User{ID: userID, Username: userID}
+		if err := sub.addPlaylist(ctx, "list-"+userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	playCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go sub.ManagePlaylists(playCtx, session)
+
+	// Alice's playlist was queued first, but bob's carries on while she's at the limit
+	for round := 0; round < 3; round++ {
+		for _, track := range queuedBy("bob") {
+			sub.queue.RemoveTrack(track)
+		}
+		deadline := time.Now().Add(time.Second)
+		for len(queuedBy("bob")) != 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected more of bob's playlist to be added in round %d, queue %v", round, sub.Queue())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if n := len(queuedBy("alice")); n != 2 {
+		t.Errorf("expected alice to still have 2 tracks queued, got %d", n)
+	}
+	if n := len(sub.pendingPlaylists()); n != 2 {
+		t.Errorf("expected both playlists to still be adding, got %d", n)
+	}
+}
+
+func TestPlaylistStopsOnError(t *testing.T) {
+	useFakePlaylist(t, []string{"a", "b", "c"})
+	lookupTracks = func(ctx context.Context, ids []string) ([]*Track, error) {
+		if ids[0] != "a" {
+			return nil, ServiceError("YouTube", errors.New("broken"))
+		}
+		return []*Track{{ID: "a", Title: "a"}}, nil
+	}
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-playlist-error")
+	sub.MaxQueueLen = 1
+	ctx := newTestContext(session, "music")
+
+	if err := sub.addPlaylist(ctx, "list"); err != nil {
+		t.Fatal(err)
+	}
+	sub.queue.Clear()
+	playCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go sub.ManagePlaylists(playCtx, session)
+
+	want := "--> Stopped adding a playlist queued by user after 1 tracks: YouTube isn't responding right now, try again in a bit"
+	deadline := time.Now().Add(time.Second)
+	for session.LastMessage().Content != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the playlist to stop, got %q", session.LastMessage().Content)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(sub.pendingPlaylists()) != 0 {
+		t.Error("expected the failed playlist to be removed")
+	}
+}
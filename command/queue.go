@@ -0,0 +1,353 @@
+package command
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sync"
+)
+
+// How many upcoming tracks are downloaded ahead of being played
+const downloadAhead = 2
+
+// What happens to tracks after they're played
+type LoopMode int
+
+const (
+	LoopOff   LoopMode = iota
+	LoopTrack          // Play the same track again when it ends
+	LoopQueue          // Add tracks back to the end of the queue when they end or are skipped
+)
+
+func (m LoopMode) String() string {
+	switch m {
+	case LoopTrack:
+		return "track"
+	case LoopQueue:
+		return "queue"
+	default:
+		return "off"
+	}
+}
+
+// How a track stopped playing
+type trackEnd int
+
+const (
+	trackEnded   trackEnd = iota // Played to the end
+	trackSkipped                 // Skipped, or the player stopped
+	trackFailed                  // Couldn't be played, so it's never looped
+)
+
+// How tracks are added to a queue, from the guild's settings
+type QueuePolicy struct {
+	MaxLen     int  // Most tracks in the queue
+	MaxPerUser int  // Most tracks one user can have queued, 0 for no limit
+	Fair       bool // Take turns between the users who queued tracks
+}
+
+/*
+Ordered tracks of a subscription, shared by the handlers, the download manager and the
+player. The player takes tracks from the front once they're downloaded, and the download
+manager fetches the first few not yet downloaded, so tracks can be moved or removed at any
+point before they play.
+
+Positions are as shown by %list, starting at 1 with the track playing if there is one
+*/
+type TrackQueue struct {
+	mu       sync.Mutex
+	current  *Track   // Taken by the player, until it finishes
+	upcoming []*Track // Waiting to play, in order
+	loop     LoopMode
+	changed  chan struct{} // Closed and replaced whenever the queue changes
+}
+
+func NewTrackQueue() *TrackQueue {
+	return &TrackQueue{changed: make(chan struct{})}
+}
+
+// Wake everything waiting on the queue. Must hold mu
+func (q *TrackQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Channel closed the next time the queue changes
+func (q *TrackQueue) Changed() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.changed
+}
+
+// Copy of the tracks, starting with the one playing
+func (q *TrackQueue) Tracks() []*Track {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tracks := make([]*Track, 0, len(q.upcoming)+1)
+	if q.current != nil {
+		tracks = append(tracks, q.current)
+	}
+	return append(tracks, q.upcoming...)
+}
+
+// Number of tracks, including the one playing
+func (q *TrackQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current != nil {
+		return len(q.upcoming) + 1
+	}
+	return len(q.upcoming)
+}
+
+/*
+Add a track to the end, or with a fair policy after the last track of the first round of
+turns its requester hasn't had. Returns a user error if the queue or the requester's share
+of it is full
+*/
+func (q *TrackQueue) Add(track *Track, policy QueuePolicy) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := len(q.upcoming)
+	if q.current != nil {
+		count++
+	}
+	if count >= policy.MaxLen {
+		return UserError("The queue is full, it can only hold %d tracks", policy.MaxLen)
+	}
+	if policy.MaxPerUser > 0 && q.countFor(track.RequesterID) >= policy.MaxPerUser {
+		return UserError("You already have %d tracks in the queue, the most allowed", policy.MaxPerUser)
+	}
+	i := len(q.upcoming)
+	if policy.Fair {
+		i = q.fairIndex(track.RequesterID)
+	}
+	q.upcoming = append(q.upcoming[:i], append([]*Track{track}, q.upcoming[i:]...)...)
+	q.notify()
+	return nil
+}
+
+// Number of tracks a user has queued, including the one playing. Must hold mu
+func (q *TrackQueue) countFor(requesterID string) int {
+	count := 0
+	if q.current != nil && q.current.RequesterID == requesterID {
+		count++
+	}
+	for _, track := range q.upcoming {
+		if track.RequesterID == requesterID {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+Where a user's next track goes to take turns with everyone else: before the first track from
+a later round than theirs. A track's round is how many tracks its requester has ahead of it,
+counting the one playing. Must hold mu
+*/
+func (q *TrackQueue) fairIndex(requesterID string) int {
+	round := q.countFor(requesterID)
+	seen := map[string]int{}
+	if q.current != nil {
+		seen[q.current.RequesterID]++
+	}
+	for i, track := range q.upcoming {
+		if seen[track.RequesterID] > round {
+			return i
+		}
+		seen[track.RequesterID]++
+	}
+	return len(q.upcoming)
+}
+
+/*
+Take the next track to play if it's downloaded. Otherwise returns nil and a channel that's
+closed when it's worth trying again
+*/
+func (q *TrackQueue) Next() (*Track, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.upcoming) == 0 || q.upcoming[0].Filename == "" {
+		return nil, q.changed
+	}
+	q.current = q.upcoming[0]
+	q.upcoming = q.upcoming[1:]
+	return q.current, nil
+}
+
+/*
+Mark the track playing as finished, adding it back to the queue if it's looped. Returns true
+if it was added back, so its file should be kept
+*/
+func (q *TrackQueue) Finish(track *Track, end trackEnd) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current != track {
+		return false
+	}
+	q.current = nil
+	requeued := true
+	switch {
+	case q.loop == LoopTrack && end == trackEnded:
+		q.upcoming = append([]*Track{track}, q.upcoming...)
+	case q.loop == LoopQueue && end != trackFailed:
+		q.upcoming = append(q.upcoming, track)
+	default:
+		requeued = false
+	}
+	q.notify()
+	return requeued
+}
+
+func (q *TrackQueue) Loop() LoopMode {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.loop
+}
+
+func (q *TrackQueue) SetLoop(mode LoopMode) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.loop = mode
+}
+
+/*
+Get the first of the next few tracks that needs downloading. If there isn't one, returns nil
+and a channel that's closed when it's worth trying again
+*/
+func (q *TrackQueue) NextDownload() (*Track, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, track := range q.upcoming {
+		if i == downloadAhead {
+			break
+		}
+		if track.Filename == "" {
+			return track, nil
+		}
+	}
+	return nil, q.changed
+}
+
+/*
+Record where a track was downloaded to. Returns false if it was removed from the queue while
+downloading, so the file isn't needed
+*/
+func (q *TrackQueue) SetDownloaded(track *Track, filename string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.find(track) < 0 {
+		return false
+	}
+	track.Filename = filename
+	q.notify()
+	return true
+}
+
+// Remove a track that hasn't started playing, e.g. if it failed to download
+func (q *TrackQueue) RemoveTrack(track *Track) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i := q.find(track); i >= 0 {
+		q.upcoming = append(q.upcoming[:i], q.upcoming[i+1:]...)
+		q.notify()
+	}
+}
+
+// Index of a track in upcoming, -1 if it isn't there. Must hold mu
+func (q *TrackQueue) find(track *Track) int {
+	for i, item := range q.upcoming {
+		if item == track {
+			return i
+		}
+	}
+	return -1
+}
+
+// Index in upcoming of a position, or a user error if it isn't an upcoming track. Must hold mu
+func (q *TrackQueue) index(position int) (int, error) {
+	i := position - 1
+	if q.current != nil {
+		if position == 1 {
+			return 0, UserError("Track 1 is playing, skip it with next instead")
+		}
+		i--
+	}
+	if i < 0 || i >= len(q.upcoming) {
+		return 0, UserError("There's no track %d in the queue", position)
+	}
+	return i, nil
+}
+
+// Remove the track at a position, returning it
+func (q *TrackQueue) Remove(position int) (*Track, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i, err := q.index(position)
+	if err != nil {
+		return nil, err
+	}
+	track := q.upcoming[i]
+	q.upcoming = append(q.upcoming[:i], q.upcoming[i+1:]...)
+	q.notify()
+	return track, nil
+}
+
+// Move the track at a position to another, shifting the tracks between. Returns the track moved
+func (q *TrackQueue) Move(from, to int) (*Track, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i, err := q.index(from)
+	if err != nil {
+		return nil, err
+	}
+	j, err := q.index(to)
+	if err != nil {
+		return nil, err
+	}
+	track := q.upcoming[i]
+	q.upcoming = append(q.upcoming[:i], q.upcoming[i+1:]...)
+	q.upcoming = append(q.upcoming[:j], append([]*Track{track}, q.upcoming[j:]...)...)
+	q.notify()
+	return track, nil
+}
+
+// Put the tracks waiting to play in a random order. Returns how many were shuffled
+func (q *TrackQueue) Shuffle() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := len(q.upcoming) - 1; i > 0; i-- {
+		r, _ := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		j := int(r.Int64())
+		q.upcoming[i], q.upcoming[j] = q.upcoming[j], q.upcoming[i]
+	}
+	q.notify()
+	return len(q.upcoming)
+}
+
+// Remove every track waiting to play, returning them
+func (q *TrackQueue) Clear() []*Track {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	removed := q.upcoming
+	q.upcoming = nil
+	q.notify()
+	return removed
+}
+
+/*
+Remove the tracks waiting before a position so it plays next. Returns the track at the
+position, the track playing which should be skipped, if any, and the tracks removed
+*/
+func (q *TrackQueue) SkipTo(position int) (target, playing *Track, removed []*Track, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i, err := q.index(position)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	removed = append([]*Track{}, q.upcoming[:i]...)
+	q.upcoming = q.upcoming[i:]
+	q.notify()
+	return q.upcoming[0], q.current, removed, nil
+}
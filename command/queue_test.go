@@ -0,0 +1,293 @@
+package command
+
+import (
+	"bluebot/fake"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, titles ...string) (*TrackQueue, []*Track) {
+	t.Helper()
+	queue := NewTrackQueue()
+	tracks := make([]*Track, len(titles))
+	for i, title := range titles {
+		tracks[i] = &Track{ID: title, Title: title}
+		if err := queue.Add(tracks[i], QueuePolicy{MaxLen: len(titles)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return queue, tracks
+}
+
+func assertQueue(t *testing.T, queue *TrackQueue, titles ...string) {
+	t.Helper()
+	got := []string{}
+	for _, track := range queue.Tracks() {
+		got = append(got, track.Title)
+	}
+	if strings.Join(got, ",") != strings.Join(titles, ",") {
+		t.Errorf("queue is %v, expected %v", got, titles)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	queue, _ := newTestQueue(t, "a", "b")
+	assertErrorKind(t, queue.Add(&Track{Title: "c"}, QueuePolicy{MaxLen: 2}), ErrUser)
+	assertQueue(t, queue, "a", "b")
+}
+
+func TestQueuePlaysInOrderOnceDownloaded(t *testing.T) {
+	queue, tracks := newTestQueue(t, "a", "b", "c")
+	if track, changed := queue.Next(); track != nil || changed == nil {
+		t.Fatal("expected to wait for the first track to download")
+	}
+	queue.SetDownloaded(tracks[1], "b.weba")
+	if track, _ := queue.Next(); track != nil {
+		t.Fatalf("expected to wait for a, got %s", track.Title)
+	}
+
+	if track, _ := queue.NextDownload(); track != tracks[0] {
+		t.Fatalf("expected a to be downloaded first, got %v", track)
+	}
+	_, changed := queue.Next()
+	queue.SetDownloaded(tracks[0], "a.weba")
+	select {
+	case <-changed:
+	default:
+		t.Fatal("expected downloading to wake the player")
+	}
+	if track, _ := queue.Next(); track != tracks[0] {
+		t.Fatalf("expected a to play, got %v", track)
+	}
+	assertQueue(t, queue, "a", "b", "c")
+	queue.Finish(tracks[0], trackEnded)
+	assertQueue(t, queue, "b", "c")
+}
+
+func TestQueueDownloadsAhead(t *testing.T) {
+	queue, tracks := newTestQueue(t, "a", "b", "c")
+	queue.SetDownloaded(tracks[0], "a.weba")
+	queue.SetDownloaded(tracks[1], "b.weba")
+	if track, _ := queue.NextDownload(); track != nil {
+		t.Fatalf("expected only %d tracks to be downloaded ahead, got %s", downloadAhead, track.Title)
+	}
+	// Moving c forward means it's needed soon
+	if _, err := queue.Move(3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if track, _ := queue.NextDownload(); track != tracks[2] {
+		t.Fatalf("expected c to be downloaded next, got %v", track)
+	}
+
+	removed, _ := queue.Remove(1)
+	if queue.SetDownloaded(removed, "c.weba") {
+		t.Error("expected a removed track's download not to be kept")
+	}
+}
+
+func TestQueuePositions(t *testing.T) {
+	queue, tracks := newTestQueue(t, "a", "b", "c", "d", "e")
+	queue.SetDownloaded(tracks[0], "a.weba")
+	queue.Next()
+
+	// a is playing at 1 so can't be changed
+	_, err := queue.Remove(1)
+	assertErrorKind(t, err, ErrUser)
+	_, err = queue.Move(2, 1)
+	assertErrorKind(t, err, ErrUser)
+	_, err = queue.Remove(6)
+	assertErrorKind(t, err, ErrUser)
+
+	if track, err := queue.Move(2, 5); err != nil || track != tracks[1] {
+		t.Fatalf("unexpected move result %v, %v", track, err)
+	}
+	assertQueue(t, queue, "a", "c", "d", "e", "b")
+	if _, err = queue.Move(4, 2); err != nil {
+		t.Fatal(err)
+	}
+	assertQueue(t, queue, "a", "e", "c", "d", "b")
+	if track, err := queue.Remove(3); err != nil || track != tracks[2] {
+		t.Fatalf("unexpected remove result %v, %v", track, err)
+	}
+	assertQueue(t, queue, "a", "e", "d", "b")
+
+	target, playing, removed, err := queue.SkipTo(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != tracks[3] || playing != tracks[0] || len(removed) != 1 || removed[0] != tracks[4] {
+		t.Errorf("unexpected skip result %v, %v, %v", target, playing, removed)
+	}
+	assertQueue(t, queue, "a", "d", "b")
+
+	if removed = queue.Clear(); len(removed) != 2 {
+		t.Errorf("expected 2 tracks to be cleared, got %d", len(removed))
+	}
+	assertQueue(t, queue, "a")
+}
+
+func TestQueueShuffle(t *testing.T) {
+	titles := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	queue, tracks := newTestQueue(t, titles...)
+	queue.SetDownloaded(tracks[0], "a.weba")
+	queue.Next()
+	if count := queue.Shuffle(); count != len(titles)-1 {
+		t.Errorf("expected %d tracks to be shuffled, got %d", len(titles)-1, count)
+	}
+	shuffled := queue.Tracks()
+	if shuffled[0] != tracks[0] {
+		t.Error("shuffling moved the track playing")
+	}
+	seen := map[*Track]bool{}
+	for _, track := range shuffled {
+		seen[track] = true
+	}
+	if len(seen) != len(titles) {
+		t.Errorf("shuffling lost tracks, got %v", shuffled)
+	}
+}
+
+func TestMusicSkipTo(t *testing.T) {
+	useFakeAudio(t, 1000, time.Millisecond)
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-skipto", "a", "b", "c")
+	startTestPlayer(t, session, sub)
+	ctx := newTestContext(session, "music")
+
+	tracks := sub.Queue()
+	markDownloaded(sub, tracks[0])
+	waitForState(t, sub, StatePlaying)
+	markDownloaded(sub, tracks[2])
+	if err := handleSkipTo(ctx, []string{"3"}); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "--> Skipped to [ c ]" {
+		t.Errorf("unexpected skip reply: %q", content)
+	}
+	deadline := time.Now().Add(time.Second)
+	for sub.Status().Track != tracks[2] {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected c to play, status is %+v", sub.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if queue := sub.Queue(); len(queue) != 1 {
+		t.Errorf("expected only c left in the queue, got %v", queue)
+	}
+
+	assertErrorKind(t, handleRemove(ctx, []string{"1"}), ErrUser)
+	assertErrorKind(t, handleShuffle(ctx, nil), ErrUser)
+	if _, ok := handleMove(ctx, []string{"1"}).(*UsageError); !ok {
+		t.Error("expected move with one position to be a usage error")
+	}
+}
+
+func TestQueueLoop(t *testing.T) {
+	queue, tracks := newTestQueue(t, "a", "b", "c")
+	for _, track := range tracks {
+		queue.SetDownloaded(track, track.Title+".weba")
+	}
+
+	queue.SetLoop(LoopTrack)
+	queue.Next()
+	if !queue.Finish(tracks[0], trackEnded) {
+		t.Error("expected a looped track to keep its file")
+	}
+	assertQueue(t, queue, "a", "b", "c")
+	queue.Next()
+	if queue.Finish(tracks[0], trackSkipped) {
+		t.Error("expected skipping a looped track to move on")
+	}
+	assertQueue(t, queue, "b", "c")
+
+	queue.SetLoop(LoopQueue)
+	queue.Next()
+	if !queue.Finish(tracks[1], trackSkipped) {
+		t.Error("expected a skipped track to go back in the looped queue")
+	}
+	assertQueue(t, queue, "c", "b")
+	queue.Next()
+	if queue.Finish(tracks[2], trackFailed) {
+		t.Error("expected a track that failed not to be looped")
+	}
+	assertQueue(t, queue, "b")
+
+	queue.SetLoop(LoopOff)
+	queue.Next()
+	if queue.Finish(tracks[1], trackEnded) {
+		t.Error("expected a track not to be kept with looping off")
+	}
+	assertQueue(t, queue)
+}
+
+func TestMusicLoopTrack(t *testing.T) {
+	useFakeAudio(t, 10, 0)
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-loop", "a", "b")
+	vc := startTestPlayer(t, session, sub)
+	ctx := newTestContext(session, "music")
+
+	if err := handleLoop(ctx, []string{"track"}); err != nil {
+		t.Fatal(err)
+	}
+	tracks := sub.Queue()
+	markDownloaded(sub, tracks[0])
+	if !vc.WaitForFrames(30, time.Second) {
+		t.Fatalf("expected the track to play repeatedly, got %d packets", len(vc.Frames()))
+	}
+	if queue := sub.Queue(); len(queue) != 2 || queue[0] != tracks[0] {
+		t.Errorf("expected a to stay at the front of the queue, got %v", queue)
+	}
+	if err := handleList(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; !strings.Contains(content, "Looping the current track\n") {
+		t.Errorf("unexpected queue listing: %q", content)
+	}
+
+	if err := handleLoop(ctx, []string{"off"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, sub, StateBuffering)
+	if queue := sub.Queue(); len(queue) != 1 || queue[0] != tracks[1] {
+		t.Errorf("expected only b left once looping stopped, got %v", queue)
+	}
+	if err := handleLoop(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; !strings.HasPrefix(content, "Looping is off") {
+		t.Errorf("unexpected loop mode reply: %q", content)
+	}
+}
+
+func TestQueueFairAndPerUser(t *testing.T) {
+	queue := NewTrackQueue()
+	policy := QueuePolicy{MaxLen: 10, MaxPerUser: 3, Fair: true}
+	add := func(requester string, n int) {
+		t.Helper()
+		track := &Track{Title: fmt.Sprintf("%s%d", requester, n), RequesterID: requester}
+		if err := queue.Add(track, policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a", 1)
+	add("a", 2)
+	add("a", 3)
+	add("b", 1)
+	add("b", 2)
+	add("c", 1)
+	assertQueue(t, queue, "a1", "b1", "c1", "a2", "b2", "a3")
+	assertErrorKind(t, queue.Add(&Track{Title: "a4", RequesterID: "a"}, policy), ErrUser)
+
+	// The track playing counts as its requester's turn
+	queue.SetDownloaded(queue.Tracks()[0], "a1.weba")
+	queue.Next()
+	add("d", 1)
+	assertQueue(t, queue, "a1", "b1", "c1", "d1", "a2", "b2", "a3")
+
+	policy.Fair = false
+	add("c", 2)
+	assertQueue(t, queue, "a1", "b1", "c1", "d1", "a2", "b2", "a3", "c2")
+}
@@ -0,0 +1,140 @@
+package command
+
+import (
+	"bluebot/util"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A command along with the metadata used for help output and slash command registration
+type Command struct {
+	Name     string
+	Aliases  []string
+	Usage    string // Arguments only e.g. "<URL or search terms>", generated from Args if empty
+	Summary  string
+	Category string
+	Args     []*Arg                                // Used to generate usage and slash options
+	Options  []*discordgo.ApplicationCommandOption // Slash command options if not from Args
+	Require  Requirement                           // Who can use the command
+	Handler  util.HandlerFunc
+}
+
+// Full usage of the command with the given prefix e.g. %queue <terms...>
+func (c *Command) UsageLine(prefix string) string {
+	usage := c.Usage
+	if usage == "" {
+		parts := make([]string, 0, len(c.Args))
+		for _, arg := range c.Args {
+			parts = append(parts, arg.Usage())
+		}
+		usage = strings.Join(parts, " ")
+	}
+	if usage == "" {
+		return prefix + c.Name
+	}
+	return fmt.Sprintf("%s%s %s", prefix, c.Name, usage)
+}
+
+// Slash command options, either given directly or generated from the command's arguments
+func (c *Command) SlashOptions() []*discordgo.ApplicationCommandOption {
+	if c.Options != nil {
+		return c.Options
+	}
+	options := make([]*discordgo.ApplicationCommandOption, 0, len(c.Args))
+	for _, arg := range c.Args {
+		options = append(options, arg.Option())
+	}
+	return options
+}
+
+// Set of commands that can be looked up by name or alias
+type Registry struct {
+	mu       sync.RWMutex
+	commands map[string]*Command
+	aliases  map[string]string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		commands: make(map[string]*Command),
+		aliases:  make(map[string]string),
+	}
+}
+
+/*
+Add commands to the registry, replacing any existing ones with the same name. Names and aliases
+are lowercased to match how commands are looked up
+*/
+func (r *Registry) Register(cmds ...*Command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cmd := range cmds {
+		cmd.Name = strings.ToLower(cmd.Name)
+		r.commands[cmd.Name] = cmd
+		for i, alias := range cmd.Aliases {
+			cmd.Aliases[i] = strings.ToLower(alias)
+			r.aliases[cmd.Aliases[i]] = cmd.Name
+		}
+	}
+}
+
+// Remove commands and their aliases from the registry
+func (r *Registry) Unregister(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		name = strings.ToLower(name)
+		cmd, ok := r.commands[name]
+		if !ok {
+			continue
+		}
+		for _, alias := range cmd.Aliases {
+			delete(r.aliases, alias)
+		}
+		delete(r.commands, name)
+	}
+}
+
+// Find a command by its name or one of its aliases
+func (r *Registry) Get(name string) (*Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name = strings.ToLower(name)
+	if cmd, ok := r.commands[name]; ok {
+		return cmd, true
+	}
+	if alias, ok := r.aliases[name]; ok {
+		return r.commands[alias], true
+	}
+	return nil, false
+}
+
+// All commands sorted by category then name
+func (r *Registry) Commands() []*Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmds := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		if cmds[i].Category != cmds[j].Category {
+			return cmds[i].Category < cmds[j].Category
+		}
+		return cmds[i].Name < cmds[j].Name
+	})
+	return cmds
+}
+
+func StringOption(name string, description string, required bool) *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        name,
+		Description: description,
+		Required:    required,
+	}
+}
@@ -0,0 +1,30 @@
+package command
+
+import (
+	"bluebot/util"
+)
+
+/*
+Create the reload command, which runs the given reload and reports what it changed. The
+reload must leave everything as it was if it fails
+*/
+func ReloadCommand(reload func() ([]string, error)) *Command {
+	return &Command{
+		Name:     "reload",
+		Summary:  "Reload the config, phrases, voice presets and image templates",
+		Category: "Admin",
+		Require:  Requirement{OwnerOnly: true},
+		Handler: func(ctx *util.Context, args []string) error {
+			changes, err := reload()
+			if err != nil {
+				return &Error{Kind: ErrUser, Message: "Reload failed, nothing was changed: " + err.Error()}
+			}
+			if len(changes) == 0 {
+				ctx.Send("Reloaded, nothing changed")
+				return nil
+			}
+			sendLines(ctx, append([]string{"Reloaded:"}, changes...))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,252 @@
+package command
+
+import (
+	"bluebot/util"
+	"context"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// How long the results of a search can be picked from
+var SearchTimeout = time.Minute
+
+// Searches YouTube for videos and playlists, replaced in tests
+var searchResults = searchYouTube
+
+// Discord's limit on the text of a select menu option
+const maxOptionLen = 100
+
+// A video or playlist found by searching
+type searchResult struct {
+	Title      string
+	Channel    string
+	Track      *Track // Set for a video
+	PlaylistID string // Set for a playlist
+}
+
+func (r *searchResult) URL() string {
+	if r.Track != nil {
+		return r.Track.URL
+	}
+	return "https://www.youtube.com/playlist?list=" + r.PlaylistID
+}
+
+// Length or that it's a playlist, and the channel it's from e.g. "3:25, by Channel"
+func (r *searchResult) details() string {
+	details := []string{}
+	if r.Track == nil {
+		details = append(details, "playlist")
+	} else if r.Track.Duration > 0 {
+		details = append(details, formatDuration(r.Track.Duration))
+	}
+	if r.Channel != "" {
+		details = append(details, "by "+r.Channel)
+	}
+	return strings.Join(details, ", ")
+}
+
+/*
+Results of a search waiting for the user who searched to pick one, until they time out. Only
+a user's latest search in each channel is kept
+*/
+type pendingSearch struct {
+	results []*searchResult
+	listing string // The results as shown
+	session util.Session
+	message *discordgo.Message
+	timer   *time.Timer
+}
+
+var (
+	searchesMu sync.Mutex
+	searches   = map[string]*pendingSearch{} // By channel and user ID
+)
+
+func searchKey(ctx *util.Context) string {
+	return ctx.ChannelID + ":" + ctx.Author.ID
+}
+
+// Stop waiting for a pick, replacing the menu on the results with a note of why
+func (s *pendingSearch) close(note string) {
+	s.timer.Stop()
+	content := s.listing + "\n" + note
+	s.session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:         s.message.ID,
+		Channel:    s.message.ChannelID,
+		Content:    &content,
+		Components: []discordgo.MessageComponent{},
+	})
+}
+
+/*
+Search YouTube for videos and playlists. Videos that can't be played, e.g. because they're
+private, are left out
+*/
+func searchYouTube(ctx context.Context, query string) ([]*searchResult, error) {
+	items, err := searchYT(ctx, query)
+	if err != nil {
+		return nil, ServiceError("YouTube", err)
+	}
+	ids := []string{}
+	for _, item := range items {
+		if item.Id.VideoId != "" {
+			ids = append(ids, item.Id.VideoId)
+		}
+	}
+	tracks := map[string]*Track{}
+	if len(ids) > 0 {
+		found, err := tracksFromIDs(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range found {
+			tracks[track.ID] = track
+		}
+	}
+
+	results := []*searchResult{}
+	for _, item := range items {
+		// Search snippets come HTML escaped, unlike the titles of videos
+		result := &searchResult{
+			Title:   html.UnescapeString(item.Snippet.Title),
+			Channel: html.UnescapeString(item.Snippet.ChannelTitle),
+		}
+		switch {
+		case item.Id.VideoId != "":
+			track, ok := tracks[item.Id.VideoId]
+			if !ok {
+				continue
+			}
+			result.Title, result.Track = track.Title, track
+		case item.Id.PlaylistId != "":
+			result.PlaylistID = item.Id.PlaylistId
+		default:
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+/*
+Search YouTube and show the top results for the user to pick one to queue, either with %pick
+or from a select menu on the results. The queue must have room before searching
+*/
+func handleSearch(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgsFrom(ctx, searchArgs, args)
+	if err != nil {
+		return err
+	}
+	voiceChannelID := getAuthorVoiceChannel(ctx)
+	if voiceChannelID == "" {
+		return UserError("You're not in a voice channel")
+	}
+	return offerResults(ctx, voiceChannelID, parsed.String("terms"))
+}
+
+func offerResults(ctx *util.Context, voiceChannelID, query string) error {
+	if sub, ok := Subscriptions.Get(voiceChannelID); ok {
+		if err := sub.checkSpace(); err != nil {
+			return err
+		}
+	}
+	results, err := searchResults(ctx, query)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return UserError("YouTube search returned no results for %s", query)
+	}
+
+	lines := []string{fmt.Sprintf("Results for [ %s ]:", query)}
+	options := []discordgo.SelectMenuOption{}
+	for i, result := range results {
+		lines = append(lines, fmt.Sprintf("%d - %s (%s)", i+1, result.Title, result.details()))
+		options = append(options, discordgo.SelectMenuOption{
+			Label:       util.Truncate(result.Title, maxOptionLen),
+			Value:       strconv.Itoa(i + 1),
+			Description: util.Truncate(result.details(), maxOptionLen),
+		})
+	}
+	search := &pendingSearch{results: results, listing: strings.Join(lines, "\n"), session: ctx.Session}
+	content := search.listing + fmt.Sprintf(
+		"\nPick one with `%spick <number>` or from the menu within %s", ctx.Prefix, formatDuration(SearchTimeout),
+	)
+	search.message, err = ctx.SendComponents(content, []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.SelectMenu{CustomID: "pick", Placeholder: "Pick a result to queue", Options: options},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	key := searchKey(ctx)
+	searchesMu.Lock()
+	replaced := searches[key]
+	searches[key] = search
+	search.timer = time.AfterFunc(SearchTimeout, func() {
+		searchesMu.Lock()
+		expired := searches[key] == search
+		if expired {
+			delete(searches, key)
+		}
+		searchesMu.Unlock()
+		if expired {
+			search.close("Timed out, search again to pick one")
+		}
+	})
+	searchesMu.Unlock()
+	if replaced != nil {
+		replaced.close("Replaced by a newer search")
+	}
+	return nil
+}
+
+/*
+Queue one of the results of the user's latest search in the channel, starting the player if
+it isn't playing
+*/
+func handlePick(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgs(pickArgs, args)
+	if err != nil {
+		return err
+	}
+	voiceChannelID := getAuthorVoiceChannel(ctx)
+	if voiceChannelID == "" {
+		return UserError("You're not in a voice channel")
+	}
+	number := parsed.Int("number")
+
+	key := searchKey(ctx)
+	searchesMu.Lock()
+	search, ok := searches[key]
+	valid := ok && number >= 1 && number <= len(search.results)
+	if valid {
+		delete(searches, key)
+	}
+	searchesMu.Unlock()
+	if !ok {
+		return UserError("You have no search results to pick from, search with `%ssearch <terms>` first", ctx.Prefix)
+	}
+	if !valid {
+		return UserError("Pick a number from 1 to %d", len(search.results))
+	}
+	result := search.results[number-1]
+	search.close(fmt.Sprintf("Picked %d", number))
+
+	sub, ok := Subscriptions.Get(voiceChannelID)
+	if !ok {
+		return runPlayer(ctx, voiceChannelID, result.URL())
+	}
+	if result.Track != nil {
+		return sub.addVideo(ctx, result.Track, true)
+	}
+	return sub.addPlaylist(ctx, result.PlaylistID)
+}
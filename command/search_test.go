@@ -0,0 +1,94 @@
+package command
+
+import (
+	"bluebot/fake"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Make searches return the given results instead of calling YouTube
+func useFakeSearch(t *testing.T, results ...*searchResult) {
+	t.Helper()
+	old := searchResults
+	searchResults = func(ctx context.Context, query string) ([]*searchResult, error) { return results, nil }
+	t.Cleanup(func() { searchResults = old })
+}
+
+func TestMusicSearchAndPick(t *testing.T) {
+	useFakeSearch(t,
+		&searchResult{Title: "song", Channel: "band", Track: &Track{ID: "abc", Title: "song", Duration: 205 * time.Second}},
+		&searchResult{Title: "album", Channel: "band", PlaylistID: "xyz"},
+	)
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-search", "first")
+	sub.MaxQueueLen = 2
+	ctx := newTestContext(session, "search")
+
+	if err := handleSearch(ctx, []string{"some", "song"}); err != nil {
+		t.Fatal(err)
+	}
+	results := session.LastMessage()
+	for _, want := range []string{"1 - song (3:25, by band)\n", "2 - album (playlist, by band)\n", "`%pick <number>`"} {
+		if !strings.Contains(results.Content, want) {
+			t.Errorf("expected %q in search results: %q", want, results.Content)
+		}
+	}
+	menu := results.Components[0].(discordgo.ActionsRow).Components[0].(discordgo.SelectMenu)
+	if menu.CustomID != "pick" || len(menu.Options) != 2 || menu.Options[1].Value != "2" {
+		t.Errorf("unexpected select menu: %+v", menu)
+	}
+
+	assertErrorKind(t, handlePick(ctx, []string{"3"}), ErrUser)
+	if err := handlePick(ctx, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if queue := sub.Queue(); len(queue) != 2 || queue[1].Title != "song" || queue[1].Requester != "user" {
+		t.Errorf("expected the picked song to be queued, got %v", queue)
+	}
+	if content := session.MessageContent(results.ID); !strings.HasSuffix(content, "\nPicked 1") {
+		t.Errorf("expected the results to show the pick: %q", content)
+	}
+	if len(results.Components) != 0 {
+		t.Error("expected the select menu to be removed once picked")
+	}
+	assertErrorKind(t, handlePick(ctx, []string{"1"}), ErrUser)
+
+	// A full queue is reported before searching
+	assertErrorKind(t, handleQueue(ctx, []string{"another", "song"}), ErrUser)
+}
+
+func TestMusicSearchReplacedAndTimesOut(t *testing.T) {
+	useFakeSearch(t, &searchResult{Title: "song", Track: &Track{ID: "abc", Title: "song"}})
+	old := SearchTimeout
+	SearchTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { SearchTimeout = old })
+	session := fake.NewSession()
+	session.AddGuild("guild", map[string]string{"user": "voice-timeout"})
+	ctx := newTestContext(session, "search-timeout")
+
+	// Search terms given to queue show the results to pick from
+	if err := handleQueue(ctx, []string{"song"}); err != nil {
+		t.Fatal(err)
+	}
+	first := session.LastMessage()
+	if err := handleSearch(ctx, []string{"song"}); err != nil {
+		t.Fatal(err)
+	}
+	second := session.LastMessage()
+	if content := session.MessageContent(first.ID); !strings.HasSuffix(content, "\nReplaced by a newer search") {
+		t.Errorf("expected the first search to be replaced: %q", content)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.HasSuffix(session.MessageContent(second.ID), "\nTimed out, search again to pick one") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the search to time out: %q", session.MessageContent(second.ID))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertErrorKind(t, handlePick(ctx, []string{"1"}), ErrUser)
+}
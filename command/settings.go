@@ -0,0 +1,283 @@
+package command
+
+import (
+	"bluebot/config"
+	"bluebot/store"
+	"bluebot/util"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Commands that can't be disabled, so a guild can't lock itself out
+var alwaysEnabled = []string{"help", "settings"}
+
+// Highest maxqueue a guild can set when the config doesn't say
+const defaultMaxQueueLimit = 500
+
+// A guild setting that can be read and changed with the settings command
+type guildSetting struct {
+	Description string
+	Get         func(settings *store.GuildSettings) string
+	Set         func(settings *store.GuildSettings, values []string, registry *Registry) error
+}
+
+var guildSettings = map[string]*guildSetting{
+	"prefix": {
+		Description: "Prefix for text commands",
+		Get:         func(s *store.GuildSettings) string { return s.Prefix },
+		Set: func(s *store.GuildSettings, values []string, _ *Registry) error {
+			if len(values) != 1 || len(values[0]) > 5 || strings.ContainsAny(values[0], " \t\n") {
+				return usageErrorf("prefix must be 1-5 characters with no spaces")
+			}
+			s.Prefix = values[0]
+			return nil
+		},
+	},
+	"voice": {
+		Description: "Voice preset used by tell and greetings",
+		Get:         func(s *store.GuildSettings) string { return s.VoicePreset },
+		Set: func(s *store.GuildSettings, values []string, _ *Registry) error {
+			presets := config.VoicePresetNames()
+			if len(values) != 1 || !slices.Contains(presets, values[0]) {
+				return usageErrorf("voice must be one of: %s", strings.Join(presets, ", "))
+			}
+			s.VoicePreset = values[0]
+			return nil
+		},
+	},
+	"maxqueue": {
+		Description: "Most tracks allowed in the music queue",
+		Get:         func(s *store.GuildSettings) string { return strconv.Itoa(s.MaxQueueLen) },
+		Set: func(s *store.GuildSettings, values []string, _ *Registry) error {
+			n, err := strconv.Atoi(strings.Join(values, ""))
+			if limit := maxQueueLimit(); err != nil || n < 1 || n > limit {
+				return usageErrorf("maxqueue must be between 1 and %d", limit)
+			}
+			s.MaxQueueLen = n
+			return nil
+		},
+	},
+	"userqueue": {
+		Description: "Most tracks one person can have in the music queue, 0 for no limit",
+		Get:         func(s *store.GuildSettings) string { return strconv.Itoa(s.MaxUserTracks) },
+		Set: func(s *store.GuildSettings, values []string, _ *Registry) error {
+			n, err := strconv.Atoi(strings.Join(values, ""))
+			if err != nil || n < 0 || n > 50 {
+				return usageErrorf("userqueue must be between 0 and 50")
+			}
+			s.MaxUserTracks = n
+			return nil
+		},
+	},
+	"fairqueue": {
+		Description: "Whether people who queue music take turns rather than playing in the order queued, on or off",
+		Get:         func(s *store.GuildSettings) string { return onOff(s.FairQueue) },
+		Set: func(s *store.GuildSettings, values []string, _ *Registry) error {
+			switch strings.ToLower(strings.Join(values, "")) {
+			case "on", "true", "yes":
+				s.FairQueue = true
+			case "off", "false", "no":
+				s.FairQueue = false
+			default:
+				return usageErrorf("fairqueue must be on or off")
+			}
+			return nil
+		},
+	},
+	"skipvotes": {
+		Description: "Percent of listeners who must vote with next to skip a track, 0 lets anyone skip",
+		Get:         func(s *store.GuildSettings) string { return strconv.Itoa(s.SkipVotePercent) },
+		Set: func(s *store.GuildSettings, values []string, _ *Registry) error {
+			n, err := strconv.Atoi(strings.TrimSuffix(strings.Join(values, ""), "%"))
+			if err != nil || n < 0 || n > 100 {
+				return usageErrorf("skipvotes must be between 0 and 100")
+			}
+			s.SkipVotePercent = n
+			return nil
+		},
+	},
+	"disabled": {
+		Description: "Commands that can't be used in this server, or none",
+		Get: func(s *store.GuildSettings) string {
+			if len(s.DisabledCommands) == 0 {
+				return "none"
+			}
+			return strings.Join(s.DisabledCommands, ", ")
+		},
+		Set: func(s *store.GuildSettings, values []string, registry *Registry) error {
+			disabled := []string{}
+			if !isNone(values) {
+				for _, name := range splitList(values) {
+					cmd, ok := registry.Get(name)
+					if !ok {
+						return usageErrorf("No command called %s", name)
+					}
+					if slices.Contains(alwaysEnabled, cmd.Name) {
+						return usageErrorf("%s can't be disabled", cmd.Name)
+					}
+					disabled = append(disabled, cmd.Name)
+				}
+			}
+			s.DisabledCommands = disabled
+			return nil
+		},
+	},
+	"roles": {
+		Description: "Roles needed for commands or actions like forceskip, set with <name> <role>..., none or default",
+		Get: func(s *store.GuildSettings) string {
+			if len(s.CommandRoles) == 0 {
+				return "default"
+			}
+			names := maps.Keys(s.CommandRoles)
+			sort.Strings(names)
+			parts := make([]string, 0, len(names))
+			for _, name := range names {
+				roles := "none"
+				if len(s.CommandRoles[name]) > 0 {
+					roles = strings.Join(s.CommandRoles[name], " or ")
+				}
+				parts = append(parts, fmt.Sprintf("%s: %s", name, roles))
+			}
+			return strings.Join(parts, "; ")
+		},
+		Set: func(s *store.GuildSettings, values []string, registry *Registry) error {
+			if len(values) < 2 {
+				return usageErrorf("roles needs a command or action followed by roles, none or default")
+			}
+			name := values[0]
+			if cmd, ok := registry.Get(name); ok {
+				if cmd.Require.OwnerOnly {
+					return usageErrorf("%s is only for the bot owner", cmd.Name)
+				}
+				name = cmd.Name
+			} else if action, ok := findAction(name); !ok {
+				return usageErrorf("No command or action called %s, actions are: %s", name, actionNames())
+			} else if action.Require.OwnerOnly {
+				return usageErrorf("%s is only for the bot owner", action.Name)
+			}
+			roles := values[1:]
+			if len(roles) == 1 && roles[0] == "default" {
+				delete(s.CommandRoles, name)
+			} else if isNone(roles) {
+				s.CommandRoles[name] = []string{}
+			} else {
+				s.CommandRoles[name] = roles
+			}
+			return nil
+		},
+	},
+}
+
+var settingsArgs = []*Arg{
+	{
+		Name:        "action",
+		Description: "Whether to show or change settings",
+		Kind:        ArgEnum,
+		Required:    true,
+		Choices:     func() []string { return []string{"get", "set"} },
+	},
+	{Name: "key", Description: "Setting name", Kind: ArgEnum, Choices: settingNames},
+	{Name: "value", Description: "New value when setting", Kind: ArgList},
+}
+
+// Create the settings command, which needs the registry to check command names
+func SettingsCommand(registry *Registry) *Command {
+	return &Command{
+		Name:     "settings",
+		Summary:  "Show or change this server's settings",
+		Category: "Admin",
+		Args:     settingsArgs,
+		Require:  Requirement{Permissions: discordgo.PermissionManageServer},
+		Handler: func(ctx *util.Context, args []string) error {
+			return handleSettings(ctx, registry, args)
+		},
+	}
+}
+
+func handleSettings(ctx *util.Context, registry *Registry, args []string) error {
+	parsed, err := ParseArgs(settingsArgs, args)
+	if err != nil {
+		return err
+	}
+	if ctx.GuildID == "" {
+		return UserError("Settings can only be used in a server")
+	}
+
+	if parsed.String("action") == "get" {
+		current := store.Guild(ctx.GuildID)
+		keys := settingNames()
+		if parsed.Has("key") {
+			keys = []string{parsed.String("key")}
+		}
+		output := ""
+		for _, key := range keys {
+			setting := guildSettings[key]
+			output += fmt.Sprintf("**%s**: `%s` - %s\n", key, setting.Get(current), setting.Description)
+		}
+		ctx.Send(output)
+		return nil
+	}
+
+	if !parsed.Has("key") || !parsed.Has("value") {
+		return usageErrorf("Need a setting and a value to set it to")
+	}
+	key := parsed.String("key")
+	setting := guildSettings[key]
+	var value string
+	err = store.UpdateGuild(ctx.GuildID, func(settings *store.GuildSettings) error {
+		if err := setting.Set(settings, parsed.Strings("value"), registry); err != nil {
+			return err
+		}
+		value = setting.Get(settings)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ctx.Send(fmt.Sprintf("Set %s to `%s`", key, value))
+	return nil
+}
+
+func settingNames() []string {
+	names := maps.Keys(guildSettings)
+	sort.Strings(names)
+	return names
+}
+
+func isNone(values []string) bool {
+	return len(values) == 1 && values[0] == "none"
+}
+
+// Split values that may also be separated by commas
+func splitList(values []string) []string {
+	items := []string{}
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// Highest maxqueue a guild can set, from config
+func maxQueueLimit() int {
+	if limit := config.Get().MaxQueueLimit; limit > 0 {
+		return limit
+	}
+	return defaultMaxQueueLimit
+}
@@ -0,0 +1,90 @@
+package command
+
+import (
+	"bluebot/fake"
+	"bluebot/store"
+	"fmt"
+	"testing"
+)
+
+func newSettingsRegistry() *Registry {
+	registry := NewRegistry()
+	registry.Register(&Command{Name: "queue", Aliases: []string{"q"}})
+	registry.Register(HelpCommand(registry), SettingsCommand(registry))
+	return registry
+}
+
+func TestSettingsGet(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newAccessContext(t, session, "settings-get")
+	if err := handleSettings(ctx, newSettingsRegistry(), []string{"get", "prefix"}); err != nil {
+		t.Fatal(err)
+	}
+	if content := session.LastMessage().Content; content != "**prefix**: `%` - Prefix for text commands\n" {
+		t.Errorf("unexpected reply: %q", content)
+	}
+
+	ctx.GuildID = ""
+	assertErrorKind(t, handleSettings(ctx, newSettingsRegistry(), []string{"get"}), ErrUser)
+}
+
+func TestSettingsSet(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newAccessContext(t, session, "settings-set")
+	registry := newSettingsRegistry()
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"set", "prefix", "!!"}, "Set prefix to `!!`"},
+		{[]string{"set", "maxqueue", "1"}, "Set maxqueue to `1`"},
+		{[]string{"set", "maxqueue", fmt.Sprint(defaultMaxQueueLimit)}, "Set maxqueue to `500`"},
+		{[]string{"set", "disabled", "q,nope"}, ""},
+		{[]string{"set", "disabled", "q"}, "Set disabled to `queue`"},
+		{[]string{"set", "disabled", "none"}, "Set disabled to `none`"},
+	}
+	for _, test := range tests {
+		err := handleSettings(ctx, registry, test.args)
+		if test.want == "" {
+			assertUsageError(t, err)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("settings %q: %s", test.args, err)
+		}
+		if content := session.LastMessage().Content; content != test.want {
+			t.Errorf("settings %q replied %q, want %q", test.args, content, test.want)
+		}
+	}
+	if settings := store.Guild("settings-set"); settings.Prefix != "!!" || settings.MaxQueueLen != defaultMaxQueueLimit {
+		t.Errorf("expected the settings to be saved, got %+v", settings)
+	}
+}
+
+func TestSettingsSetInvalid(t *testing.T) {
+	session := fake.NewSession()
+	ctx := newAccessContext(t, session, "settings-invalid")
+	registry := newSettingsRegistry()
+	for _, args := range [][]string{
+		{"set", "prefix", "toolong"},
+		{"set", "prefix", "a", "b"},
+		{"set", "prefix"},
+		{"set", "maxqueue", "0"},
+		{"set", "maxqueue", fmt.Sprint(defaultMaxQueueLimit + 1)},
+		{"set", "maxqueue", "lots"},
+		{"set", "disabled", "help"},
+		{"set", "disabled", "queue", "commands"},
+		{"set", "disabled", "settings"},
+		{"set", "nope", "1"},
+	} {
+		assertUsageError(t, handleSettings(ctx, registry, args))
+	}
+	// Nothing is saved when a value is refused
+	settings := store.Guild("settings-invalid")
+	if settings.Prefix != store.DefaultPrefix || settings.MaxQueueLen != store.DefaultMaxQueueLen || len(settings.DisabledCommands) != 0 {
+		t.Errorf("expected the default settings, got %+v", settings)
+	}
+	if n := len(session.Messages()); n != 0 {
+		t.Errorf("expected no replies, got %d", n)
+	}
+}
@@ -1,9 +1,11 @@
 package command
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	zmq "github.com/pebbe/zmq4"
 )
@@ -18,13 +20,22 @@ type WorkerSocket struct {
 	sck *zmq.Socket
 }
 
-func NewWorkerSocket() (*WorkerSocket, error) {
+/*
+Connect a socket to the worker. Receiving gives up at the context's deadline if it has one
+*/
+func NewWorkerSocket(ctx context.Context) (*WorkerSocket, error) {
 	//  Prepare our context and sockets
 	sck, err := zmq.NewSocket(zmq.REQ)
 	if err != nil {
 		log.Printf("Failed to create socket: %s", err)
 		return nil, err
 	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = sck.SetRcvtimeo(time.Until(deadline)); err != nil {
+			sck.Close()
+			return nil, err
+		}
+	}
 
 	err = sck.Connect("tcp://localhost:5678")
 	if err != nil {
@@ -34,6 +45,10 @@ func NewWorkerSocket() (*WorkerSocket, error) {
 	return &WorkerSocket{sck}, err
 }
 
+func (w *WorkerSocket) Close() error {
+	return w.sck.Close()
+}
+
 func (w *WorkerSocket) Send(command string, params *map[string]interface{}) error {
 	log.Printf("Sending command %s to worker", command)
 	data, err := json.Marshal(params)
@@ -56,7 +71,7 @@ func (w *WorkerSocket) Receive() (interface{}, error) {
 		return nil, err
 	}
 	if response.Code != 0 {
-		log.Printf("Worker errored: %s", response.Error)
+		return nil, fmt.Errorf("worker errored with code %d: %s", response.Code, response.Error)
 	}
 	return response.Result, nil
 }
@@ -3,383 +3,354 @@ package command
 import (
 	"bluebot/config"
 	"bluebot/jytdl"
+	"bluebot/store"
 	"bluebot/util"
 	"context"
-	"crypto/md5"
-	"crypto/rand"
-	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"google.golang.org/api/option"
 
-	"github.com/bwmarrin/discordgo"
-	"github.com/ebml-go/webm"
 	"google.golang.org/api/youtube/v3"
 )
 
 var (
-	MaxQueueLen     int = 30
-	MaxQueueDisplay int = 3
-	MaxListDisplay  int = 10
+	MaxQueueDisplay  int = 3
+	MaxListDisplay   int = 10
+	MaxSearchResults int = 5
 )
 
-var Subscriptions = make(map[string]*Subscription)
-var UsedIDs = make(map[string]bool)
-
 // Each instance of the bot playing in a voice channel is a "Subscription"
 type Subscription struct {
-	ID        string      // Unique ID
-	Folder    string      // Base folder + ID
-	QueueView []*Track    // All videos in queue, downloaded or not, needed for displaying queue
-	mu        *sync.Mutex // To prevent race condition on queue append
-	Events    chan string // Event queue (user actions such as pause, next etc.)
-	Downloads chan *Track // To download queue
-	Tracks    chan *Track // Downloaded tracks queue
+	ID          string          // Unique ID
+	GuildID     string          // Guild it's playing in
+	ChannelID   string          // Voice channel it's playing in
+	Folder      string          // Base folder + ID
+	MaxQueueLen int             // Limit on tracks in the queue, from the guild's settings
+	mu          *sync.Mutex     // Guards the player status and playlists
+	queue       *TrackQueue     // All tracks, downloaded or not, starting with the one playing
+	playlists   []*playlistFeed // Still being added as the queue plays, in the order queued
+
+	commands chan playerCommand // Actions for the player to carry out
+	done     chan struct{}      // Closed when the player stops
+	stopOnce sync.Once
+	state    PlayerState
+	current  *Track
+	elapsed  time.Duration
+	duration time.Duration
+	stopNP   context.CancelFunc // Stops updating the last now playing message
+	votes    map[string]bool    // IDs of users who voted to skip the current track
 }
 
 // Represents a downloaded track
 type Track struct {
-	ID       string
-	Filename string
-	Title    string
+	ID          string
+	Filename    string
+	Title       string
+	URL         string        // Link to the video
+	Duration    time.Duration // Length from YouTube, 0 if unknown
+	Requester   string        // Name of who queued it
+	RequesterID string
+	Start       time.Duration // Where to start playing from
 }
 
-func NewSubscription() (*Subscription, error) {
-	// Get a random hash as the ID (that isn't in use)
-	var id string
-	for {
-		buffer := make([]byte, 4)
-		_, err := rand.Read(buffer)
-		if err != nil {
-			return nil, err
-		}
-		id = fmt.Sprintf("%x", md5.Sum(buffer))
-		if _, ok := UsedIDs[id]; !ok {
-			UsedIDs[id] = true
-			break
-		}
+// Create a subscription, use Subscriptions.Start to get one with a unique ID
+func NewSubscription(id string, maxQueueLen int) *Subscription {
+	return &Subscription{
+		ID:          id,
+		Folder:      config.Get().AudioPath + "/" + id,
+		MaxQueueLen: maxQueueLen,
+		mu:          &sync.Mutex{},
+		queue:       NewTrackQueue(),
+		commands:    make(chan playerCommand),
+		done:        make(chan struct{}),
+		votes:       map[string]bool{},
 	}
-	sub := &Subscription{
-		ID:        id,
-		Folder:    config.Cfg.AudioPath + "/" + id,
-		mu:        &sync.Mutex{},
-		QueueView: []*Track{},
-		Events:    make(chan string),
-		Downloads: make(chan *Track, MaxQueueLen),
-		Tracks:    make(chan *Track, MaxQueueLen),
-	}
-	return sub, nil
+}
+
+// Copy of the tracks in the queue, starting with the one playing
+func (sub *Subscription) Queue() []*Track {
+	return sub.queue.Tracks()
+}
+
+func (sub *Subscription) QueueLen() int {
+	return sub.queue.Len()
 }
 
 /*
 Add a video or playlist to the queue and downloads channel. Directly get the metadata and add
 to queue if a URL otherwise first search youtube and use the first valid result
 */
-func (sub *Subscription) AddToQueue(session *discordgo.Session, chID string, terms []string) {
-	if MaxQueueLen-len(sub.QueueView) < 1 {
-		session.ChannelMessageSend(chID, "Max queue length reached")
-		return
+func (sub *Subscription) AddToQueue(ctx *util.Context, query string) error {
+	if err := sub.checkSpace(); err != nil {
+		return err
 	}
 
-	var err error
-	if !strings.Contains(terms[0], "https://") {
+	if !isLink(query) {
 		// Not a URL so search youtube for a video/playlist
-		items, err := searchYT(strings.Join(terms, " "))
+		items, err := searchYT(ctx, query)
 		if err != nil {
-			session.ChannelMessageSend(chID, "YouTube search returned no results")
-			log.Println(err)
-			return
+			return ServiceError("YouTube", err)
 		}
 		// Use first result with an ID that can be added
 		for i := range items {
 			if items[i].Id.VideoId != "" {
-				track := &Track{items[i].Id.VideoId, "", items[i].Snippet.Title}
-				err = sub.addVideo(session, chID, track, true)
-
+				var track *Track
+				if track, err = trackFromID(ctx, items[i].Id.VideoId); err == nil {
+					err = sub.addVideo(ctx, track, true)
+				}
 			} else if items[i].Id.PlaylistId != "" {
-				err = sub.addPlaylist(session, chID, items[i].Id.PlaylistId)
+				err = sub.addPlaylist(ctx, items[i].Id.PlaylistId)
 			}
 			if err == nil {
-				return
+				return nil
 			}
 		}
-		session.ChannelMessageSend(chID, "YouTube search returned no results")
-		log.Println(err)
+		if err != nil {
+			return err
+		}
+		return UserError("YouTube search returned no results for %s", query)
+	}
 
-	} else {
-		// Use the given URL
-		URL := terms[0]
-		if !strings.Contains(URL, "list=") {
-			track, err := trackFromURL(URL)
-			if err == nil {
-				err = sub.addVideo(session, chID, track, true) //lint:ignore SA4006 error is handled
-			}
-		} else {
-			err = sub.addPlaylist(session, chID, strings.Split(URL, "list=")[1])
+	// Use the given URL
+	link, err := parseYouTubeURL(strings.Fields(query)[0])
+	if err != nil {
+		return err
+	}
+	if link.PlaylistID != "" {
+		return sub.addPlaylist(ctx, link.PlaylistID)
+	}
+	track, err := trackFromID(ctx, link.VideoID)
+	if err != nil {
+		return err
+	}
+	track.Start = link.Start
+	return sub.addVideo(ctx, track, true)
+}
+
+// Returns a user error if the queue has no room for another track
+func (sub *Subscription) checkSpace() error {
+	if sub.MaxQueueLen-sub.QueueLen() < 1 {
+		return UserError("The queue is full, it can only hold %d tracks", sub.MaxQueueLen)
+	}
+	return nil
+}
+
+// The parts of a YouTube link used to queue it
+type youtubeLink struct {
+	VideoID    string
+	PlaylistID string
+	Start      time.Duration // From a t= timestamp
+}
+
+/*
+Read a YouTube video or playlist link, in any of the forms YouTube shares them e.g.
+youtube.com/watch?v=ID, youtu.be/ID, youtube.com/shorts/ID or youtube.com/playlist?list=ID
+*/
+func parseYouTubeURL(raw string) (*youtubeLink, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, UserError("Couldn't read the link %s", raw)
+	}
+	query := u.Query()
+	link := &youtubeLink{PlaylistID: query.Get("list")}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case host == "youtu.be":
+		link.VideoID = path[0]
+	case host == "youtube.com" || strings.HasSuffix(host, ".youtube.com"):
+		if path[0] == "watch" {
+			link.VideoID = query.Get("v")
+		} else if len(path) == 2 && (path[0] == "shorts" || path[0] == "embed" || path[0] == "live") {
+			link.VideoID = path[1]
 		}
-		if err != nil {
-			session.ChannelMessageSend(chID, "Failed to find a download for "+URL)
-			log.Println(err)
+	default:
+		return nil, UserError("Only YouTube links can be queued")
+	}
+	if link.VideoID == "" && link.PlaylistID == "" {
+		return nil, UserError("Couldn't find a video or playlist in the link %s", raw)
+	}
+
+	timestamp := query.Get("t")
+	if timestamp == "" {
+		timestamp = query.Get("start")
+	}
+	if timestamp != "" {
+		if link.Start, err = parseTimestamp(timestamp); err != nil {
+			return nil, UserError("Couldn't read the timestamp t=%s in the link", timestamp)
 		}
 	}
+	return link, nil
 }
 
 /*
 Search youtube for a list of videos or playlists
 */
-func searchYT(query string) ([]*youtube.SearchResult, error) {
-	ctx := context.Background()
-	service, err := youtube.NewService(ctx, option.WithCredentialsFile(config.Cfg.GoogleKeyPath))
+func searchYT(ctx context.Context, query string) ([]*youtube.SearchResult, error) {
+	service, err := youtube.NewService(ctx, option.WithCredentialsFile(config.Get().GoogleKeyPath))
 	if err != nil {
 		return nil, err
 	}
 	parts := []string{"snippet"}
-	results, err := service.Search.List(parts).Q(query).MaxResults(5).Do()
-	if err != nil || len(results.Items) == 0 {
+	results, err := service.Search.List(parts).Q(query).MaxResults(int64(MaxSearchResults)).Context(ctx).Do()
+	if err != nil {
 		return nil, err
 	}
 	return results.Items, nil
 }
 
-func trackFromURL(URL string) (*Track, error) {
-	ctx := context.Background()
-	service, err := youtube.NewService(ctx, option.WithCredentialsFile(config.Cfg.GoogleKeyPath))
-	if err != nil {
-		return nil, err
-	}
-
-	parts := []string{"snippet"}
-	vid := strings.Split(URL, "v=")[1]
-	videos, err := service.Videos.List(parts).Id(vid).Do()
+func trackFromID(ctx context.Context, vid string) (*Track, error) {
+	tracks, err := tracksFromIDs(ctx, []string{vid})
 	if err != nil {
 		return nil, err
 	}
-	if len(videos.Items) < 1 {
-		return nil, errors.New("no video found for given ID")
+	if len(tracks) < 1 {
+		return nil, UserError("Couldn't find the YouTube video %s", vid)
 	}
-
-	return &Track{vid, "", videos.Items[0].Snippet.Title}, nil
+	return tracks[0], nil
 }
 
 /*
-Get the list of videos for a playlist and add them to the download queue
+Get the title and length of up to 50 videos in one request. Videos that can't be found, e.g.
+because they're private or deleted, are left out
 */
-func (sub *Subscription) addPlaylist(session *discordgo.Session, chID string, ID string) error {
-	ctx := context.Background()
-	service, err := youtube.NewService(ctx, option.WithCredentialsFile(config.Cfg.GoogleKeyPath))
+func tracksFromIDs(ctx context.Context, ids []string) ([]*Track, error) {
+	service, err := youtube.NewService(ctx, option.WithCredentialsFile(config.Get().GoogleKeyPath))
 	if err != nil {
-		return err
+		return nil, ServiceError("YouTube", err)
 	}
-	parts := []string{"snippet"}
-	maxResults := int64(MaxQueueLen - len(sub.QueueView))
-	results, err := service.PlaylistItems.List(parts).PlaylistId(ID).MaxResults(maxResults).Do()
+
+	parts := []string{"snippet", "contentDetails"}
+	videos, err := service.Videos.List(parts).Id(ids...).Context(ctx).Do()
 	if err != nil {
-		return err
+		return nil, ServiceError("YouTube", err)
 	}
-
-	tracksAdded := 0
-	message, _ := session.ChannelMessageSend(chID, "--> Adding playlist to the queue...")
-	for _, item := range results.Items {
-		track := &Track{item.Snippet.ResourceId.VideoId, "", item.Snippet.Title}
-		err := sub.addVideo(session, chID, track, false)
-		// Count tracks added for condensed message
-		if err == nil {
-			tracksAdded++
-			session.ChannelMessageEdit(
-				chID, message.ID, fmt.Sprintf("--> Added track [ %s ] to the queue", item.Snippet.Title),
-			)
+	byID := make(map[string]*youtube.Video, len(videos.Items))
+	for _, video := range videos.Items {
+		byID[video.Id] = video
+	}
+	tracks := make([]*Track, 0, len(ids))
+	for _, id := range ids {
+		video, ok := byID[id]
+		if !ok {
+			continue
+		}
+		track := &Track{ID: id, Title: video.Snippet.Title, URL: videoURL(id)}
+		if video.ContentDetails != nil {
+			track.Duration, _ = parseISODuration(video.ContentDetails.Duration)
 		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+func videoURL(id string) string {
+	return "https://www.youtube.com/watch?v=" + id
+}
 
+var isoDurationRegex = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// Read a video length as given by the YouTube API, e.g. PT4M13S
+func parseISODuration(iso string) (time.Duration, error) {
+	match := isoDurationRegex.FindStringSubmatch(iso)
+	if match == nil {
+		return 0, fmt.Errorf("invalid duration %s", iso)
 	}
-	session.ChannelMessageDelete(chID, message.ID)
-	session.ChannelMessageSend(chID, fmt.Sprintf("--> Added %d tracks to the queue", tracksAdded))
-	return nil
+	var total time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if n, err := strconv.Atoi(match[i+1]); err == nil {
+			total += time.Duration(n) * unit
+		}
+	}
+	return total, nil
+}
+
+// How tracks are added to the queue, from the guild's settings
+func (sub *Subscription) queuePolicy() QueuePolicy {
+	settings := store.Guild(sub.GuildID)
+	return QueuePolicy{MaxLen: sub.MaxQueueLen, MaxPerUser: settings.MaxUserTracks, Fair: settings.FairQueue}
 }
 
 /*
-Get metadata including audio formats for a video from its URL and add to the
-queue & downloads channel
+Add a video to the queue, where the download manager will pick it up
 */
-func (sub *Subscription) addVideo(
-	session *discordgo.Session, chID string, track *Track, isShowingMessage bool,
-) error {
-	sub.Downloads <- track
-	sub.mu.Lock()
-	sub.QueueView = append(sub.QueueView, track)
-	sub.mu.Unlock()
+func (sub *Subscription) addVideo(ctx *util.Context, track *Track, isShowingMessage bool) error {
+	track.Requester = ctx.AuthorName()
+	track.RequesterID = ctx.Author.ID
+	if err := sub.queue.Add(track, sub.queuePolicy()); err != nil {
+		return err
+	}
 	if isShowingMessage {
-		session.ChannelMessageSend(chID, fmt.Sprintf("--> Added track [ %s ] to the queue", track.Title))
+		ctx.Send(fmt.Sprintf("--> Added track [ %s ] to the queue", track.Title))
 	}
 	return nil
 }
 
 /*
-Manages downloading and saving tracks using the metadata added to the downloads channel
-by the queue manager
+Manages downloading the next few tracks in the queue, waiting for the queue to change when
+they're all downloaded
 
-Puts the Track object containing the filename on the tracks channel to be picked up by the
-playback manager
+The filename is set on each track once it's downloaded, so the playback manager can play it
 */
 func (sub *Subscription) ManageDownloads(ctx context.Context) {
-	for {
-		// Only download 2 tracks in advance
-		for len(sub.Tracks) > 1 {
-			time.Sleep(time.Second)
-		}
-		select {
-		// Get video metadata from queue and download the audio file
-		case track := <-sub.Downloads:
-			err := downloadAudio(sub.Folder, track)
-			if err != nil {
-				log.Printf("Failed to download file for %s", track.ID)
-				log.Println(err)
-				sub.removeQueueItem(track)
-				continue
+	for ctx.Err() == nil {
+		track, changed := sub.queue.NextDownload()
+		if track == nil {
+			select {
+			case <-changed:
+			case <-ctx.Done():
 			}
-			sub.Tracks <- track
-
-		case <-ctx.Done():
-			log.Println("Closing file download manager")
-			return
-
-		default:
-			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		filename, err := downloadAudio(sub.Folder, track)
+		if err != nil {
+			log.Printf("Failed to download file for %s", track.ID)
+			log.Println(err)
+			sub.queue.RemoveTrack(track)
+			continue
+		}
+		// Removed from the queue while downloading
+		if !sub.queue.SetDownloaded(track, filename) {
+			os.Remove(filename)
 		}
 	}
+	log.Println("Closing file download manager")
 }
 
 /*
 Download a youtube video's audio to a WebM file with opus audio.
-Sets the output filename on the track object
+Returns the output filename
 */
-func downloadAudio(folder string, track *Track) error {
+func downloadAudio(folder string, track *Track) (string, error) {
 	log.Printf("Downloading audio file for %s\n", track.ID)
 	// Create unique file name
 	randHex, err := util.RandomHex(4)
 	if err != nil {
-		return err
+		return "", err
 	}
 	filename := fmt.Sprintf("%s/%s-%s.weba", folder, track.ID, randHex)
 	// Download
 	err = jytdl.GetAudio(track.ID, filename, "audio/webm")
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.Printf("Finished downloading for %s\n", track.ID)
-	track.Filename = filename
-	return nil
-}
-
-func (sub *Subscription) removeQueueItem(track *Track) {
-	// Remove element from queue view
-	for i, item := range sub.QueueView {
-		if item.ID == track.ID {
-			sub.mu.Lock()
-			sub.QueueView = append(sub.QueueView[:i], sub.QueueView[i+1:]...)
-			sub.mu.Unlock()
-			break
-		}
-	}
+	return filename, nil
 }
 
-/*
-Play over the dowloaded tracks from the track channel by parsing the WebM and directly sending
-the opus packets, deleting each track's file after it's finished
-
-# Accepts control events through the events channel
-
-Waits for a bit when the track channel is empty before closing in case download is slow.
-There's a long timeout on the parsed WebM channel for a similar reason
-*/
-func (sub *Subscription) ManagePlayback(session *discordgo.Session, chID string, vc *discordgo.VoiceConnection, ctx context.Context, cancel context.CancelFunc) {
-	defer cancel()
-	for {
-		// Iterate over the Tracks channel
-		select {
-		case track := <-sub.Tracks:
-			file, err := os.Open(track.Filename)
-			if err != nil {
-				log.Printf("An error occurred opening [ %s ] for subscription %s: %s", track.Title, sub.ID, err)
-				session.ChannelMessageSend(chID, fmt.Sprintf("Failed to play [ %s ], skipping", track.Title))
-				continue
-			}
-
-			// Parse webm
-			var w webm.WebM
-			wr, err := webm.Parse(file, &w)
-			if err != nil {
-				log.Printf("An error occurred parsing [ %s ] for subscription %s: %s", track.Title, sub.ID, err)
-				session.ChannelMessageSend(chID, fmt.Sprintf("Failed to play [ %s ], skipping", track.Title))
-			}
-			session.ChannelMessageSend(chID, fmt.Sprintf("--> Playing track [ %s ]", track.Title))
-			log.Printf("Playing track [ %s ] for subscription %s", track.Title, sub.ID)
-			// Read opus data from parsed webm and pass into sending channel
-			playing := true
-			for playing {
-				select {
-				// Check for events over packets
-				case event := <-sub.Events:
-					switch event {
-					case "next":
-						playing = false
-					case "pause":
-						quit := WaitForResume(sub.Events)
-						if quit {
-							return
-						}
-					case "stop":
-						return
-					default:
-						continue
-					}
-				// Send the opus data
-				case packet, ok := <-wr.Chan:
-					if !ok {
-						playing = false
-					}
-					vc.OpusSend <- packet.Data
-				// Move on after 2 seconds of no packets
-				case <-time.After(2 * time.Second):
-					log.Printf("Failed to read any packets for subscription %s", sub.ID)
-					playing = false
-				}
-			}
-			// Cleanup file and queue list
-			file.Close()
+// Delete the files of tracks taken out of the queue before they played
+func deleteTrackFiles(tracks []*Track) {
+	for _, track := range tracks {
+		if track.Filename != "" {
 			os.Remove(track.Filename)
-			sub.mu.Lock()
-			sub.QueueView = sub.QueueView[1:]
-			sub.mu.Unlock()
-
-		case <-ctx.Done():
-			return
-
-		default:
-			time.Sleep(500 * time.Millisecond)
-		}
-	}
-}
-
-/*
-Wait for an event through the channel to end the pause.
-Returns true if we need to stop rather than just resume
-*/
-func WaitForResume(ch chan string) bool {
-	for {
-		select {
-		case event := <-ch:
-			if event == "resume" {
-				return false
-			} else if event == "stop" {
-				return true
-			}
-		default:
-			time.Sleep(time.Millisecond * 300)
 		}
 	}
 }
@@ -0,0 +1,100 @@
+package command
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// Subscriptions currently playing, shared by the music handlers and players
+var Subscriptions = NewSubscriptionRegistry()
+
+/*
+Set of playing subscriptions that can be looked up by voice channel or guild, safe to use
+from concurrent handlers. The bot can only be in one voice channel per guild, so there's at
+most one subscription per guild
+*/
+type SubscriptionRegistry struct {
+	mu        sync.RWMutex
+	byID      map[string]*Subscription
+	byChannel map[string]*Subscription
+	byGuild   map[string]*Subscription
+}
+
+func NewSubscriptionRegistry() *SubscriptionRegistry {
+	return &SubscriptionRegistry{
+		byID:      make(map[string]*Subscription),
+		byChannel: make(map[string]*Subscription),
+		byGuild:   make(map[string]*Subscription),
+	}
+}
+
+/*
+Create a subscription for a voice channel and add it, unless the guild already has one.
+Checking and adding happen together so two commands can't both start a player
+*/
+func (r *SubscriptionRegistry) Start(guildID, voiceChannelID string, maxQueueLen int) (*Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.byGuild[guildID]; ok {
+		if existing.ChannelID == voiceChannelID {
+			return nil, UserError("Music is already playing in your voice channel")
+		}
+		return nil, UserError("Music is already playing in another voice channel in this server")
+	}
+	// Get a random hash as the ID (that isn't in use)
+	var id string
+	for {
+		buffer := make([]byte, 4)
+		if _, err := rand.Read(buffer); err != nil {
+			return nil, err
+		}
+		id = fmt.Sprintf("%x", md5.Sum(buffer))
+		if _, ok := r.byID[id]; !ok {
+			break
+		}
+	}
+	sub := NewSubscription(id, maxQueueLen)
+	sub.GuildID = guildID
+	sub.ChannelID = voiceChannelID
+	r.byID[id] = sub
+	r.byChannel[voiceChannelID] = sub
+	r.byGuild[guildID] = sub
+	return sub, nil
+}
+
+// Remove a subscription, if it's still the one registered
+func (r *SubscriptionRegistry) Remove(sub *Subscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.byID[sub.ID] != sub {
+		return
+	}
+	delete(r.byID, sub.ID)
+	delete(r.byChannel, sub.ChannelID)
+	delete(r.byGuild, sub.GuildID)
+}
+
+// Find the subscription playing in a voice channel
+func (r *SubscriptionRegistry) Get(voiceChannelID string) (*Subscription, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.byChannel[voiceChannelID]
+	return sub, ok
+}
+
+// Find the subscription playing in any of a guild's voice channels
+func (r *SubscriptionRegistry) ForGuild(guildID string) (*Subscription, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.byGuild[guildID]
+	return sub, ok
+}
+
+// Number of subscriptions playing
+func (r *SubscriptionRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.byID)
+}
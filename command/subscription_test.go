@@ -0,0 +1,200 @@
+package command
+
+import (
+	"bluebot/fake"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionRegistryLookup(t *testing.T) {
+	registry := NewSubscriptionRegistry()
+	sub, err := registry.Start("guild", "voice", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := registry.Get("voice"); !ok || got != sub {
+		t.Error("subscription not found by voice channel")
+	}
+	if got, ok := registry.ForGuild("guild"); !ok || got != sub {
+		t.Error("subscription not found by guild")
+	}
+	if _, err = registry.Start("guild", "other-voice", 5); err == nil {
+		t.Error("expected an error starting a second subscription in the guild")
+	}
+
+	registry.Remove(sub)
+	if _, ok := registry.Get("voice"); ok {
+		t.Error("subscription still found after removing")
+	}
+	if _, ok := registry.ForGuild("guild"); ok {
+		t.Error("subscription still found by guild after removing")
+	}
+	// A stale remove mustn't take out a newer subscription
+	newer, err := registry.Start("guild", "voice", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Remove(sub)
+	if got, ok := registry.Get("voice"); !ok || got != newer {
+		t.Error("newer subscription removed by a stale remove")
+	}
+}
+
+func TestSubscriptionRegistryParallel(t *testing.T) {
+	registry := NewSubscriptionRegistry()
+	const guilds = 50
+	var wg sync.WaitGroup
+	started := make(chan *Subscription, guilds*2)
+	for i := 0; i < guilds; i++ {
+		guildID := fmt.Sprint("guild-", i)
+		// Two commands race to start a player in each guild, only one should win
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(voiceChannelID string) {
+				defer wg.Done()
+				sub, err := registry.Start(guildID, voiceChannelID, 10)
+				if err != nil {
+					if !isErrorKind(err, ErrUser) {
+						t.Errorf("unexpected error starting in %s: %v", guildID, err)
+					}
+					return
+				}
+				sub.queue.Add(&Track{ID: "track", Title: "track"}, QueuePolicy{MaxLen: sub.MaxQueueLen})
+				started <- sub
+			}(fmt.Sprintf("voice-%d-%d", i, j))
+		}
+	}
+	wg.Wait()
+	close(started)
+
+	subs := []*Subscription{}
+	ids := map[string]bool{}
+	for sub := range started {
+		subs = append(subs, sub)
+		if ids[sub.ID] {
+			t.Errorf("duplicate subscription ID %s", sub.ID)
+		}
+		ids[sub.ID] = true
+	}
+	if len(subs) != guilds || registry.Len() != guilds {
+		t.Fatalf("expected one subscription per guild, started %d, registered %d", len(subs), registry.Len())
+	}
+
+	for _, sub := range subs {
+		wg.Add(1)
+		go func(sub *Subscription) {
+			defer wg.Done()
+			if got, ok := registry.ForGuild(sub.GuildID); !ok || got != sub {
+				t.Errorf("wrong subscription for %s", sub.GuildID)
+			}
+			if got, ok := registry.Get(sub.ChannelID); !ok || got != sub {
+				t.Errorf("wrong subscription for %s", sub.ChannelID)
+			}
+			if len(sub.Queue()) != 1 {
+				t.Errorf("expected a track queued for %s", sub.GuildID)
+			}
+			registry.Remove(sub)
+		}(sub)
+	}
+	wg.Wait()
+	if registry.Len() != 0 {
+		t.Errorf("%d subscriptions left after removing them all", registry.Len())
+	}
+}
+
+func TestMusicHandlersParallel(t *testing.T) {
+	session := fake.NewSession()
+	sub := addTestSubscription(t, session, "voice-parallel", "first", "second")
+	sub.MaxQueueLen = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := handleList(newTestContext(session, "music"), nil); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// The queue is full so this doesn't need YouTube
+			if err := handleQueue(newTestContext(session, "music"), []string{"song"}); !isErrorKind(err, ErrUser) {
+				t.Errorf("expected the queue to be full, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestVoiceUserCountsParallel(t *testing.T) {
+	counts := &userCounts{counts: map[string]int{}}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counts.add("voice", 1)
+			counts.add("other", 1)
+			counts.add("other", -1)
+		}()
+	}
+	wg.Wait()
+	if n := counts.get("voice"); n != 100 {
+		t.Errorf("expected 100 users, got %d", n)
+	}
+	if n := counts.get("other"); n != 0 {
+		t.Errorf("expected no users left, got %d", n)
+	}
+}
+
+func TestParseYouTubeURL(t *testing.T) {
+	links := map[string]youtubeLink{
+		"https://www.youtube.com/watch?v=abc123":                  {VideoID: "abc123"},
+		"https://youtube.com/watch?v=abc123&t=83":                 {VideoID: "abc123", Start: 83 * time.Second},
+		"https://youtu.be/abc123?t=1m23s":                         {VideoID: "abc123", Start: 83 * time.Second},
+		"https://m.youtube.com/watch?v=abc123&start=90":           {VideoID: "abc123", Start: 90 * time.Second},
+		"https://www.youtube.com/shorts/abc123":                   {VideoID: "abc123"},
+		"https://music.youtube.com/watch?v=abc123&list=PL1":       {VideoID: "abc123", PlaylistID: "PL1"},
+		"https://www.youtube.com/playlist?list=PL1":               {PlaylistID: "PL1"},
+		"https://www.youtube.com/watch?list=PL1&v=abc123&index=2": {VideoID: "abc123", PlaylistID: "PL1"},
+	}
+	for raw, want := range links {
+		got, err := parseYouTubeURL(raw)
+		if err != nil {
+			t.Errorf("parseYouTubeURL(%q) failed: %s", raw, err)
+		} else if *got != want {
+			t.Errorf("parseYouTubeURL(%q) = %+v, want %+v", raw, *got, want)
+		}
+	}
+
+	for _, raw := range []string{
+		"https://www.youtube.com/",
+		"https://www.youtube.com/watch?x=1",
+		"https://example.com/watch?v=abc123",
+		"https://youtu.be/abc123?t=soon",
+	} {
+		_, err := parseYouTubeURL(raw)
+		assertErrorKind(t, err, ErrUser)
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	durations := map[string]time.Duration{
+		"PT4M13S":  4*time.Minute + 13*time.Second,
+		"PT1H2M3S": time.Hour + 2*time.Minute + 3*time.Second,
+		"PT30S":    30 * time.Second,
+		"P1DT2H":   26 * time.Hour,
+		"P0D":      0,
+	}
+	for iso, want := range durations {
+		if got, err := parseISODuration(iso); err != nil || got != want {
+			t.Errorf("parseISODuration(%q) = %s, %v, want %s", iso, got, err, want)
+		}
+	}
+	if _, err := parseISODuration("4:13"); err == nil {
+		t.Error("expected a duration that isn't ISO 8601 to fail")
+	}
+}
@@ -2,66 +2,89 @@ package command
 
 import (
 	"bluebot/config"
+	"bluebot/store"
+	"bluebot/util"
 	"context"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"strings"
 	"sync"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/hajimehoshi/go-mp3"
 	"google.golang.org/api/option"
 	"google.golang.org/api/texttospeech/v1"
 	"layeh.com/gopus"
 )
 
+var SetVoiceArgs = []*Arg{
+	{
+		Name:        "preset",
+		Description: "Voice preset name",
+		Kind:        ArgEnum,
+		Required:    true,
+		Choices:     config.VoicePresetNames,
+	},
+}
+
+var TellArgs = []*Arg{
+	{Name: "message", Description: "What to say", Kind: ArgRest, Required: true},
+}
+
 var (
 	// Opus encoding constants
-	FrameSize      int    = 960
-	Channels       int    = 1
-	SampleRate     int    = 48000
-	BitRate        int    = 64 * 1000
-	VoiceSelection string = "default"
+	FrameSize  int = 960
+	Channels   int = 1
+	SampleRate int = 48000
+	BitRate    int = 64 * 1000
 )
 
 /*
-	Set the current voice preset from the available ones
+	Set this guild's voice preset from the available ones
 */
-func HandleSetVoice(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	if len(args) < 1 {
-		session.ChannelMessageSend(msg.ChannelID, "No voice preset given")
-		return nil
+func HandleSetVoice(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgs(SetVoiceArgs, args)
+	if err != nil {
+		return err
 	}
-	if _, ok := config.VoicePresets[args[0]]; !ok {
-		session.ChannelMessageSend(msg.ChannelID, "Preset doesn't exist")
+	preset := parsed.String("preset")
+	err = store.UpdateGuild(ctx.GuildID, func(settings *store.GuildSettings) error {
+		settings.VoicePreset = preset
 		return nil
+	})
+	if errors.Is(err, store.ErrNoGuild) {
+		return UserError("Voice presets can only be set in a server")
+	} else if err != nil {
+		return err
 	}
-	VoiceSelection = args[0]
-	session.ChannelMessageSend(msg.ChannelID, "Preset set to "+VoiceSelection)
+	ctx.Send("Preset set to " + preset)
 	return nil
 }
 
 /*
 	Play the MP3 audio file generated by the Python backend
 */
-func HandleTell(session *discordgo.Session, msg *discordgo.MessageCreate, args []string) error {
-	voiceChannelID := getAuthorVoiceChannel(session, msg)
+func HandleTell(ctx *util.Context, args []string) error {
+	parsed, err := ParseArgsFrom(ctx, TellArgs, args)
+	if err != nil {
+		return err
+	}
+	voiceChannelID := getAuthorVoiceChannel(ctx)
 	if voiceChannelID == "" {
-		session.ChannelMessageSend(msg.ChannelID, "You're not in a voice channel")
-		return nil
+		return UserError("You're not in a voice channel")
 	}
 	// Join voice channel and start websocket audio communication
-	vc, err := session.ChannelVoiceJoin(msg.GuildID, voiceChannelID, false, true)
+	vc, err := ctx.Session.ChannelVoiceJoin(ctx.GuildID, voiceChannelID, false, true)
 	if err != nil {
 		return err
 	}
 	defer vc.Disconnect()
 
-	err = generateVoice(strings.Join(args, " "))
+	err = generateVoice(ctx, parsed.String("message"), store.Guild(ctx.GuildID).VoicePreset)
 	if err != nil {
 		return err
 	}
@@ -77,14 +100,23 @@ func HandleTell(session *discordgo.Session, msg *discordgo.MessageCreate, args [
 	return nil
 }
 
-func generateVoice(message string) error {
-	ctx := context.Background()
-	tts, err := texttospeech.NewService(ctx, option.WithCredentialsFile(config.Cfg.GoogleKeyPath))
+func generateVoice(ctx context.Context, message string, presetName string) error {
+	tts, err := texttospeech.NewService(ctx, option.WithCredentialsFile(config.Get().GoogleKeyPath))
 	if err != nil {
-		return err
+		return ServiceError("Text-to-Speech", err)
 	}
 
-	preset := config.VoicePresets[VoiceSelection]
+	// Presets can disappear from config after being saved for a guild
+	preset, ok := config.GetVoicePreset(presetName)
+	if !ok {
+		preset, ok = config.GetVoicePreset(store.DefaultVoicePreset)
+	}
+	if !ok {
+		return InternalError(
+			"The voice presets are missing, ask the bot owner to check them",
+			fmt.Errorf("no voice preset %s or %s", presetName, store.DefaultVoicePreset),
+		)
+	}
 	// Request for voice clip data from Google
 	req := &texttospeech.SynthesizeSpeechRequest{
 		Input: &texttospeech.SynthesisInput{
@@ -101,16 +133,16 @@ func generateVoice(message string) error {
 			SsmlGender:   preset.Gender,
 		},
 	}
-	resp, err := tts.Text.Synthesize(req).Do()
+	resp, err := tts.Text.Synthesize(req).Context(ctx).Do()
 	if err != nil {
-		return err
+		return ServiceError("Text-to-Speech", err)
 	}
 	// Convert to bytes and save
 	decoded, err := base64.StdEncoding.DecodeString(resp.AudioContent)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(config.Cfg.AudioPath+"/output.mp3", decoded, 0644)
+	err = ioutil.WriteFile(config.Get().AudioPath+"/output.mp3", decoded, 0644)
 	if err != nil {
 		return err
 	}
@@ -120,9 +152,9 @@ func generateVoice(message string) error {
 /*
 	Play a reader of MP3 data over discord voice connection
 */
-func playMP3(vc *discordgo.VoiceConnection) error {
+func playMP3(vc util.VoiceConnection) error {
 	// Check the file opens first
-	file, err := os.Open(config.Cfg.AudioPath + "/output.mp3")
+	file, err := os.Open(config.Get().AudioPath + "/output.mp3")
 	if err != nil {
 		return err
 	}
@@ -179,7 +211,7 @@ func MP3Reader(c chan []int16, file io.Reader) {
 /*
 	Encodes raw audio data from a channel in opus and sends over discord
 */
-func opusSender(c chan []int16, vc *discordgo.VoiceConnection) {
+func opusSender(c chan []int16, vc util.VoiceConnection) {
 	// Set up encoder
 	enc, err := gopus.NewEncoder(SampleRate, Channels, gopus.Audio)
 	if err != nil {
@@ -200,7 +232,7 @@ func opusSender(c chan []int16, vc *discordgo.VoiceConnection) {
 			log.Println(err)
 			return
 		}
-		vc.OpusSend <- opus
+		vc.Opus() <- opus
 	}
 
 }
@@ -0,0 +1,32 @@
+package command
+
+import (
+	"bluebot/fake"
+	"testing"
+	"time"
+)
+
+func TestOpusSenderEncodesFrames(t *testing.T) {
+	session := fake.NewSession()
+	vc, err := session.ChannelVoiceJoin("guild", "voice", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := make(chan []int16, 3)
+	for i := 0; i < cap(frames); i++ {
+		frames <- make([]int16, FrameSize*Channels)
+	}
+	close(frames)
+	opusSender(frames, vc)
+
+	fakeVC := session.VoiceConnections()[0]
+	if !fakeVC.WaitForFrames(3, time.Second) {
+		t.Fatalf("expected 3 opus frames, got %d", len(fakeVC.Frames()))
+	}
+	for _, frame := range fakeVC.Frames() {
+		if len(frame) == 0 {
+			t.Error("empty opus frame")
+		}
+	}
+}
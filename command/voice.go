@@ -2,37 +2,66 @@ package command
 
 import (
 	"bluebot/config"
-	"fmt"
-	"strings"
+	"bluebot/store"
+	"bluebot/util"
+	"context"
+	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
-var numUsers = map[string]int{}
+// Number of users in each voice channel, updated by concurrent voice state handlers
+type userCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var numUsers = &userCounts{counts: map[string]int{}}
+
+// Change the count for a channel, returning the new count
+func (c *userCounts) add(channelID string, delta int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[channelID] += delta
+	count := c.counts[channelID]
+	if count <= 0 {
+		delete(c.counts, channelID)
+	}
+	return count
+}
 
-func HandleVoiceState(session *discordgo.Session, msg *discordgo.VoiceStateUpdate) error {
+func (c *userCounts) get(channelID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[channelID]
+}
+
+func HandleVoiceState(ctx context.Context, session util.Session, msg *discordgo.VoiceStateUpdate) error {
 	// Get the member of the voice state update
 	user, err := session.GuildMember(msg.GuildID, msg.UserID)
 	if err != nil {
 		return err
 	}
-	if user.User.ID == session.State.User.ID {
+	if user.User.ID == session.BotUserID() {
 		return nil
 	}
 
 	// User joined
 	if msg.BeforeUpdate == nil {
-		numUsers[msg.ChannelID]++
-		greetUser(session, msg, user)
+		count := numUsers.add(msg.ChannelID, 1)
+		greetUser(ctx, session, msg, user, count)
 		// User left
 	} else if msg.VoiceState.ChannelID == "" {
-		numUsers[msg.BeforeUpdate.ChannelID]--
+		numUsers.add(msg.BeforeUpdate.ChannelID, -1)
 	}
 
 	return nil
 }
 
-func greetUser(session *discordgo.Session, msg *discordgo.VoiceStateUpdate, user *discordgo.Member) error {
+func greetUser(
+	ctx context.Context, session util.Session, msg *discordgo.VoiceStateUpdate, user *discordgo.Member, count int,
+) error {
 	var name string
 	if user.Nick == "" {
 		name = user.User.Username
@@ -40,21 +69,22 @@ func greetUser(session *discordgo.Session, msg *discordgo.VoiceStateUpdate, user
 		name = user.Nick
 	}
 
-	var phrase, text string
-	if numUsers[msg.ChannelID] == 1 {
-		phrase = config.GetPhrase("first_greet")
-	} else if numUsers[msg.ChannelID] < 5 {
-		phrase = config.GetPhrase("normal_greet")
-	} else {
-		phrase = config.GetPhrase("busy_greet")
+	data := &config.PhraseData{
+		User:        name,
+		MemberCount: count,
+		Time:        config.PhraseTime{Time: time.Now()},
 	}
-
-	if strings.Contains(phrase, "%s") {
-		text = fmt.Sprintf(phrase, name)
-	} else {
-		text = phrase
+	if channel, err := session.StateChannel(msg.ChannelID); err == nil {
+		data.Channel = channel.Name
+	}
+	category := "busy_greet"
+	if count == 1 {
+		category = "first_greet"
+	} else if count < 5 {
+		category = "normal_greet"
 	}
-	err := generateVoice(text)
+	text := config.GetPhrase(category, msg.ChannelID, data)
+	err := generateVoice(ctx, text, store.Guild(msg.GuildID).VoicePreset)
 	if err != nil {
 		return err
 	}
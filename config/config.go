@@ -1,40 +1,63 @@
 package config
 
 import (
-	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"math/big"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"gopkg.in/yaml.v3"
 )
 
-var Cfg = &Config{}
+// The config in use, read with Get
+var cfg = &Config{}
 
 var DiscordToken string
 
-var Phrases = make(map[string][]string, 0)
+var Phrases = make(map[string][]*Phrase, 0)
 
 var VoicePresets = make(map[string]*VoicePreset, 0)
 
 var ImageSettings = make(map[string]*ImageSetting, 0)
 
 type Config struct {
-	AudioPath         string `yaml:"AudioPath"`
-	CivListPath       string `yaml:"CivListPath"`
-	CivSelections     int    `yaml:"CivSelections"`
-	GoogleKeyPath     string `yaml:"GoogleKeyPath"`
-	DiscordTokenPath  string `yaml:"DiscordTokenPath"`
-	ImageFontPath     string `yaml:"ImageFontPath"`
-	ImagePath         string `yaml:"ImagePath"`
-	SelfImagePath     string `yaml:"SelfImagePath"`
-	ImageSettingsPath string `yaml:"ImageSettingsPath"`
-	LogFilePath       string `yaml:"LogFilePath"`
-	SettingsDurationS int    `yaml:"SettingsDurationS"`
-	VoicePresetsPath  string `yaml:"VoicePresetsPath"`
+	AudioPath         string                `yaml:"AudioPath"`
+	CivListPath       string                `yaml:"CivListPath"`
+	CivSelections     int                   `yaml:"CivSelections"`
+	CommandTimeoutS   int                   `yaml:"CommandTimeoutS"`
+	CommandTimeouts   map[string]int        `yaml:"CommandTimeouts"` // Per command, in seconds
+	DatabasePath      string                `yaml:"DatabasePath"`
+	GoogleKeyPath     string                `yaml:"GoogleKeyPath"`
+	DiscordTokenPath  string                `yaml:"DiscordTokenPath"`
+	ErrorEmbeds       bool                  `yaml:"ErrorEmbeds"` // Show command errors as embeds
+	ImageFontPath     string                `yaml:"ImageFontPath"`
+	ImagePath         string                `yaml:"ImagePath"`
+	SelfImagePath     string                `yaml:"SelfImagePath"`
+	ImageSettingsPath string                `yaml:"ImageSettingsPath"`
+	LogFilePath       string                `yaml:"LogFilePath"`
+	MaxQueueLimit     int                   `yaml:"MaxQueueLimit"` // Highest maxqueue a server can set
+	OwnerIDs          []string              `yaml:"OwnerIDs"`
+	PhraseNoRepeat    bool                  `yaml:"PhraseNoRepeat"` // Don't use a phrase twice in a row in a channel
+	PhrasesPath       string                `yaml:"PhrasesPath"`    // Folder of <category>.json phrase lists
+	RateLimits        map[string]*RateLimit `yaml:"RateLimits"`
+	SettingsDurationS int                   `yaml:"SettingsDurationS"`
+	VoicePresetsPath  string                `yaml:"VoicePresetsPath"`
+}
+
+// Most uses of a command allowed within a window of time, 0 for no limit
+type RateLimit struct {
+	PerUser  int `yaml:"PerUser"`
+	PerGuild int `yaml:"PerGuild"`
+	WindowS  int `yaml:"WindowS"`
 }
 
 type ImageSetting struct {
@@ -51,103 +74,275 @@ type VoicePreset struct {
 	Gender   string  `json:"gender"`
 }
 
+// Config fields that are only used at startup
+var restartFields = []string{"DatabasePath", "DiscordTokenPath", "LogFilePath"}
+
+// Guards swapping in the reloaded config, phrases, presets and image settings
+var mu sync.RWMutex
+
+// The config file and everything loaded from the files it points to
+type loaded struct {
+	cfg           *Config
+	phrases       map[string][]*Phrase
+	voicePresets  map[string]*VoicePreset
+	imageSettings map[string]*ImageSetting
+	warnings      []string // Problems that only stop some commands working
+}
+
+/*
+Get the config in use. Reloading swaps in a new Config rather than changing this one, so it
+can be kept and read for as long as needed, though it won't see later reloads
+*/
+func Get() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return cfg
+}
+
 func LoadConfig() error {
-	file, err := os.OpenFile(os.Getenv("CONFIG"), os.O_RDONLY, 0444)
+	l, err := load()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	decoder := yaml.NewDecoder(file)
+	l.logWarnings()
+	mu.Lock()
+	l.apply()
+	mu.Unlock()
+	return nil
+}
 
-	if err = decoder.Decode(Cfg); err != nil {
-		return err
-	} else if DiscordToken, err = ReadDiscordToken(); err != nil {
-		return err
-	} else if err = loadVoicePresets(); err != nil {
-		return err
-	} else if err = loadImageSettings(); err != nil {
-		return err
-	} else if err = loadPhrases(); err != nil {
-		return err
-	} else {
-		return nil
+/*
+Load the config and data files again and swap them in, but only if all of them load and
+are valid. Returns a description of each change made
+*/
+func Reload() ([]string, error) {
+	l, err := load()
+	if err != nil {
+		return nil, err
 	}
+	l.logWarnings()
+	mu.Lock()
+	defer mu.Unlock()
+	changes := l.changes()
+	l.apply()
+	return changes, nil
 }
 
-func loadVoicePresets() error {
-	data, err := ioutil.ReadFile(Cfg.VoicePresetsPath)
-	if err != nil {
-		return err
+/*
+Load the config file, if CONFIG is set, and override it with any BLUEBOT_* environment
+variables. Then check it and load the files it points to, returning every problem found
+as a ValidationError
+*/
+func load() (*loaded, error) {
+	l := &loaded{cfg: &Config{}}
+	if path := os.Getenv("CONFIG"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if err = yaml.NewDecoder(file).Decode(l.cfg); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
 	}
-	err = json.Unmarshal(data, &VoicePresets)
-	if err != nil {
-		return err
+
+	c := &checker{}
+	applyEnv(l.cfg, c)
+	applyDefaults(l.cfg)
+	// Phrases used to always be next to the audio folder
+	if l.cfg.PhrasesPath == "" && l.cfg.AudioPath != "" {
+		l.cfg.PhrasesPath = filepath.Join(l.cfg.AudioPath, "..", "phrases")
 	}
-	return nil
+	loadable := checkConfig(l.cfg, c)
+
+	var err error
+	if loadable["VoicePresetsPath"] {
+		if l.voicePresets, err = loadVoicePresets(l.cfg); err != nil {
+			c.problem("VoicePresetsPath: %s", err)
+		}
+	}
+	if loadable["ImageSettingsPath"] {
+		if l.imageSettings, err = loadImageSettings(l.cfg); err != nil {
+			c.problem("ImageSettingsPath: %s", err)
+		}
+	}
+	if loadable["PhrasesPath"] {
+		if l.phrases, err = loadPhrases(l.cfg.PhrasesPath); err != nil {
+			c.problem("PhrasesPath: %s", err)
+		}
+	}
+	l.check(c)
+	l.warnings = c.warnings
+	return l, c.err()
 }
 
-func loadImageSettings() error {
-	data, err := ioutil.ReadFile(Cfg.ImageSettingsPath)
-	if err != nil {
-		return err
+func (l *loaded) logWarnings() {
+	for _, warning := range l.warnings {
+		log.Printf("Config warning: %s", warning)
 	}
-	err = json.Unmarshal(data, &ImageSettings)
-	if err != nil {
-		return err
+}
+
+/*
+Check the config, the files it points to and the Discord token without using them. Returns
+warnings for problems that only stop some commands working, and an error for anything else
+*/
+func Check() ([]string, error) {
+	l, err := load()
+	if l == nil {
+		return nil, err
 	}
-	return nil
+	if _, tokenErr := readToken(l.cfg.DiscordTokenPath); tokenErr != nil {
+		problem := "DiscordTokenPath: " + tokenErr.Error()
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			validationErr.Problems = append(validationErr.Problems, problem)
+		} else {
+			err = &ValidationError{[]string{problem}}
+		}
+	}
+	return l.warnings, err
 }
 
-func loadPhrases() error {
-	var err error
-	categories := []string{
-		"say", "wrongcommand", "taxes", "first_greet", "normal_greet", "busy_greet",
+func (l *loaded) apply() {
+	cfg = l.cfg
+	Phrases = l.phrases
+	VoicePresets = l.voicePresets
+	ImageSettings = l.imageSettings
+}
+
+// Describe how the loaded files differ from the ones in use
+func (l *loaded) changes() []string {
+	changes := []string{}
+	cfgType := reflect.TypeOf(*l.cfg)
+	oldCfg, newCfg := reflect.ValueOf(*cfg), reflect.ValueOf(*l.cfg)
+	for i := 0; i < cfgType.NumField(); i++ {
+		if reflect.DeepEqual(oldCfg.Field(i).Interface(), newCfg.Field(i).Interface()) {
+			continue
+		}
+		name := cfgType.Field(i).Name
+		if slices.Contains(restartFields, name) {
+			changes = append(changes, fmt.Sprintf("Config %s changed, takes effect after a restart", name))
+		} else {
+			changes = append(changes, fmt.Sprintf("Config %s changed", name))
+		}
 	}
+	changes = append(changes, diffKeys("voice preset", VoicePresets, l.voicePresets)...)
+	changes = append(changes, diffKeys("image command", ImageSettings, l.imageSettings)...)
+	categories := maps.Keys(Phrases)
+	for category := range l.phrases {
+		if _, ok := Phrases[category]; !ok {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
 	for _, category := range categories {
-		Phrases[category], err = loadPhraseList(category)
-		if err != nil {
-			return err
+		before, after := Phrases[category], l.phrases[category]
+		if len(before) != len(after) {
+			changes = append(changes, fmt.Sprintf("Phrases for %s: %d -> %d", category, len(before), len(after)))
+		} else if !samePhrases(before, after) {
+			changes = append(changes, fmt.Sprintf("Phrases for %s changed", category))
 		}
 	}
-	return nil
+	return changes
 }
 
-func loadPhraseList(filename string) ([]string, error) {
-	var phrases map[string][]string
-	file, err := ioutil.ReadFile(Cfg.AudioPath + "/../phrases/" + filename + ".json")
+// Describe the entries added, removed and changed between two maps
+func diffKeys[V any](kind string, before, after map[string]V) []string {
+	changes := []string{}
+	names := maps.Keys(before)
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldValue, existed := before[name]
+		newValue, exists := after[name]
+		switch {
+		case !existed:
+			changes = append(changes, fmt.Sprintf("Added %s %s", kind, name))
+		case !exists:
+			changes = append(changes, fmt.Sprintf("Removed %s %s", kind, name))
+		case !reflect.DeepEqual(oldValue, newValue):
+			changes = append(changes, fmt.Sprintf("Changed %s %s", kind, name))
+		}
+	}
+	return changes
+}
+
+func loadVoicePresets(cfg *Config) (map[string]*VoicePreset, error) {
+	data, err := ioutil.ReadFile(cfg.VoicePresetsPath)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(file, &phrases)
+	presets := make(map[string]*VoicePreset)
+	err = json.Unmarshal(data, &presets)
 	if err != nil {
 		return nil, err
 	}
-	return phrases["data"], nil
+	return presets, nil
 }
 
-// Get a random phrase from a chosen phrase list category
-func GetPhrase(category string) string {
-	list, ok := Phrases[category]
-	if !ok {
-		return "Hello!"
+func loadImageSettings(cfg *Config) (map[string]*ImageSetting, error) {
+	data, err := ioutil.ReadFile(cfg.ImageSettingsPath)
+	if err != nil {
+		return nil, err
 	}
-	max := big.NewInt(int64(len(list)))
-	sel, _ := rand.Int(rand.Reader, max)
-	return list[sel.Int64()]
+	settings := make(map[string]*ImageSetting)
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// Get a voice preset by name
+func GetVoicePreset(name string) (*VoicePreset, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	preset, ok := VoicePresets[name]
+	return preset, ok
+}
+
+// Names of all voice presets, sorted
+func VoicePresetNames() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := maps.Keys(VoicePresets)
+	sort.Strings(names)
+	return names
+}
+
+// Copy of the image settings, by command name
+func GetImageSettings() map[string]*ImageSetting {
+	mu.RLock()
+	defer mu.RUnlock()
+	return maps.Clone(ImageSettings)
 }
 
 // Read the token as a string from file
 func ReadDiscordToken() (string, error) {
-	token, err := ioutil.ReadFile(Cfg.DiscordTokenPath)
+	return readToken(Get().DiscordTokenPath)
+}
+
+func readToken(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("not set")
+	}
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(string(token)), err
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
 }
 
 func SetupLogging() error {
-	file, err := os.OpenFile(Cfg.LogFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	file, err := os.OpenFile(Get().LogFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return err
 	}
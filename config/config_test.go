@@ -0,0 +1,160 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+/*
+Write a valid config file with any extra fields, along with the files it points to plus any
+extra files, and point CONFIG at it
+*/
+func writeConfig(t *testing.T, dir, extra string, files map[string]string) {
+	t.Helper()
+	for _, folder := range []string{"audio", "images", "self_images", "phrases"} {
+		if err := os.MkdirAll(filepath.Join(dir, folder), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all := map[string]string{
+		"civ_list.csv":       "",
+		"images.json":        "{}",
+		"voice_presets.json": `{"default": {"name": "en-GB-Standard-A", "language": "en-GB"}}`,
+	}
+	for name, data := range files {
+		all[name] = data
+	}
+	for name, data := range all {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := "AudioPath: " + dir + "/audio\n" +
+		"CivListPath: " + dir + "/civ_list.csv\n" +
+		"DatabasePath: " + dir + "/bluebot.db\n" +
+		"ImagePath: " + dir + "/images\n" +
+		"ImageSettingsPath: " + dir + "/images.json\n" +
+		"LogFilePath: " + dir + "/bluebot.log\n" +
+		"PhrasesPath: " + dir + "/phrases\n" +
+		"SelfImagePath: " + dir + "/self_images\n" +
+		"VoicePresetsPath: " + dir + "/voice_presets.json\n" + extra
+	path := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG", path)
+}
+
+// Put the config and data files back as they were after the test
+func restoreLoaded(t *testing.T) {
+	t.Helper()
+	mu.RLock()
+	oldCfg, oldPhrases, oldPresets, oldImages := cfg, Phrases, VoicePresets, ImageSettings
+	mu.RUnlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		cfg, Phrases, VoicePresets, ImageSettings = oldCfg, oldPhrases, oldPresets, oldImages
+		mu.Unlock()
+	})
+}
+
+func TestReloadReportsChanges(t *testing.T) {
+	restoreLoaded(t)
+	dir := t.TempDir()
+	writeConfig(t, dir, "CivSelections: 3\n", nil)
+	if err := LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := Get()
+
+	writeConfig(t, dir, "CivSelections: 4\nDiscordTokenPath: "+dir+"/token.txt\n", map[string]string{
+		"voice_presets.json": `{
+			"default": {"name": "en-GB-Standard-A", "language": "en-GB"},
+			"fast": {"name": "en-GB-Standard-B", "language": "en-GB", "rate": 2}
+		}`,
+		"phrases/say.json": `{"data": ["hi"]}`,
+	})
+	changes, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Config CivSelections changed",
+		"Config DiscordTokenPath changed, takes effect after a restart",
+		"Added voice preset fast",
+		"Phrases for say: 0 -> 1",
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got changes %q, want %q", changes, want)
+	}
+	if Get().CivSelections != 4 || GetPhrases("say")[0].String() != "hi" {
+		t.Errorf("expected the reloaded config and phrases to be used, got %+v", Get())
+	}
+	// The old config is replaced, not changed
+	if loaded.CivSelections != 3 {
+		t.Error("reload changed the config it replaced")
+	}
+
+	changes, err = Reload()
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes reloading the same files, got %q, %v", changes, err)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	restoreLoaded(t)
+	dir := t.TempDir()
+	writeConfig(t, dir, "CivSelections: 3\n", nil)
+	if err := LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := Get()
+
+	writeConfig(t, dir, "CivSelections: -1\n", map[string]string{"phrases/say.json": `{"data": ["hi"]}`})
+	if _, err := Reload(); err == nil {
+		t.Fatal("expected the invalid config to fail")
+	}
+	if Get() != loaded || len(GetPhrases("say")) != 0 {
+		t.Error("failed reload changed the config or phrases in use")
+	}
+}
+
+func TestReloadWhileReading(t *testing.T) {
+	restoreLoaded(t)
+	dir := t.TempDir()
+	writeConfig(t, dir, "", nil)
+	if err := LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if cfg := Get(); cfg.CivSelections < 1 || cfg.AudioPath == "" {
+					t.Errorf("read a partly loaded config %+v", cfg)
+					return
+				}
+				GetPhrase("say", "channel", &PhraseData{})
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := Reload(); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,405 @@
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Categories the bot uses, any others in the phrases folder are only used by %phrase
+var requiredPhraseCategories = []string{
+	"say", "wrongcommand", "taxes", "first_greet", "normal_greet", "busy_greet",
+}
+
+// Longest phrase that can be added, well under Discord's message limit
+const MaxPhraseLen = 500
+
+// Most text a phrase can fill in to, at Discord's message limit
+const maxRenderLen = 2000
+
+// PhraseTime methods phrases can call, e.g. {{.Time.Format "Monday"}}
+var phraseTimeMethods = []string{"Format", "Weekday", "Month", "Day", "Year", "Hour", "Minute"}
+
+var errRenderTooLong = fmt.Errorf("phrase is longer than %d characters when filled in", maxRenderLen)
+
+// Category names are file names, so they're kept simple
+var phraseCategoryRegex = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+/*
+A phrase template, picked at random with a chance proportional to its weight. In the JSON
+it's either just the text, or an object with the text and a weight
+*/
+type Phrase struct {
+	Text   string
+	Weight int
+	tmpl   *template.Template
+}
+
+/*
+Variables phrases can use, e.g. "Hi {{.User}}". MemberCount is the number of people in the
+voice channel for greetings and in the server otherwise
+*/
+type PhraseData struct {
+	User        string
+	Channel     string
+	MemberCount int
+	Time        PhraseTime
+}
+
+// Time shown as e.g. 15:04, but the time.Time methods can be used for other formats
+type PhraseTime struct {
+	time.Time
+}
+
+func (t PhraseTime) String() string {
+	return t.Format("15:04")
+}
+
+// The last phrase used in each category and channel, so it isn't picked twice in a row
+var (
+	lastPhrasesMu sync.Mutex
+	lastPhrases   = map[string]string{}
+)
+
+/*
+Parse a phrase's template, checking it only uses the variables in PhraseData and the time
+methods allowed. Anything else a template can do, like loops, is refused so a phrase can't
+take long to fill in. Older phrases used %s for the user's name, so it's treated as {{.User}}
+*/
+func ParsePhrase(text string, weight int) (*Phrase, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errors.New("phrase is empty")
+	}
+	if len(text) > MaxPhraseLen {
+		return nil, fmt.Errorf("phrase is longer than %d characters", MaxPhraseLen)
+	}
+	if weight < 1 {
+		return nil, errors.New("weight must be at least 1")
+	}
+	tmpl, err := template.New("phrase").Option("missingkey=error").Parse(strings.ReplaceAll(text, "%s", "{{.User}}"))
+	if err != nil {
+		return nil, err
+	}
+	if len(tmpl.Templates()) > 1 {
+		return nil, errors.New("phrases can't define templates")
+	}
+	for _, node := range tmpl.Tree.Root.Nodes {
+		if err = checkPhraseNode(node); err != nil {
+			return nil, err
+		}
+	}
+	if err = tmpl.Execute(io.Discard, &PhraseData{}); err != nil {
+		return nil, err
+	}
+	return &Phrase{Text: text, Weight: weight, tmpl: tmpl}, nil
+}
+
+// Only allow text and single variables such as {{.User}} or {{.Time.Format "Monday"}}
+func checkPhraseNode(node parse.Node) error {
+	if _, ok := node.(*parse.TextNode); ok {
+		return nil
+	}
+	refused := fmt.Errorf("phrases can only use variables like {{.User}}, not %s", node)
+	action, ok := node.(*parse.ActionNode)
+	if !ok || len(action.Pipe.Decl) > 0 || len(action.Pipe.Cmds) != 1 {
+		return refused
+	}
+	args := action.Pipe.Cmds[0].Args
+	field, ok := args[0].(*parse.FieldNode)
+	if !ok {
+		return refused
+	}
+	if _, ok = reflect.TypeOf(PhraseData{}).FieldByName(field.Ident[0]); !ok {
+		return refused
+	}
+	switch {
+	case len(field.Ident) == 1 && len(args) == 1:
+		return nil
+	case len(field.Ident) == 2 && field.Ident[0] == "Time" && slices.Contains(phraseTimeMethods, field.Ident[1]):
+		for _, arg := range args[1:] {
+			if _, ok := arg.(*parse.StringNode); !ok {
+				return refused
+			}
+		}
+		return nil
+	}
+	return refused
+}
+
+func (p *Phrase) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		parsed, err := ParsePhrase(text, 1)
+		if err != nil {
+			return err
+		}
+		*p = *parsed
+		return nil
+	}
+	weighted := struct {
+		Text   string `json:"text"`
+		Weight *int   `json:"weight"`
+	}{}
+	if err := json.Unmarshal(data, &weighted); err != nil {
+		return errors.New("phrases must be text or an object with text and weight")
+	}
+	weight := 1
+	if weighted.Weight != nil {
+		weight = *weighted.Weight
+	}
+	parsed, err := ParsePhrase(weighted.Text, weight)
+	if err != nil {
+		return err
+	}
+	*p = *parsed
+	return nil
+}
+
+// Phrases with the default weight are saved as just their text
+func (p *Phrase) MarshalJSON() ([]byte, error) {
+	if p.Weight == 1 {
+		return json.Marshal(p.Text)
+	}
+	return json.Marshal(map[string]interface{}{"text": p.Text, "weight": p.Weight})
+}
+
+/*
+Fill in the phrase's variables, falling back to its text if that fails or it would be longer
+than a message can be
+*/
+func (p *Phrase) Render(data *PhraseData) string {
+	out := &limitedWriter{limit: maxRenderLen}
+	if err := p.tmpl.Execute(out, data); err != nil {
+		log.Printf("Failed to fill in phrase %q: %s", p.Text, err)
+		return p.Text
+	}
+	return out.String()
+}
+
+// Buffer that refuses writes past its limit
+type limitedWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errRenderTooLong
+	}
+	return w.buf.Write(p)
+}
+
+func (w *limitedWriter) String() string {
+	return w.buf.String()
+}
+
+func (p *Phrase) String() string {
+	if p.Weight == 1 {
+		return p.Text
+	}
+	return fmt.Sprintf("%s (weight %d)", p.Text, p.Weight)
+}
+
+func samePhrases(a, b []*Phrase) bool {
+	return slices.EqualFunc(a, b, func(x, y *Phrase) bool {
+		return x.Text == y.Text && x.Weight == y.Weight
+	})
+}
+
+/*
+Load every <category>.json file in the phrases folder. Each file is an object with the
+phrases in a "data" list
+*/
+func loadPhrases(dir string) (map[string][]*Phrase, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	phrases := make(map[string][]*Phrase, len(paths))
+	for _, path := range paths {
+		category := strings.TrimSuffix(filepath.Base(path), ".json")
+		if !phraseCategoryRegex.MatchString(category) {
+			continue
+		}
+		list, err := loadPhraseList(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		phrases[category] = list
+	}
+	return phrases, nil
+}
+
+func loadPhraseList(path string) ([]*Phrase, error) {
+	var phrases map[string][]json.RawMessage
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(file, &phrases)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Phrase, len(phrases["data"]))
+	for i, data := range phrases["data"] {
+		list[i] = &Phrase{}
+		if err = json.Unmarshal(data, list[i]); err != nil {
+			return nil, fmt.Errorf("phrase %d: %w", i+1, err)
+		}
+	}
+	return list, nil
+}
+
+// Write a category's phrases to a temporary file then move it into place
+func savePhraseList(dir, category string, list []*Phrase) error {
+	data, err := json.MarshalIndent(map[string][]*Phrase{"data": list}, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, category+".json.tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, category+".json"))
+}
+
+/*
+Get a random phrase from a chosen phrase list category with its variables filled in. With
+PhraseNoRepeat set, the phrase last used in the channel isn't picked again straight away
+*/
+func GetPhrase(category, channelID string, data *PhraseData) string {
+	mu.RLock()
+	list := Phrases[category]
+	noRepeat := cfg.PhraseNoRepeat
+	mu.RUnlock()
+	if len(list) == 0 {
+		return "Hello!"
+	}
+
+	key := category + "/" + channelID
+	lastPhrasesMu.Lock()
+	defer lastPhrasesMu.Unlock()
+	if noRepeat && len(list) > 1 {
+		choices := make([]*Phrase, 0, len(list))
+		for _, phrase := range list {
+			if phrase.Text != lastPhrases[key] {
+				choices = append(choices, phrase)
+			}
+		}
+		if len(choices) > 0 {
+			list = choices
+		}
+	}
+	phrase := pickPhrase(list)
+	lastPhrases[key] = phrase.Text
+	return phrase.Render(data)
+}
+
+// Pick a phrase with a chance proportional to its weight
+func pickPhrase(list []*Phrase) *Phrase {
+	total := 0
+	for _, phrase := range list {
+		total += phrase.Weight
+	}
+	sel, _ := rand.Int(rand.Reader, big.NewInt(int64(total)))
+	n := int(sel.Int64())
+	for _, phrase := range list {
+		if n < phrase.Weight {
+			return phrase
+		}
+		n -= phrase.Weight
+	}
+	return list[len(list)-1]
+}
+
+// Names of the categories in the phrases folder and the ones the bot uses, sorted
+func PhraseCategories() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	categories := maps.Keys(Phrases)
+	for _, category := range requiredPhraseCategories {
+		if !slices.Contains(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// Copy of the phrases in a category, in the order they're stored
+func GetPhrases(category string) []*Phrase {
+	mu.RLock()
+	defer mu.RUnlock()
+	return slices.Clone(Phrases[category])
+}
+
+/*
+Add a phrase to the end of a category and save it, creating the category if needed. Returns
+the new phrase's number
+*/
+func AddPhrase(category string, phrase *Phrase) (int, error) {
+	if !phraseCategoryRegex.MatchString(category) {
+		return 0, fmt.Errorf("invalid phrase category %q", category)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	list := append(slices.Clone(Phrases[category]), phrase)
+	return len(list), setPhrases(category, list)
+}
+
+/*
+Remove a phrase from a category by its position, starting at 1 as listed by %phrase list,
+and save it. Returns the phrase removed
+*/
+func RemovePhrase(category string, number int) (*Phrase, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	list := Phrases[category]
+	if number < 1 || number > len(list) {
+		return nil, fmt.Errorf("no phrase %d in %s, there are %d", number, category, len(list))
+	}
+	removed := list[number-1]
+	list = slices.Delete(slices.Clone(list), number-1, number)
+	return removed, setPhrases(category, list)
+}
+
+// Save a category's new phrases then swap them in. Must hold mu
+func setPhrases(category string, list []*Phrase) error {
+	if err := savePhraseList(cfg.PhrasesPath, category, list); err != nil {
+		return err
+	}
+	phrases := maps.Clone(Phrases)
+	if phrases == nil {
+		phrases = map[string][]*Phrase{}
+	}
+	phrases[category] = list
+	Phrases = phrases
+	return nil
+}
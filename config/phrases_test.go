@@ -0,0 +1,208 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Use a temporary phrases folder, restoring the current phrases after the test
+func setupPhrases(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldCfg, oldPhrases := cfg, Phrases
+	t.Cleanup(func() { cfg, Phrases = oldCfg, oldPhrases })
+	cfg = &Config{PhrasesPath: dir}
+	phrases, err := loadPhrases(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Phrases = phrases
+	return dir
+}
+
+func phraseTexts(phrases []*Phrase) []string {
+	texts := make([]string, len(phrases))
+	for i, phrase := range phrases {
+		texts[i] = phrase.String()
+	}
+	return texts
+}
+
+func mustParsePhrase(t *testing.T, text string, weight int) *Phrase {
+	t.Helper()
+	phrase, err := ParsePhrase(text, weight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return phrase
+}
+
+func TestLoadPhrasesDiscoversCategories(t *testing.T) {
+	setupPhrases(t, map[string]string{
+		"say.json":   `{"data": ["hi", "hey"]}`,
+		"jokes.json": `{"data": ["knock knock", {"text": "why did the", "weight": 3}]}`,
+		"notes.txt":  "not phrases",
+	})
+	if got := phraseTexts(GetPhrases("jokes")); !reflect.DeepEqual(got, []string{"knock knock", "why did the (weight 3)"}) {
+		t.Errorf("unexpected jokes: %q", got)
+	}
+	categories := PhraseCategories()
+	want := []string{"busy_greet", "first_greet", "jokes", "normal_greet", "say", "taxes", "wrongcommand"}
+	if !reflect.DeepEqual(categories, want) {
+		t.Errorf("got categories %q, want %q", categories, want)
+	}
+	if phrase := GetPhrase("taxes", "channel", &PhraseData{}); phrase != "Hello!" {
+		t.Errorf("expected the fallback for a missing category, got %q", phrase)
+	}
+}
+
+func TestLoadPhrasesRejectsInvalid(t *testing.T) {
+	files := map[string]string{
+		"template.json": `{"data": ["fine", "{{.User"]}`,
+		"variable.json": `{"data": ["{{.Nobody}}"]}`,
+		"weight.json":   `{"data": [{"text": "hi", "weight": 0}]}`,
+	}
+	for name, data := range files {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPhrases(dir); err == nil {
+			t.Errorf("expected an error loading %s", data)
+		}
+	}
+}
+
+func TestPhraseTemplate(t *testing.T) {
+	data := &PhraseData{
+		User:        "alice",
+		Channel:     "general",
+		MemberCount: 4,
+		Time:        PhraseTime{time.Date(2023, 1, 2, 15, 4, 0, 0, time.UTC)},
+	}
+	phrases := map[string]string{
+		"{{.User}} joined {{.Channel}} with {{.MemberCount}} others at {{.Time}}": "alice joined general with 4 others at 15:04",
+		"Hi %s":                            "Hi alice",
+		"It's {{.Time.Format \"Monday\"}}": "It's Monday",
+	}
+	for text, want := range phrases {
+		if got := mustParsePhrase(t, text, 1).Render(data); got != want {
+			t.Errorf("%q rendered as %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestPhraseTemplateRestricted(t *testing.T) {
+	for _, text := range []string{
+		`{{range .User}}x{{end}}`,
+		`{{if .User}}x{{end}}`,
+		`{{with .User}}x{{end}}`,
+		`{{define "x"}}x{{end}}hi`,
+		`{{block "x" .}}x{{end}}`,
+		`{{template "phrase" .}}`,
+		`{{$x := .User}}`,
+		`{{.User | printf "%s"}}`,
+		`{{printf "%0999999d" 1}}`,
+		`{{.Time.AddDate 1 0 0}}`,
+		`{{.Time.Format .User}}`,
+		`{{.}}`,
+	} {
+		if _, err := ParsePhrase(text, 1); err == nil {
+			t.Errorf("expected %q to be refused", text)
+		}
+	}
+	for _, text := range []string{`{{.Time.Weekday}} at {{.Time.Hour}}`, `{{.MemberCount}} here`} {
+		if _, err := ParsePhrase(text, 1); err != nil {
+			t.Errorf("expected %q to be allowed: %s", text, err)
+		}
+	}
+}
+
+func TestPhraseRenderLimit(t *testing.T) {
+	text := `{{.User}}`
+	phrase := mustParsePhrase(t, text, 1)
+	if got := phrase.Render(&PhraseData{User: strings.Repeat("a", maxRenderLen+1)}); got != text {
+		t.Errorf("expected the phrase's own text when too long, got %d characters", len(got))
+	}
+	if got := phrase.Render(&PhraseData{User: strings.Repeat("a", maxRenderLen)}); len(got) != maxRenderLen {
+		t.Errorf("expected a phrase at the limit to be filled in, got %d characters", len(got))
+	}
+}
+
+func TestGetPhraseWeights(t *testing.T) {
+	setupPhrases(t, map[string]string{
+		"say.json": `{"data": [{"text": "common", "weight": 99}, "rare"]}`,
+	})
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[GetPhrase("say", "channel", &PhraseData{})]++
+	}
+	if counts["common"] < 900 || counts["rare"] == 0 {
+		t.Errorf("phrases not picked by weight: %v", counts)
+	}
+}
+
+func TestGetPhraseNoRepeat(t *testing.T) {
+	setupPhrases(t, map[string]string{"say.json": `{"data": ["a", "b", "c"]}`})
+	cfg.PhraseNoRepeat = true
+
+	last := GetPhrase("say", "channel", &PhraseData{})
+	other := GetPhrase("say", "other", &PhraseData{})
+	for i := 0; i < 100; i++ {
+		phrase := GetPhrase("say", "channel", &PhraseData{})
+		if phrase == last {
+			t.Fatalf("%q picked twice in a row", phrase)
+		}
+		last = phrase
+	}
+	if other == "" {
+		t.Error("expected a phrase for the other channel")
+	}
+}
+
+func TestAddAndRemovePhrasePersist(t *testing.T) {
+	dir := setupPhrases(t, map[string]string{"say.json": `{"data": ["hi"]}`})
+
+	if n, err := AddPhrase("say", mustParsePhrase(t, "  hello {{.User}} ", 1)); err != nil || n != 2 {
+		t.Fatalf("AddPhrase = %d, %v", n, err)
+	}
+	if _, err := AddPhrase("taxes", mustParsePhrase(t, "pay up", 2)); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := RemovePhrase("say", 1)
+	if err != nil || removed.Text != "hi" {
+		t.Fatalf("RemovePhrase = %v, %v", removed, err)
+	}
+	if _, err = RemovePhrase("say", 5); err == nil {
+		t.Error("expected an error removing a phrase that doesn't exist")
+	}
+	if _, err = AddPhrase("../say", mustParsePhrase(t, "escape", 1)); err == nil {
+		t.Error("expected an error for an invalid category")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "taxes.json"))
+	if err != nil || !strings.Contains(string(data), `"weight": 2`) {
+		t.Errorf("expected the weight to be saved: %s %v", data, err)
+	}
+	saved, err := loadPhrases(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for category, want := range map[string][]string{"say": {"hello {{.User}}"}, "taxes": {"pay up (weight 2)"}} {
+		if got := phraseTexts(saved[category]); !reflect.DeepEqual(got, want) {
+			t.Errorf("saved %s %q, want %q", category, got, want)
+		}
+		if got := phraseTexts(Phrases[category]); !reflect.DeepEqual(got, want) {
+			t.Errorf("in use %s %q, want %q", category, got, want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/exp/maps"
+	"gopkg.in/yaml.v3"
+)
+
+// Voice preset that must exist, used when a guild hasn't picked one
+const DefaultVoicePreset = "default"
+
+// Prefix of environment variables that override config fields
+const envPrefix = "BLUEBOT_"
+
+// Used for fields left unset in config
+var defaults = Config{
+	CivSelections:     3,
+	CommandTimeoutS:   30,
+	MaxQueueLimit:     500,
+	SettingsDurationS: 300,
+}
+
+// Every problem found with the config, so they can all be fixed in one go
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config:\n  %s", strings.Join(e.Problems, "\n  "))
+}
+
+// Collects problems and warnings while checking config
+type checker struct {
+	problems []string
+	warnings []string
+}
+
+func (c *checker) problem(format string, a ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, a...))
+}
+
+func (c *checker) warn(format string, a ...interface{}) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, a...))
+}
+
+func (c *checker) err() error {
+	if len(c.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{c.problems}
+}
+
+// Check a path is set and exists, and is a directory or not as expected
+func (c *checker) path(field, path string, dir bool) bool {
+	if path == "" {
+		c.problem("%s is not set", field)
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		c.problem("%s: %s does not exist", field, path)
+	} else if dir && !info.IsDir() {
+		c.problem("%s: %s is not a folder", field, path)
+	} else if !dir && info.IsDir() {
+		c.problem("%s: %s is a folder, expected a file", field, path)
+	} else {
+		return true
+	}
+	return false
+}
+
+// Warn about an optional file that's unset or missing
+func (c *checker) optional(field, path, consequence string) {
+	if path == "" {
+		c.warn("%s is not set, %s", field, consequence)
+	} else if _, err := os.Stat(path); err != nil {
+		c.warn("%s: %s does not exist, %s", field, path, consequence)
+	}
+}
+
+// Check a file can be created at a path, i.e. its folder exists
+func (c *checker) creatable(field, path string) {
+	if path == "" {
+		c.problem("%s is not set", field)
+		return
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		c.problem("%s: folder %s does not exist", field, filepath.Dir(path))
+	}
+}
+
+/*
+Name of the environment variable overriding a config field, e.g. CivListPath is set with
+BLUEBOT_CIV_LIST_PATH
+*/
+func EnvName(field string) string {
+	name := []rune{}
+	runes := []rune(field)
+	for i, r := range runes {
+		// Words start at an upper case letter after a lower case one, so OwnerIDs is OWNER_IDS
+		if i > 0 && unicode.IsUpper(r) && unicode.IsLower(runes[i-1]) {
+			name = append(name, '_')
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return envPrefix + string(name)
+}
+
+/*
+Override config fields from BLUEBOT_* environment variables. Strings are used as they are and
+anything else is parsed as YAML, e.g. BLUEBOT_OWNER_IDS="[123, 456]"
+*/
+func applyEnv(cfg *Config, c *checker) {
+	value := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		env := EnvName(field.Name)
+		raw, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if field.Type.Kind() == reflect.String {
+			value.Field(i).SetString(raw)
+			continue
+		}
+		parsed := reflect.New(field.Type)
+		if err := yaml.Unmarshal([]byte(raw), parsed.Interface()); err != nil {
+			c.problem("%s: can't be read as %s: %s", env, field.Type, strings.ReplaceAll(err.Error(), "\n", " "))
+			continue
+		}
+		value.Field(i).Set(parsed.Elem())
+	}
+}
+
+// Fill in unset fields that have defaults
+func applyDefaults(cfg *Config) {
+	value := reflect.ValueOf(cfg).Elem()
+	defaultValue := reflect.ValueOf(defaults)
+	for i := 0; i < value.NumField(); i++ {
+		if value.Field(i).IsZero() {
+			value.Field(i).Set(defaultValue.Field(i))
+		}
+	}
+}
+
+/*
+Check the config fields, before the files they point to are loaded. Returns the files that
+can be loaded
+*/
+func checkConfig(cfg *Config, c *checker) (loadable map[string]bool) {
+	loadable = map[string]bool{
+		"AudioPath":         c.path("AudioPath", cfg.AudioPath, true),
+		"ImagePath":         c.path("ImagePath", cfg.ImagePath, true),
+		"ImageSettingsPath": c.path("ImageSettingsPath", cfg.ImageSettingsPath, false),
+		"PhrasesPath":       c.path("PhrasesPath", cfg.PhrasesPath, true),
+		"VoicePresetsPath":  c.path("VoicePresetsPath", cfg.VoicePresetsPath, false),
+	}
+	c.path("CivListPath", cfg.CivListPath, false)
+	c.path("SelfImagePath", cfg.SelfImagePath, true)
+	c.creatable("DatabasePath", cfg.DatabasePath)
+	c.creatable("LogFilePath", cfg.LogFilePath)
+	c.optional("GoogleKeyPath", cfg.GoogleKeyPath, "YouTube and Text-to-Speech won't work")
+	c.optional("ImageFontPath", cfg.ImageFontPath, "image commands won't work")
+
+	if cfg.CivSelections < 1 {
+		c.problem("CivSelections must be at least 1")
+	}
+	if cfg.CommandTimeoutS < 0 {
+		c.problem("CommandTimeoutS can't be negative")
+	}
+	for _, name := range sortedKeys(cfg.CommandTimeouts) {
+		if cfg.CommandTimeouts[name] < 1 {
+			c.problem("CommandTimeouts: %s must be at least 1 second", name)
+		}
+	}
+	if cfg.MaxQueueLimit < 1 {
+		c.problem("MaxQueueLimit must be at least 1")
+	}
+	if cfg.SettingsDurationS < 1 {
+		c.problem("SettingsDurationS must be at least 1")
+	}
+	for _, name := range sortedKeys(cfg.RateLimits) {
+		limit := cfg.RateLimits[name]
+		if limit == nil {
+			c.problem("RateLimits: %s has no limits set", name)
+		} else if limit.PerUser < 0 || limit.PerGuild < 0 {
+			c.problem("RateLimits: %s limits can't be negative", name)
+		} else if limit.WindowS < 1 && (limit.PerUser > 0 || limit.PerGuild > 0) {
+			c.problem("RateLimits: %s needs a WindowS of at least 1", name)
+		}
+	}
+	return loadable
+}
+
+// Check the files loaded from the config are usable
+func (l *loaded) check(c *checker) {
+	if l.voicePresets != nil {
+		if _, ok := l.voicePresets[DefaultVoicePreset]; !ok {
+			c.problem("VoicePresetsPath: no %s voice preset", DefaultVoicePreset)
+		}
+		for _, name := range sortedKeys(l.voicePresets) {
+			if preset := l.voicePresets[name]; preset.Name == "" || preset.Language == "" {
+				c.problem("VoicePresetsPath: %s needs a name and language", name)
+			}
+		}
+	}
+	for _, name := range sortedKeys(l.imageSettings) {
+		setting := l.imageSettings[name]
+		if l.cfg.ImagePath == "" {
+			break
+		}
+		if _, err := os.Stat(filepath.Join(l.cfg.ImagePath, setting.Filename)); err != nil {
+			c.problem("ImageSettingsPath: image %s for %s does not exist", setting.Filename, name)
+		}
+	}
+	if l.phrases != nil {
+		for _, category := range requiredPhraseCategories {
+			if len(l.phrases[category]) == 0 {
+				c.warn("PhrasesPath: no phrases for %s, Hello! is used instead", category)
+			}
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := maps.Keys(m)
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	names := map[string]string{
+		"AudioPath":         "BLUEBOT_AUDIO_PATH",
+		"CommandTimeoutS":   "BLUEBOT_COMMAND_TIMEOUT_S",
+		"OwnerIDs":          "BLUEBOT_OWNER_IDS",
+		"SettingsDurationS": "BLUEBOT_SETTINGS_DURATION_S",
+	}
+	for field, want := range names {
+		if got := EnvName(field); got != want {
+			t.Errorf("EnvName(%s) = %s, want %s", field, got, want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("BLUEBOT_AUDIO_PATH", "/audio: path")
+	t.Setenv("BLUEBOT_CIV_SELECTIONS", "5")
+	t.Setenv("BLUEBOT_ERROR_EMBEDS", "true")
+	t.Setenv("BLUEBOT_OWNER_IDS", "[123, 456]")
+	t.Setenv("BLUEBOT_RATE_LIMITS", "{tell: {PerUser: 1, WindowS: 10}}")
+	t.Setenv("BLUEBOT_SETTINGS_DURATION_S", "soon")
+
+	cfg := &Config{CivSelections: 1}
+	c := &checker{}
+	applyEnv(cfg, c)
+
+	want := &Config{
+		AudioPath:     "/audio: path",
+		CivSelections: 5,
+		ErrorEmbeds:   true,
+		OwnerIDs:      []string{"123", "456"},
+		RateLimits:    map[string]*RateLimit{"tell": {PerUser: 1, WindowS: 10}},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+	if len(c.problems) != 1 {
+		t.Errorf("expected a problem for the invalid duration, got %q", c.problems)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	cfg := &Config{CivSelections: 2}
+	applyDefaults(cfg)
+	if cfg.CivSelections != 2 || cfg.CommandTimeoutS != 30 || cfg.SettingsDurationS != 300 || cfg.MaxQueueLimit != 500 {
+		t.Errorf("unexpected defaults applied: %+v", cfg)
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	data := []byte("AudioPath: " + dir + "\nCivSelections: -1\nCivListPath: " + dir + "/missing.csv\n")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG", path)
+
+	_, err := load()
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	want := []string{
+		"CivListPath: " + dir + "/missing.csv does not exist",
+		"CivSelections must be at least 1",
+		"VoicePresetsPath is not set",
+	}
+	for _, problem := range want {
+		found := false
+		for _, got := range validationErr.Problems {
+			found = found || got == problem
+		}
+		if !found {
+			t.Errorf("missing problem %q in %q", problem, validationErr.Problems)
+		}
+	}
+}
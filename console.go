@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bluebot/command"
+	"bluebot/util"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"layeh.com/gopus"
+)
+
+// IDs used for the pretend guild, channels and user in console mode
+const (
+	consoleGuildID        = "console"
+	consoleChannelID      = "console"
+	consoleVoiceChannelID = "console-voice"
+	consoleUserID         = "console-user"
+	consoleBotID          = "console-bot"
+)
+
+// Voice output is decoded to 48kHz stereo
+const (
+	consoleSampleRate = 48000
+	consoleChannels   = 2
+	// Largest opus frame is 120ms
+	consoleMaxFrameSize = consoleSampleRate * 120 / 1000
+)
+
+var _ util.Session = (*ConsoleSession)(nil)
+
+/*
+Session that runs commands from the terminal instead of Discord. Replies are printed, files
+are saved to the output folder and voice is decoded to WAV files there. The console user is
+an admin and bot owner in a single guild and is always in its voice channel
+*/
+type ConsoleSession struct {
+	OutDir string
+	out    io.Writer
+	mu     sync.Mutex
+	nextID int
+}
+
+func NewConsoleSession(outDir string, out io.Writer) (*ConsoleSession, error) {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+	return &ConsoleSession{OutDir: outDir, out: out}, nil
+}
+
+/*
+Read lines from stdin and handle each as a message from the console user, the same as
+messages from Discord. Commands run concurrently so music can be controlled while playing
+*/
+func RunConsole(outDir string) error {
+	session, err := NewConsoleSession(outDir, os.Stdout)
+	if err != nil {
+		return err
+	}
+	command.ExtraOwnerIDs = append(command.ExtraOwnerIDs, consoleUserID)
+	fmt.Printf("bluebot console, output saved to %s. Type commands e.g. %%help\n", outDir)
+
+	var wg sync.WaitGroup
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		msg := &discordgo.MessageCreate{Message: &discordgo.Message{
+			ChannelID: consoleChannelID,
+			GuildID:   consoleGuildID,
+			Content:   scanner.Text(),
+			Author:    &discordgo.User{ID: consoleUserID, Username: "console"},
+		}}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			MessageHandler(session, msg)
+		}()
+	}
+	wg.Wait()
+	return scanner.Err()
+}
+
+func (s *ConsoleSession) print(format string, a ...interface{}) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	fmt.Fprintf(s.out, format+"\n", a...)
+	return fmt.Sprint(s.nextID)
+}
+
+// Save a sent file to the output folder with a unique name
+func (s *ConsoleSession) saveFile(name string, r io.Reader) (string, error) {
+	randHex, err := util.RandomHex(4)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.OutDir, randHex+"-"+filepath.Base(name))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, r)
+	return path, err
+}
+
+func (s *ConsoleSession) message(channelID, content string) *discordgo.Message {
+	id := s.print("bluebot> %s", content)
+	return &discordgo.Message{ID: id, ChannelID: channelID, Content: content}
+}
+
+func (s *ConsoleSession) embeds(channelID string, embeds []*discordgo.MessageEmbed) *discordgo.Message {
+	var message *discordgo.Message
+	for _, embed := range embeds {
+		message = s.message(channelID, fmt.Sprintf("[%s] %s", embed.Title, embed.Description))
+	}
+	return message
+}
+
+// Components can't be used in the console, so show the commands they run instead
+func (s *ConsoleSession) components(components []discordgo.MessageComponent) {
+	for _, component := range components {
+		row, ok := component.(discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, item := range row.Components {
+			switch item := item.(type) {
+			case discordgo.Button:
+				if !item.Disabled {
+					s.print("bluebot [%s]> %%%s", item.Label, item.CustomID)
+				}
+			case discordgo.SelectMenu:
+				for _, option := range item.Options {
+					s.print("bluebot [%s]> %%%s %s", option.Label, item.CustomID, option.Value)
+				}
+			}
+		}
+	}
+}
+
+func (s *ConsoleSession) files(channelID string, files []*discordgo.File) (*discordgo.Message, error) {
+	var message *discordgo.Message
+	for _, file := range files {
+		path, err := s.saveFile(file.Name, file.Reader)
+		if err != nil {
+			return nil, err
+		}
+		message = s.message(channelID, "[file saved to "+path+"]")
+	}
+	return message, nil
+}
+
+func (s *ConsoleSession) BotUserID() string {
+	return consoleBotID
+}
+
+func (s *ConsoleSession) StateGuild(guildID string) (*discordgo.Guild, error) {
+	return &discordgo.Guild{
+		ID:          guildID,
+		MemberCount: 1,
+		VoiceStates: []*discordgo.VoiceState{
+			{GuildID: guildID, UserID: consoleUserID, ChannelID: consoleVoiceChannelID},
+		},
+	}, nil
+}
+
+func (s *ConsoleSession) StateChannel(channelID string) (*discordgo.Channel, error) {
+	return &discordgo.Channel{ID: channelID, GuildID: consoleGuildID, Name: channelID}, nil
+}
+
+func (s *ConsoleSession) ChannelVoiceJoin(guildID, channelID string, mute, deaf bool) (util.VoiceConnection, error) {
+	randHex, err := util.RandomHex(4)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.OutDir, "voice-"+randHex+".wav")
+	vc, err := newConsoleVoice(path)
+	if err != nil {
+		return nil, err
+	}
+	s.print("bluebot joined voice, recording to %s", path)
+	return vc, nil
+}
+
+func (s *ConsoleSession) ChannelMessageSend(
+	channelID string, content string, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	return s.message(channelID, content), nil
+}
+
+func (s *ConsoleSession) ChannelMessageSendEmbed(
+	channelID string, embed *discordgo.MessageEmbed, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	return s.embeds(channelID, []*discordgo.MessageEmbed{embed}), nil
+}
+
+func (s *ConsoleSession) ChannelFileSend(
+	channelID, name string, r io.Reader, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	return s.files(channelID, []*discordgo.File{{Name: name, Reader: r}})
+}
+
+func (s *ConsoleSession) ChannelMessageSendComplex(
+	channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	message := s.message(channelID, data.Content)
+	if len(data.Embeds) > 0 {
+		message = s.embeds(channelID, data.Embeds)
+	}
+	s.components(data.Components)
+	if len(data.Files) > 0 {
+		return s.files(channelID, data.Files)
+	}
+	return message, nil
+}
+
+func (s *ConsoleSession) ChannelMessageEdit(
+	channelID, messageID, content string, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	s.print("bluebot (edited %s)> %s", messageID, content)
+	return &discordgo.Message{ID: messageID, ChannelID: channelID, Content: content}, nil
+}
+
+func (s *ConsoleSession) ChannelMessageEditComplex(
+	m *discordgo.MessageEdit, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	message := &discordgo.Message{ID: m.ID, ChannelID: m.Channel}
+	if m.Content != nil {
+		s.print("bluebot (edited %s)> %s", m.ID, *m.Content)
+		message.Content = *m.Content
+	}
+	s.components(m.Components)
+	return message, nil
+}
+
+func (s *ConsoleSession) ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error {
+	s.print("bluebot (deleted %s)", messageID)
+	return nil
+}
+
+func (s *ConsoleSession) InteractionRespond(
+	interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption,
+) error {
+	return nil
+}
+
+func (s *ConsoleSession) InteractionResponseEdit(
+	interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	var message *discordgo.Message
+	if newresp.Content != nil {
+		message = s.message(interaction.ChannelID, *newresp.Content)
+	}
+	if newresp.Embeds != nil {
+		message = s.embeds(interaction.ChannelID, *newresp.Embeds)
+	}
+	if len(newresp.Files) > 0 {
+		return s.files(interaction.ChannelID, newresp.Files)
+	}
+	return message, nil
+}
+
+func (s *ConsoleSession) InteractionResponseDelete(
+	interaction *discordgo.Interaction, options ...discordgo.RequestOption,
+) error {
+	return nil
+}
+
+func (s *ConsoleSession) FollowupMessageCreate(
+	interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams,
+	options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	message := s.message(interaction.ChannelID, data.Content)
+	if len(data.Embeds) > 0 {
+		message = s.embeds(interaction.ChannelID, data.Embeds)
+	}
+	if len(data.Files) > 0 {
+		return s.files(interaction.ChannelID, data.Files)
+	}
+	return message, nil
+}
+
+// The console user can use every command
+func (s *ConsoleSession) UserChannelPermissions(
+	userID, channelID string, options ...discordgo.RequestOption,
+) (int64, error) {
+	return discordgo.PermissionAdministrator, nil
+}
+
+func (s *ConsoleSession) GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error) {
+	return []*discordgo.Role{}, nil
+}
+
+func (s *ConsoleSession) GuildMember(
+	guildID, userID string, options ...discordgo.RequestOption,
+) (*discordgo.Member, error) {
+	return &discordgo.Member{GuildID: guildID, User: &discordgo.User{ID: userID, Username: "console"}}, nil
+}
+
+/*
+Voice connection that decodes the opus frames sent over it and writes them to a WAV file,
+which is finished off when disconnecting
+*/
+type consoleVoice struct {
+	file    *os.File
+	decoder *gopus.Decoder
+	opus    chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+	samples uint32
+}
+
+func newConsoleVoice(path string) (*consoleVoice, error) {
+	decoder, err := gopus.NewDecoder(consoleSampleRate, consoleChannels)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	vc := &consoleVoice{
+		file:    file,
+		decoder: decoder,
+		opus:    make(chan []byte),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	// Header is written again with the sizes once all the audio is in
+	if err = vc.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	go vc.record()
+	return vc, nil
+}
+
+func (v *consoleVoice) record() {
+	defer close(v.stopped)
+	for {
+		select {
+		case frame := <-v.opus:
+			pcm, err := v.decoder.Decode(frame, consoleMaxFrameSize, false)
+			if err != nil {
+				log.Printf("Failed to decode opus frame: %s", err)
+				continue
+			}
+			if err = binary.Write(v.file, binary.LittleEndian, pcm); err != nil {
+				log.Printf("Failed to write voice output: %s", err)
+				continue
+			}
+			v.samples += uint32(len(pcm))
+		case <-v.done:
+			return
+		}
+	}
+}
+
+func (v *consoleVoice) Speaking(speaking bool) error {
+	return nil
+}
+
+func (v *consoleVoice) Disconnect() error {
+	var err error
+	v.once.Do(func() {
+		close(v.done)
+		<-v.stopped
+		if _, err = v.file.Seek(0, io.SeekStart); err != nil {
+			v.file.Close()
+			return
+		}
+		if err = v.writeHeader(); err != nil {
+			v.file.Close()
+			return
+		}
+		err = v.file.Close()
+	})
+	return err
+}
+
+func (v *consoleVoice) Opus() chan<- []byte {
+	return v.opus
+}
+
+// Write a 16 bit PCM WAV header for the samples recorded so far
+func (v *consoleVoice) writeHeader() error {
+	const bitsPerSample = 16
+	dataSize := v.samples * bitsPerSample / 8
+	blockAlign := consoleChannels * bitsPerSample / 8
+	header := []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'},
+		uint32(36 + dataSize),
+		[4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '},
+		uint32(16),
+		uint16(1), // PCM
+		uint16(consoleChannels),
+		uint32(consoleSampleRate),
+		uint32(consoleSampleRate * blockAlign),
+		uint16(blockAlign),
+		uint16(bitsPerSample),
+		[4]byte{'d', 'a', 't', 'a'},
+		dataSize,
+	}
+	for _, field := range header {
+		if err := binary.Write(v.file, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
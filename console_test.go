@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"layeh.com/gopus"
+)
+
+func TestConsolePrintsReplies(t *testing.T) {
+	out := &bytes.Buffer{}
+	session, err := NewConsoleSession(t.TempDir(), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	MessageHandler(session, newTestMessage(consoleGuildID, "%civ alice"))
+	if !strings.HasPrefix(out.String(), "bluebot> **alice**") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+}
+
+func TestConsoleVoiceWritesWAV(t *testing.T) {
+	dir := t.TempDir()
+	session, err := NewConsoleSession(dir, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc, err := session.ChannelVoiceJoin(consoleGuildID, consoleVoiceChannelID, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := gopus.NewEncoder(consoleSampleRate, 1, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const frameSize, frames = 960, 5
+	for i := 0; i < frames; i++ {
+		opus, err := enc.Encode(make([]int16, frameSize), frameSize, frameSize*2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vc.Opus() <- opus
+	}
+	if err = vc.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "voice-*.wav"))
+	if len(paths) != 1 {
+		t.Fatalf("expected one WAV file, got %v", paths)
+	}
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		t.Fatal("missing WAV header")
+	}
+	dataSize := binary.LittleEndian.Uint32(data[40:44])
+	if want := uint32(frameSize * frames * consoleChannels * 2); dataSize != want {
+		t.Errorf("expected %d bytes of audio, header says %d", want, dataSize)
+	}
+	if int(dataSize) != len(data)-44 {
+		t.Errorf("header says %d bytes of audio but file has %d", dataSize, len(data)-44)
+	}
+}
@@ -0,0 +1,449 @@
+/*
+Package fake provides an in-memory Discord session for running command handlers in tests
+without a network connection. Everything sent through it is recorded for inspection
+*/
+package fake
+
+import (
+	"bluebot/util"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var _ util.Session = (*Session)(nil)
+
+// A message sent through the fake session
+type Message struct {
+	ID         string
+	ChannelID  string
+	Content    string
+	Embeds     []*discordgo.MessageEmbed
+	Files      []*File
+	Components []discordgo.MessageComponent
+	Deleted    bool
+}
+
+type File struct {
+	Name string
+	Data []byte
+}
+
+/*
+Fake session with state set up by the test. Guilds, members, roles and permissions are
+looked up from the exported maps, which should be filled in before use
+*/
+type Session struct {
+	UserID      string
+	Guilds      map[string]*discordgo.Guild
+	Channels    map[string]*discordgo.Channel
+	Members     map[string]map[string]*discordgo.Member // By guild then user ID
+	Roles       map[string][]*discordgo.Role            // By guild ID
+	Permissions map[string]int64                        // By user ID, in every channel
+
+	mu        sync.Mutex
+	messages  []*Message
+	responses []*discordgo.InteractionResponse
+	voice     []*VoiceConnection
+	nextID    int
+}
+
+func NewSession() *Session {
+	return &Session{
+		UserID:      "bot",
+		Guilds:      map[string]*discordgo.Guild{},
+		Channels:    map[string]*discordgo.Channel{},
+		Members:     map[string]map[string]*discordgo.Member{},
+		Roles:       map[string][]*discordgo.Role{},
+		Permissions: map[string]int64{},
+	}
+}
+
+// Add a guild to the state with the given users in voice channels, keyed by user ID
+func (s *Session) AddGuild(guildID string, voiceStates map[string]string) *discordgo.Guild {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	guild := &discordgo.Guild{ID: guildID}
+	for userID, channelID := range voiceStates {
+		guild.VoiceStates = append(guild.VoiceStates, &discordgo.VoiceState{
+			GuildID: guildID, UserID: userID, ChannelID: channelID,
+		})
+	}
+	s.Guilds[guildID] = guild
+	return guild
+}
+
+// All messages sent so far, in order
+func (s *Session) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]*Message, len(s.messages))
+	copy(messages, s.messages)
+	return messages
+}
+
+// The most recently sent message, nil if none have been
+func (s *Session) LastMessage() *Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) == 0 {
+		return nil
+	}
+	return s.messages[len(s.messages)-1]
+}
+
+// Current content of a message, for messages that may still be edited
+func (s *Session) MessageContent(messageID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message, err := s.find(messageID)
+	if err != nil {
+		return ""
+	}
+	return message.Content
+}
+
+// Responses given to interactions with InteractionRespond
+func (s *Session) Responses() []*discordgo.InteractionResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	responses := make([]*discordgo.InteractionResponse, len(s.responses))
+	copy(responses, s.responses)
+	return responses
+}
+
+// Voice connections made so far, in order
+func (s *Session) VoiceConnections() []*VoiceConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	voice := make([]*VoiceConnection, len(s.voice))
+	copy(voice, s.voice)
+	return voice
+}
+
+func (s *Session) BotUserID() string {
+	return s.UserID
+}
+
+func (s *Session) StateGuild(guildID string) (*discordgo.Guild, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	guild, ok := s.Guilds[guildID]
+	if !ok {
+		return nil, discordgo.ErrStateNotFound
+	}
+	return guild, nil
+}
+
+func (s *Session) StateChannel(channelID string) (*discordgo.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channel, ok := s.Channels[channelID]
+	if !ok {
+		return nil, discordgo.ErrStateNotFound
+	}
+	return channel, nil
+}
+
+func (s *Session) ChannelVoiceJoin(guildID, channelID string, mute, deaf bool) (util.VoiceConnection, error) {
+	vc := newVoiceConnection(guildID, channelID)
+	s.mu.Lock()
+	s.voice = append(s.voice, vc)
+	s.mu.Unlock()
+	return vc, nil
+}
+
+func (s *Session) ChannelMessageSend(
+	channelID string, content string, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	return s.send(&Message{ChannelID: channelID, Content: content}), nil
+}
+
+func (s *Session) ChannelMessageSendEmbed(
+	channelID string, embed *discordgo.MessageEmbed, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	return s.send(&Message{ChannelID: channelID, Embeds: []*discordgo.MessageEmbed{embed}}), nil
+}
+
+func (s *Session) ChannelFileSend(
+	channelID, name string, r io.Reader, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	file, err := readFile(&discordgo.File{Name: name, Reader: r})
+	if err != nil {
+		return nil, err
+	}
+	return s.send(&Message{ChannelID: channelID, Files: []*File{file}}), nil
+}
+
+func (s *Session) ChannelMessageSendComplex(
+	channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	message := &Message{ChannelID: channelID, Content: data.Content, Embeds: data.Embeds, Components: data.Components}
+	for _, f := range data.Files {
+		file, err := readFile(f)
+		if err != nil {
+			return nil, err
+		}
+		message.Files = append(message.Files, file)
+	}
+	return s.send(message), nil
+}
+
+func (s *Session) ChannelMessageEdit(
+	channelID, messageID, content string, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message, err := s.find(messageID)
+	if err != nil {
+		return nil, err
+	}
+	message.Content = content
+	return &discordgo.Message{ID: message.ID, ChannelID: message.ChannelID, Content: content}, nil
+}
+
+func (s *Session) ChannelMessageEditComplex(
+	m *discordgo.MessageEdit, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message, err := s.find(m.ID)
+	if err != nil {
+		return nil, err
+	}
+	if m.Content != nil {
+		message.Content = *m.Content
+	}
+	if m.Components != nil {
+		message.Components = m.Components
+	}
+	return &discordgo.Message{ID: message.ID, ChannelID: message.ChannelID, Content: message.Content}, nil
+}
+
+func (s *Session) ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message, err := s.find(messageID)
+	if err != nil {
+		return err
+	}
+	message.Deleted = true
+	return nil
+}
+
+func (s *Session) InteractionRespond(
+	interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, resp)
+	return nil
+}
+
+/*
+Record the response to an interaction as a new message, except for components where the
+message they're on is edited instead
+*/
+func (s *Session) InteractionResponseEdit(
+	interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	if interaction.Type == discordgo.InteractionMessageComponent && interaction.Message != nil {
+		return s.editResponse(interaction.Message.ID, newresp)
+	}
+	message := &Message{ChannelID: interaction.ChannelID}
+	if newresp.Content != nil {
+		message.Content = *newresp.Content
+	}
+	if newresp.Embeds != nil {
+		message.Embeds = *newresp.Embeds
+	}
+	if newresp.Components != nil {
+		message.Components = *newresp.Components
+	}
+	for _, f := range newresp.Files {
+		file, err := readFile(f)
+		if err != nil {
+			return nil, err
+		}
+		message.Files = append(message.Files, file)
+	}
+	return s.send(message), nil
+}
+
+func (s *Session) editResponse(messageID string, edit *discordgo.WebhookEdit) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message, err := s.find(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if edit.Content != nil {
+		message.Content = *edit.Content
+	}
+	if edit.Embeds != nil {
+		message.Embeds = *edit.Embeds
+	}
+	if edit.Components != nil {
+		message.Components = *edit.Components
+	}
+	return &discordgo.Message{ID: message.ID, ChannelID: message.ChannelID, Content: message.Content}, nil
+}
+
+func (s *Session) InteractionResponseDelete(
+	interaction *discordgo.Interaction, options ...discordgo.RequestOption,
+) error {
+	return nil
+}
+
+func (s *Session) FollowupMessageCreate(
+	interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams,
+	options ...discordgo.RequestOption,
+) (*discordgo.Message, error) {
+	message := &Message{
+		ChannelID: interaction.ChannelID, Content: data.Content, Embeds: data.Embeds, Components: data.Components,
+	}
+	for _, f := range data.Files {
+		file, err := readFile(f)
+		if err != nil {
+			return nil, err
+		}
+		message.Files = append(message.Files, file)
+	}
+	return s.send(message), nil
+}
+
+func (s *Session) UserChannelPermissions(
+	userID, channelID string, options ...discordgo.RequestOption,
+) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Permissions[userID], nil
+}
+
+func (s *Session) GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Roles[guildID], nil
+}
+
+func (s *Session) GuildMember(
+	guildID, userID string, options ...discordgo.RequestOption,
+) (*discordgo.Member, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	member, ok := s.Members[guildID][userID]
+	if !ok {
+		return nil, fmt.Errorf("no member %s in guild %s", userID, guildID)
+	}
+	return member, nil
+}
+
+func (s *Session) send(message *Message) *discordgo.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	message.ID = fmt.Sprint(s.nextID)
+	s.messages = append(s.messages, message)
+	return &discordgo.Message{
+		ID: message.ID, ChannelID: message.ChannelID, Content: message.Content, Embeds: message.Embeds,
+	}
+}
+
+func (s *Session) find(messageID string) (*Message, error) {
+	for _, message := range s.messages {
+		if message.ID == messageID {
+			return message, nil
+		}
+	}
+	return nil, errors.New("unknown message " + messageID)
+}
+
+func readFile(f *discordgo.File) (*File, error) {
+	data, err := io.ReadAll(f.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Name: f.Name, Data: data}, nil
+}
+
+// Fake voice connection that records the opus frames played over it
+type VoiceConnection struct {
+	GuildID   string
+	ChannelID string
+
+	opus         chan []byte
+	mu           sync.Mutex
+	frames       [][]byte
+	speaking     bool
+	disconnected bool
+}
+
+func newVoiceConnection(guildID, channelID string) *VoiceConnection {
+	vc := &VoiceConnection{GuildID: guildID, ChannelID: channelID, opus: make(chan []byte)}
+	go func() {
+		for frame := range vc.opus {
+			vc.mu.Lock()
+			vc.frames = append(vc.frames, frame)
+			vc.mu.Unlock()
+		}
+	}()
+	return vc
+}
+
+func (v *VoiceConnection) Speaking(speaking bool) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.speaking = speaking
+	return nil
+}
+
+func (v *VoiceConnection) Disconnect() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.disconnected = true
+	return nil
+}
+
+func (v *VoiceConnection) Opus() chan<- []byte {
+	return v.opus
+}
+
+func (v *VoiceConnection) IsSpeaking() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.speaking
+}
+
+func (v *VoiceConnection) IsDisconnected() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.disconnected
+}
+
+// Opus frames received so far
+func (v *VoiceConnection) Frames() [][]byte {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	frames := make([][]byte, len(v.frames))
+	copy(frames, v.frames)
+	return frames
+}
+
+/*
+Wait until at least n frames have been received, as the last frame sent may not have been
+recorded yet. Returns false if they don't arrive within the timeout
+*/
+func (v *VoiceConnection) WaitForFrames(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if len(v.Frames()) >= n {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return len(v.Frames()) >= n
+}
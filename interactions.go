@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bluebot/command"
+	"bluebot/store"
+	"bluebot/util"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Subcommands that only exist for the slash command, calling the command without a keyword
+var implicitSubcommands = map[string]bool{
+	"civ roll": true,
+}
+
+// Discord's limit on slash command description length
+const maxDescriptionLen = 100
+
+// Names Discord accepts for slash commands: lowercase, no spaces and at most 32 characters
+var slashNameRegex = regexp.MustCompile(`^[-_\p{Ll}\p{Lo}\p{N}]{1,32}$`)
+
+// Build the slash command definition for a command from its metadata
+func slashCommand(cmd *command.Command) *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		Name:        cmd.Name,
+		Description: util.Truncate(cmd.Summary, maxDescriptionLen),
+		Options:     cmd.SlashOptions(),
+	}
+}
+
+/*
+Register every command as a global application command, replacing any that were
+registered previously
+*/
+func RegisterSlashCommands(session *discordgo.Session) error {
+	cmds := []*discordgo.ApplicationCommand{}
+	for _, cmd := range commands.Commands() {
+		cmds = append(cmds, slashCommand(cmd))
+	}
+	_, err := session.ApplicationCommandBulkOverwrite(session.State.User.ID, "", cmds)
+	if err != nil {
+		return err
+	}
+	log.Printf("Registered %d slash commands", len(cmds))
+	return nil
+}
+
+/*
+Run a slash command through the same handlers as prefixed messages. The response is
+deferred straight away as handlers can take longer than Discord's 3 second limit
+*/
+func InteractionHandler(session util.Session, i *discordgo.InteractionCreate) {
+	if i.Type == discordgo.InteractionMessageComponent {
+		ComponentHandler(session, i)
+		return
+	}
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+	data := i.ApplicationCommandData()
+	cmd, ok := commands.Get(data.Name)
+	if !ok {
+		log.Printf("Received unknown slash command: %s", data.Name)
+		return
+	}
+	err := session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		log.Printf("Failed to respond to interaction for %s: %s", data.Name, err)
+		return
+	}
+	// Text for ArgRest is passed on whole, as it would be taken from a typed command
+	whole := map[string]bool{}
+	for _, arg := range cmd.Args {
+		if arg.Kind == command.ArgRest {
+			whole[arg.Name] = true
+		}
+	}
+	args := optionsToArgs(cmd.Name, cmd.SlashOptions(), data.Options, whole)
+	log.Printf("Recevied slash command: %s with args: %s", data.Name, args)
+
+	ctx := util.NewInteractionContext(session, i.Interaction)
+	ctx.Prefix = store.Guild(i.GuildID).Prefix
+	defer ctx.Finish()
+	RunCommand(ctx, cmd.Name, args)
+}
+
+/*
+Run the command a button or select menu on one of the bot's messages stands for. Its custom
+ID is the command and arguments as they'd be typed, and any values picked from a select menu
+are added as more arguments. The command's reply replaces the message the component is on
+*/
+func ComponentHandler(session util.Session, i *discordgo.InteractionCreate) {
+	data := i.MessageComponentData()
+	args, err := util.SplitArgs(data.CustomID)
+	if err != nil || len(args) == 0 {
+		log.Printf("Received component with an invalid custom ID: %s", data.CustomID)
+		return
+	}
+	cmd, ok := commands.Get(args[0])
+	if !ok {
+		log.Printf("Received component for unknown command: %s", args[0])
+		return
+	}
+	err = session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		log.Printf("Failed to respond to component for %s: %s", cmd.Name, err)
+		return
+	}
+	args = append(args[1:], data.Values...)
+	log.Printf("Received component for: %s with args: %s", cmd.Name, args)
+
+	ctx := util.NewInteractionContext(session, i.Interaction)
+	ctx.Prefix = store.Guild(i.GuildID).Prefix
+	defer ctx.Finish()
+	RunCommand(ctx, cmd.Name, args)
+}
+
+/*
+Convert interaction options back into prefix command style arguments, in the order the
+options are defined. Subcommand names become keywords and strings are split into words
+the same way as message arguments, apart from the options named in whole
+*/
+func optionsToArgs(
+	path string,
+	defined []*discordgo.ApplicationCommandOption,
+	given []*discordgo.ApplicationCommandInteractionDataOption,
+	whole map[string]bool,
+) []string {
+	values := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(given))
+	for _, option := range given {
+		values[option.Name] = option
+	}
+
+	args := []string{}
+	for _, def := range defined {
+		option, ok := values[def.Name]
+		if !ok {
+			continue
+		}
+		switch option.Type {
+		case discordgo.ApplicationCommandOptionSubCommand,
+			discordgo.ApplicationCommandOptionSubCommandGroup:
+			subPath := path + " " + option.Name
+			if !implicitSubcommands[subPath] {
+				args = append(args, option.Name)
+			}
+			args = append(args, optionsToArgs(subPath, def.Options, option.Options, whole)...)
+		case discordgo.ApplicationCommandOptionString:
+			if whole[option.Name] {
+				args = append(args, option.StringValue())
+				continue
+			}
+			words, err := util.SplitArgs(option.StringValue())
+			if err != nil {
+				words = strings.Fields(option.StringValue())
+			}
+			args = append(args, words...)
+		default:
+			args = append(args, fmt.Sprint(option.Value))
+		}
+	}
+	return args
+}
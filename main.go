@@ -3,74 +3,301 @@ package main
 import (
 	"bluebot/command"
 	"bluebot/config"
+	"bluebot/store"
 	"bluebot/util"
+	"context"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"golang.org/x/exp/maps"
 )
 
-// Mapping of commands to handler functions
-var commands = map[string]util.HandlerFunc{
-	"civ":      command.HandleCiv,
-	"tell":     command.HandleTell,
-	"say":      command.HandleSay,
-	"setvoice": command.HandleSetVoice,
-	"show":     command.HandleShow,
-	"taxes":    command.HandleTaxes,
-	"motd":     command.HandleMemeOfTheDay,
+// All commands the bot responds to, looked up by name or alias
+var commands = command.NewRegistry()
+
+// Recent command uses for rate limits
+var limiter = util.NewRateLimiter()
+
+// Connection to Discord, nil in console mode
+var discord *discordgo.Session
+
+// Names of the image commands currently registered
+var imageCommands = []string{}
+
+// Held while the image commands are replaced, so reloads from %reload and SIGHUP take turns
+var reloadMu sync.Mutex
+
+// Used when no timeout is set in config
+const DefaultCommandTimeout = 30 * time.Second
+
+func AddCommands() {
+	commands.Register(
+		&command.Command{
+			Name:     "civ",
+			Usage:    "[player ...] | tiers <min>-<max>",
+			Summary:  "Roll random Civ 5 civs for the given or previous players, or set the tiers to pick from",
+			Category: "Games",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "roll",
+					Description: "Roll civs for the given or previous players",
+					Options: []*discordgo.ApplicationCommandOption{
+						command.StringOption("players", "Player names separated by spaces", false),
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "tiers",
+					Description: "Set the min/max tiers for this channel",
+					Options: []*discordgo.ApplicationCommandOption{
+						command.StringOption("range", "Tier range between 1 and 8, e.g. 2-6", true),
+					},
+				},
+			},
+			Handler: command.HandleCiv,
+		},
+		&command.Command{
+			Name:     "tell",
+			Summary:  "Say a message in your voice channel",
+			Category: "Voice",
+			Args:     command.TellArgs,
+			Handler:  command.HandleTell,
+		},
+		&command.Command{
+			Name:     "setvoice",
+			Summary:  "Set the voice preset used by tell",
+			Category: "Voice",
+			Args:     command.SetVoiceArgs,
+			Require:  command.Requirement{Permissions: discordgo.PermissionManageServer},
+			Handler:  command.HandleSetVoice,
+		},
+		&command.Command{
+			Name:     "say",
+			Summary:  "Get a random phrase",
+			Category: "Fun",
+			Handler:  command.HandleSay,
+		},
+		&command.Command{
+			Name:     "phrase",
+			Summary:  "List the phrases used by say, taxes and greetings, or add and remove them",
+			Category: "Fun",
+			Args:     command.PhraseArgs,
+			Handler:  command.HandlePhrase,
+		},
+		&command.Command{
+			Name:     "show",
+			Summary:  "Show a picture of bluebot",
+			Category: "Fun",
+			Handler:  command.HandleShow,
+		},
+		&command.Command{
+			Name:     "taxes",
+			Summary:  "Do your taxes",
+			Category: "Fun",
+			Handler:  command.HandleTaxes,
+		},
+		&command.Command{
+			Name:     "motd",
+			Aliases:  []string{"meme"},
+			Summary:  "Get the meme of the day",
+			Category: "Fun",
+			Handler:  command.HandleMemeOfTheDay,
+		},
+		command.HelpCommand(commands),
+		command.SettingsCommand(commands),
+		command.ReloadCommand(Reload),
+	)
+	commands.Register(command.MusicCommands...)
 }
 
+// Register a command for each image setting, replacing any registered before
 func AddImageCommands() {
-	for cmd, item := range config.ImageSettings {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	addImageCommands()
+}
+
+func addImageCommands() {
+	commands.Unregister(imageCommands...)
+	imageCommands = []string{}
+	for name, item := range config.GetImageSettings() {
+		cmd := strings.ToLower(name)
+		// Discord rejects every slash command if one of them has an invalid name
+		if !slashNameRegex.MatchString(cmd) {
+			log.Printf("Skipping image command %q: not a valid slash command name", name)
+			continue
+		}
+		if _, ok := commands.Get(cmd); ok {
+			log.Printf("Skipping image command %q: there's already a command called %s", name, cmd)
+			continue
+		}
 		settings := item
-		commands[cmd] = func(
-			session *discordgo.Session, msg *discordgo.MessageCreate, args []string,
-		) error {
-			return command.HandleImage(session, msg, settings, args)
+		imageCommands = append(imageCommands, cmd)
+		commands.Register(&command.Command{
+			Name:     cmd,
+			Summary:  fmt.Sprintf("Write some text on the %s image", cmd),
+			Category: "Images",
+			Args:     command.ImageArgs,
+			Handler: func(ctx *util.Context, args []string) error {
+				return command.HandleImage(ctx, settings, args)
+			},
+		})
+	}
+}
+
+/*
+Reload config and data files, then update the image commands and slash commands to match.
+Returns what changed
+*/
+func Reload() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	changes, err := config.Reload()
+	if err != nil {
+		log.Printf("Reload failed: %s", err)
+		return nil, err
+	}
+	addImageCommands()
+	if discord != nil {
+		if err = RegisterSlashCommands(discord); err != nil {
+			log.Printf("Failed to register slash commands after reload: %s", err)
 		}
 	}
+	log.Printf("Reloaded with %d changes: %s", len(changes), strings.Join(changes, "; "))
+	return changes, nil
 }
 
-func VoiceHandler(session *discordgo.Session, msg *discordgo.VoiceStateUpdate) {
-	err := command.HandleVoiceState(session, msg)
+func VoiceHandler(session util.Session, msg *discordgo.VoiceStateUpdate) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout(""))
+	defer cancel()
+	err := command.HandleVoiceState(ctx, session, msg)
 	if err != nil {
 		log.Printf("Voice state update handling failed: %s", err)
 	}
 }
 
-func MessageHandler(session *discordgo.Session, msg *discordgo.MessageCreate) {
-	if msg.Author.ID == session.State.User.ID {
+func MessageHandler(session util.Session, msg *discordgo.MessageCreate) {
+	if msg.Author.ID == session.BotUserID() {
+		return
+	}
+	// Check for the guild's prefix and split msg into command and args
+	prefix := store.Guild(msg.GuildID).Prefix
+	if !strings.HasPrefix(msg.Content, prefix) {
 		return
 	}
-	// Check for prefix and split msg into command and args
-	if !strings.HasPrefix(msg.Content, "%") {
+	message_list, err := util.SplitArgs(msg.Content[len(prefix):])
+	if err != nil {
+		session.ChannelMessageSend(msg.ChannelID, "Couldn't read that command: "+err.Error())
+		return
+	}
+	if len(message_list) == 0 {
 		return
 	}
-	message_list := strings.Split(msg.Content[1:], " ")
 	command, args := message_list[0], message_list[1:]
 	log.Printf("Recevied command: %s with args: %s", command, args)
 
-	// Check command exists and run its handler if so
-	if handler, ok := commands[command]; ok {
-		start := time.Now()
-		err := handler(session, msg, args)
-		log.Printf("%s took %s", command, time.Since(start))
-		// Any errors returned cause internal server error message
-		// Handle errors more specifically if needed within the handler function
-		if err != nil {
-			session.ChannelMessageSend(msg.ChannelID, "A fatal internal error occurred")
-			log.Printf("Command %s failed with error: %s", command, err)
+	ctx := util.NewMessageContext(session, msg)
+	ctx.Prefix = prefix
+	ctx.Line = msg.Content[len(prefix):]
+	RunCommand(ctx, command, args)
+}
+
+// Check command exists and run its handler if so
+func RunCommand(ctx *util.Context, name string, args []string) {
+	cmd, ok := commands.Get(name)
+	if !ok {
+		command.SendPhrase(ctx, "wrongcommand")
+		return
+	}
+	if store.Guild(ctx.GuildID).IsDisabled(cmd.Name) {
+		ctx.Send(fmt.Sprintf("%s%s is disabled in this server", ctx.Prefix, cmd.Name))
+		return
+	}
+	if allowed, reason := command.CheckAccess(ctx, cmd); !allowed {
+		ctx.Send(reason)
+		return
+	}
+	if wait := checkRateLimit(ctx, cmd); wait > 0 {
+		ctx.Send(fmt.Sprintf(
+			"Slow down! You can use %s%s again in %s", ctx.Prefix, cmd.Name, wait.Truncate(time.Second)+time.Second,
+		))
+		return
+	}
+	var cancel context.CancelFunc
+	ctx.Context, cancel = context.WithTimeout(ctx.Context, commandTimeout(cmd.Name))
+	defer cancel()
+
+	start := time.Now()
+	err := runHandler(ctx, cmd, args)
+	log.Printf("%s took %s", cmd.Name, time.Since(start))
+	// The kind of error decides what the user is told, the full cause is logged
+	if err != nil {
+		command.ReplyError(ctx, cmd, err)
+	}
+}
+
+// Run a command's handler, recovering from any panic so one command can't take down the bot
+func runHandler(ctx *util.Context, cmd *command.Command, args []string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Command %s panicked: %v\n%s", cmd.Name, r, debug.Stack())
+			// The value is shown so a reply can be matched up with its stack trace in the log
+			err = command.InternalError(
+				fmt.Sprintf("Something went wrong running %s%s: %v", ctx.Prefix, cmd.Name, r), fmt.Errorf("panic: %v", r),
+			)
 		}
-	} else {
-		session.ChannelMessageSend(msg.ChannelID, config.GetPhrase("wrongcommand"))
+	}()
+	return cmd.Handler(ctx, args)
+}
+
+// Time a command is given before its context is cancelled, from config
+func commandTimeout(name string) time.Duration {
+	cfg := config.Get()
+	if seconds, ok := cfg.CommandTimeouts[name]; ok && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if cfg.CommandTimeoutS > 0 {
+		return time.Duration(cfg.CommandTimeoutS) * time.Second
+	}
+	return DefaultCommandTimeout
+}
+
+/*
+Check and record a use of a command against its per user and per guild limits from config.
+Returns how long to wait if a limit has been reached
+*/
+func checkRateLimit(ctx *util.Context, cmd *command.Command) time.Duration {
+	rateLimit, ok := config.Get().RateLimits[cmd.Name]
+	if !ok || rateLimit.WindowS <= 0 {
+		return 0
+	}
+	window := time.Duration(rateLimit.WindowS) * time.Second
+	limits := []util.Limit{}
+	if rateLimit.PerUser > 0 {
+		limits = append(limits, util.Limit{
+			Key: cmd.Name + ":user:" + ctx.Author.ID, Max: rateLimit.PerUser, Window: window,
+		})
+	}
+	if rateLimit.PerGuild > 0 && ctx.GuildID != "" {
+		limits = append(limits, util.Limit{
+			Key: cmd.Name + ":guild:" + ctx.GuildID, Max: rateLimit.PerGuild, Window: window,
+		})
 	}
+	wait := limiter.Allow(time.Now(), limits...)
+	if wait > 0 {
+		log.Printf("Rate limited %s for %s (%s), wait %s", cmd.Name, ctx.Author.Username, ctx.Author.ID, wait)
+	}
+	return wait
 }
 
 func Setup() {
@@ -82,23 +309,76 @@ func Setup() {
 	if err != nil {
 		log.Fatalf("Error setting up log file: %v", err)
 	}
+	cfg := config.Get()
+	err = store.Open(cfg.DatabasePath)
+	if err != nil {
+		log.Fatalf("Failed to open settings database: %s", err)
+	}
 	// Remove old stored audio from ungraceful shutdown
-	dirs, err := ioutil.ReadDir(config.Cfg.AudioPath)
+	dirs, err := ioutil.ReadDir(cfg.AudioPath)
 	if err != nil {
 		log.Fatalf("Failed to read audio path: %s", err)
 	}
 	for _, dir := range dirs {
-		os.RemoveAll(config.Cfg.AudioPath + "/" + dir.Name())
+		os.RemoveAll(cfg.AudioPath + "/" + dir.Name())
 	}
 }
 
-// Main entry point: start discord-go client and wait for messages
+// Main entry point: run commands from the console if asked, otherwise connect to Discord
 func main() {
+	consoleOut := flag.String("out", "console", "Folder to save sent images and voice to in console mode")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-out folder] [console | validate-config]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	mode := flag.Arg(0)
+	switch mode {
+	case "", "console":
+	case "validate-config":
+		os.Exit(validateConfig())
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	Setup()
+	AddCommands()
 	AddImageCommands()
-	maps.Copy(commands, command.MusicCommands)
 
-	discord, err := discordgo.New("Bot " + config.DiscordToken)
+	if mode == "console" {
+		if err := RunConsole(*consoleOut); err != nil {
+			log.Printf("Console failed: %s", err)
+		}
+	} else {
+		runDiscord()
+	}
+	Cleanup()
+}
+
+// Print any problems with the config, returning the exit code
+func validateConfig() int {
+	warnings, err := config.Check()
+	for _, warning := range warnings {
+		fmt.Println("warning: " + warning)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println("Config is valid")
+	return 0
+}
+
+// Start discord-go client and wait for messages until the process is signalled to stop
+func runDiscord() {
+	var err error
+	config.DiscordToken, err = config.ReadDiscordToken()
+	if err != nil {
+		log.Fatalf("Failed to read discord token: %s", err)
+	}
+	discord, err = discordgo.New("Bot " + config.DiscordToken)
 	if err != nil {
 		log.Fatalf("Failed to create discord client: %s", err)
 	}
@@ -108,18 +388,41 @@ func main() {
 		log.Fatalf("Failed to open connection to Discord: %s", err)
 	}
 
-	discord.AddHandler(MessageHandler)
-	discord.AddHandler(VoiceHandler)
+	session := util.NewDiscordSession(discord)
+	discord.AddHandler(func(_ *discordgo.Session, msg *discordgo.MessageCreate) {
+		MessageHandler(session, msg)
+	})
+	discord.AddHandler(func(_ *discordgo.Session, i *discordgo.InteractionCreate) {
+		InteractionHandler(session, i)
+	})
+	discord.AddHandler(func(_ *discordgo.Session, msg *discordgo.VoiceStateUpdate) {
+		VoiceHandler(session, msg)
+	})
+
+	err = RegisterSlashCommands(discord)
+	if err != nil {
+		log.Printf("Failed to register slash commands: %s", err)
+	}
 
 	log.Println("bluebot is ready to rumble")
 
-	// Wait for OS signal through channel before closing main loop
+	// Wait for OS signal through channel before closing main loop, reloading on SIGHUP
 	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	<-sc
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
+	for sig := range sc {
+		if sig == syscall.SIGHUP {
+			Reload()
+			continue
+		}
+		break
+	}
 	discord.Close()
-	// Remove stored audio
-	err = os.RemoveAll(config.Cfg.AudioPath + "/*")
+}
+
+// Close the settings store and remove stored audio
+func Cleanup() {
+	store.Close()
+	err := os.RemoveAll(config.Get().AudioPath + "/*")
 	if err != nil {
 		log.Fatalln("Failed to remove temporary audio folder")
 	}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bluebot/command"
+	"bluebot/config"
+	"bluebot/fake"
+	"bluebot/store"
+	"bluebot/util"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestMain(m *testing.M) {
+	config.Get().CivListPath = "data/civ_list.csv"
+	config.Get().CivSelections = 3
+	dir, err := os.MkdirTemp("", "bluebot-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = store.Open(filepath.Join(dir, "test.db")); err != nil {
+		log.Fatal(err)
+	}
+	AddCommands()
+	commands.Register(&command.Command{
+		Name: "crash",
+		Handler: func(ctx *util.Context, args []string) error {
+			panic("oh no")
+		},
+	})
+	commands.Register(&command.Command{
+		Name: "echo",
+		Handler: func(ctx *util.Context, args []string) error {
+			_, err := ctx.SendComponents(strings.Join(args, " "), nil)
+			return err
+		},
+	})
+
+	code := m.Run()
+	store.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestMessage(guildID, content string) *discordgo.MessageCreate {
+	return &discordgo.MessageCreate{Message: &discordgo.Message{
+		ChannelID: "channel",
+		GuildID:   guildID,
+		Content:   content,
+		Author:    &discordgo.User{ID: "user", Username: "user"},
+	}}
+}
+
+func TestMessageHandlerRunsCommand(t *testing.T) {
+	session := fake.NewSession()
+	MessageHandler(session, newTestMessage("guild", `%civ alice "bob smith"`))
+
+	messages := session.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected one reply, got %d", len(messages))
+	}
+	if !strings.Contains(messages[0].Content, "**alice**") || !strings.Contains(messages[0].Content, "**bob smith**") {
+		t.Errorf("unexpected reply: %q", messages[0].Content)
+	}
+}
+
+func TestMessageHandlerIgnoresMessages(t *testing.T) {
+	session := fake.NewSession()
+	MessageHandler(session, newTestMessage("guild", "civ alice"))
+	msg := newTestMessage("guild", "%civ alice")
+	msg.Author.ID = session.BotUserID()
+	MessageHandler(session, msg)
+
+	if n := len(session.Messages()); n != 0 {
+		t.Errorf("expected no replies, got %d", n)
+	}
+}
+
+func TestMessageHandlerUnknownCommand(t *testing.T) {
+	session := fake.NewSession()
+	MessageHandler(session, newTestMessage("guild", "%notacommand"))
+	if n := len(session.Messages()); n != 1 {
+		t.Errorf("expected one reply, got %d", n)
+	}
+}
+
+func TestMessageHandlerUsageError(t *testing.T) {
+	session := fake.NewSession()
+	MessageHandler(session, newTestMessage("guild", "%civ tiers 9-1"))
+	if reply := session.LastMessage(); reply == nil || !strings.Contains(reply.Content, "Usage: `%civ") {
+		t.Errorf("expected usage in reply, got %+v", reply)
+	}
+}
+
+func TestMessageHandlerRecoversPanic(t *testing.T) {
+	session := fake.NewSession()
+	MessageHandler(session, newTestMessage("guild", "%crash"))
+	if reply := session.LastMessage(); reply == nil || !strings.Contains(reply.Content, "Something went wrong running %crash: oh no") {
+		t.Errorf("expected an error reply, got %+v", reply)
+	}
+}
+
+func TestMessageHandlerGuildPrefix(t *testing.T) {
+	err := store.UpdateGuild("prefixed", func(settings *store.GuildSettings) error {
+		settings.Prefix = "!"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := fake.NewSession()
+	MessageHandler(session, newTestMessage("prefixed", "%civ alice"))
+	if n := len(session.Messages()); n != 0 {
+		t.Errorf("expected the default prefix to be ignored, got %d replies", n)
+	}
+	MessageHandler(session, newTestMessage("prefixed", "!civ alice"))
+	if n := len(session.Messages()); n != 1 {
+		t.Errorf("expected one reply, got %d", n)
+	}
+}
+
+func TestComponentHandlerEditsMessage(t *testing.T) {
+	session := fake.NewSession()
+	message, _ := session.ChannelMessageSend("channel", "original")
+	InteractionHandler(session, &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		Type:      discordgo.InteractionMessageComponent,
+		GuildID:   "guild",
+		ChannelID: "channel",
+		Message:   message,
+		Member:    &discordgo.Member{User: &discordgo.User{ID: "user", Username: "user"}},
+		Data:      discordgo.MessageComponentInteractionData{CustomID: "echo 'a b'", Values: []string{"c"}},
+	}})
+
+	responses := session.Responses()
+	if len(responses) != 1 || responses[0].Type != discordgo.InteractionResponseDeferredMessageUpdate {
+		t.Errorf("expected a deferred update, got %+v", responses)
+	}
+	if n := len(session.Messages()); n != 1 {
+		t.Errorf("expected the reply to edit the message, got %d messages", n)
+	}
+	if content := session.MessageContent(message.ID); content != "a b c" {
+		t.Errorf("unexpected edited message: %q", content)
+	}
+}
+
+// Slash command interaction from "user" for the given command data
+func newTestInteraction(channelID string, data discordgo.ApplicationCommandInteractionData) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		Type:      discordgo.InteractionApplicationCommand,
+		GuildID:   "guild",
+		ChannelID: channelID,
+		Member:    &discordgo.Member{User: &discordgo.User{ID: "user", Username: "user"}},
+		Data:      data,
+	}}
+}
+
+func TestInteractionHandlerImplicitSubcommand(t *testing.T) {
+	session := fake.NewSession()
+	InteractionHandler(session, newTestInteraction("slash-roll", discordgo.ApplicationCommandInteractionData{
+		Name: "civ",
+		Options: []*discordgo.ApplicationCommandInteractionDataOption{{
+			Type: discordgo.ApplicationCommandOptionSubCommand,
+			Name: "roll",
+			Options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Type: discordgo.ApplicationCommandOptionString, Name: "players", Value: `"a b" c`},
+			},
+		}},
+	}))
+
+	responses := session.Responses()
+	if len(responses) != 1 || responses[0].Type != discordgo.InteractionResponseDeferredChannelMessageWithSource {
+		t.Errorf("expected a deferred reply, got %+v", responses)
+	}
+	// The roll subcommand is dropped, so only the players are passed on
+	content := session.LastMessage().Content
+	if !strings.Contains(content, "**a b**") || !strings.Contains(content, "**c**") || strings.Contains(content, "**roll**") {
+		t.Errorf("unexpected reply: %q", content)
+	}
+}
+
+func TestInteractionHandlerSubcommand(t *testing.T) {
+	session := fake.NewSession()
+	InteractionHandler(session, newTestInteraction("slash-tiers", discordgo.ApplicationCommandInteractionData{
+		Name: "civ",
+		Options: []*discordgo.ApplicationCommandInteractionDataOption{{
+			Type: discordgo.ApplicationCommandOptionSubCommand,
+			Name: "tiers",
+			Options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Type: discordgo.ApplicationCommandOptionString, Name: "range", Value: "2-6"},
+			},
+		}},
+	}))
+	if content := session.LastMessage().Content; content != "Min and max tiers set to 6 and 2" {
+		t.Errorf("unexpected reply: %q", content)
+	}
+}
+
+func TestOptionsToArgs(t *testing.T) {
+	defined := []*discordgo.ApplicationCommandOption{
+		{Type: discordgo.ApplicationCommandOptionInteger, Name: "count"},
+		command.StringOption("words", "", false),
+		{Type: discordgo.ApplicationCommandOptionBoolean, Name: "loud"},
+		command.StringOption("text", "", false),
+	}
+	// Options come back in any order, with numbers decoded from JSON as floats
+	given := []*discordgo.ApplicationCommandInteractionDataOption{
+		{Type: discordgo.ApplicationCommandOptionBoolean, Name: "loud", Value: true},
+		{Type: discordgo.ApplicationCommandOptionString, Name: "words", Value: `one "two three"`},
+		{Type: discordgo.ApplicationCommandOptionInteger, Name: "count", Value: float64(3)},
+		{Type: discordgo.ApplicationCommandOptionString, Name: "text", Value: `say "hi"`},
+	}
+	args := optionsToArgs("test", defined, given, map[string]bool{"text": true})
+	if got := fmt.Sprintf("%q", args); got != `["3" "one" "two three" "true" "say \"hi\""]` {
+		t.Errorf("unexpected args %s", got)
+	}
+}
+
+func TestAddImageCommandsSkipsInvalidNames(t *testing.T) {
+	old := config.ImageSettings
+	config.ImageSettings = map[string]*config.ImageSetting{
+		"picture":     {Filename: "picture.png"},
+		"two words":   {Filename: "picture.png"},
+		"Capitalised": {Filename: "picture.png"},
+		"help":        {Filename: "picture.png"},
+		"q":           {Filename: "picture.png"},
+	}
+	t.Cleanup(func() {
+		config.ImageSettings = old
+		AddImageCommands()
+	})
+
+	AddImageCommands()
+	for _, name := range []string{"picture", "capitalised"} {
+		if cmd, ok := commands.Get(name); !ok || cmd.Category != "Images" {
+			t.Errorf("expected the %s image command to be registered", name)
+		}
+	}
+	// Image commands don't replace other commands or their aliases
+	for _, name := range []string{"help", "q"} {
+		if cmd, _ := commands.Get(name); cmd.Category == "Images" {
+			t.Errorf("image command replaced %s", name)
+		}
+	}
+	if len(imageCommands) != 2 {
+		t.Errorf("expected two image commands, got %q", imageCommands)
+	}
+}
+
+func TestSlashCommandTruncatesDescription(t *testing.T) {
+	cmd := &command.Command{Name: "long", Summary: strings.Repeat("é", maxDescriptionLen+1)}
+	description := slashCommand(cmd).Description
+	if !utf8.ValidString(description) || utf8.RuneCountInString(description) != maxDescriptionLen {
+		t.Errorf("expected a valid %d character description, got %q", maxDescriptionLen, description)
+	}
+}
+
+func TestMessageHandlerRateLimit(t *testing.T) {
+	old := config.Get().RateLimits
+	config.Get().RateLimits = map[string]*config.RateLimit{"echo": {PerUser: 1, WindowS: 60}}
+	oldLimiter := limiter
+	limiter = util.NewRateLimiter()
+	t.Cleanup(func() { config.Get().RateLimits, limiter = old, oldLimiter })
+	session := fake.NewSession()
+
+	MessageHandler(session, newTestMessage("limited", "%echo first"))
+	MessageHandler(session, newTestMessage("limited", "%echo second"))
+	messages := session.Messages()
+	if len(messages) != 2 || messages[0].Content != "first" {
+		t.Fatalf("expected the first use to run, got %+v", messages)
+	}
+	if content := messages[1].Content; content != "Slow down! You can use %echo again in 1m0s" {
+		t.Errorf("unexpected rate limit reply: %q", content)
+	}
+}
+
+// Write a valid config along with any extra data files and point CONFIG at it for reloads
+func writeTestConfig(t *testing.T, extra map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	civList, err := filepath.Abs("data/civ_list.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range []string{"audio", "images", "self_images", "phrases"} {
+		if err := os.Mkdir(filepath.Join(dir, folder), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"images.json":        "{}",
+		"voice_presets.json": `{"default": {"name": "en-GB-Standard-A", "language": "en-GB"}}`,
+		"config.yml": "AudioPath: " + dir + "/audio\nCivListPath: " + civList + "\nCivSelections: 3\n" +
+			"DatabasePath: " + dir + "/bluebot.db\nImagePath: " + dir + "/images\n" +
+			"ImageSettingsPath: " + dir + "/images.json\nLogFilePath: " + dir + "/bluebot.log\n" +
+			"PhrasesPath: " + dir + "/phrases\nSelfImagePath: " + dir + "/self_images\n" +
+			"VoicePresetsPath: " + dir + "/voice_presets.json\n",
+	}
+	for name, data := range extra {
+		files[name] = data
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("CONFIG", filepath.Join(dir, "config.yml"))
+}
+
+// Reloading swaps the config while commands that read it are running
+func TestReloadWhileRunningCommands(t *testing.T) {
+	writeTestConfig(t, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session := fake.NewSession()
+			for n := 0; n < 10; n++ {
+				msg := newTestMessage("reloading", "%civ alice")
+				msg.ChannelID = fmt.Sprintf("reload-%d", i)
+				MessageHandler(session, msg)
+			}
+			for _, message := range session.Messages() {
+				if !strings.Contains(message.Content, "**alice**") {
+					t.Errorf("unexpected reply while reloading: %q", message.Content)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := config.Reload(); err != nil {
+			t.Error(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestReloadConcurrently(t *testing.T) {
+	old := config.ImageSettings
+	t.Cleanup(func() {
+		config.ImageSettings = old
+		AddImageCommands()
+	})
+	writeTestConfig(t, map[string]string{
+		"images.json":    `{"one": {"filename": "one.png"}, "two": {"filename": "two.png"}}`,
+		"images/one.png": "",
+		"images/two.png": "",
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				if _, err := Reload(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(imageCommands) != 2 {
+		t.Errorf("expected two image commands after reloading, got %q", imageCommands)
+	}
+}
@@ -42,6 +42,10 @@ fi
 if [ ! -d $DATA_DIR ]; then
     sudo mkdir $DATA_DIR
 fi
+# Phrases dir
+if [ ! -d "$DATA_DIR/phrases" ]; then
+    sudo mkdir $DATA_DIR/phrases
+fi
 # Tracks dir
 if [ ! -d "$DATA_DIR/tmp" ]; then
     sudo mkdir $DATA_DIR/tmp
@@ -53,7 +57,7 @@ echo "Done building"
 
 if [ "$1" != "test" ]; then
     # Add run script
-    echo "CONFIG=\"$CFG_DIR/config.yml\" ./bluebot" > run.sh
+    echo "CONFIG=\"$CFG_DIR/config.yml\" exec ./bluebot" > run.sh
     sudo chmod +x run.sh
 
     echo "** Installing service** "
@@ -69,7 +73,7 @@ if [ "$1" != "test" ]; then
 
     echo "Successfully installed service"
 else
-    echo "CONFIG=\"config/test_config.yml\" ./bluebot" > run.sh
+    echo "CONFIG=\"config/test_config.yml\" ./bluebot \"\$@\"" > run.sh
     echo "Giving correct permissions to run script and log file"
     sudo chmod 777 log/
     sudo chmod +x run.sh
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"bluebot/config"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	DefaultPrefix      = "%"
+	DefaultVoicePreset = config.DefaultVoicePreset
+	DefaultMaxQueueLen = 30
+	// Percent of listeners who must vote to skip a track
+	DefaultSkipVotePercent = 50
+)
+
+var ErrNoGuild = errors.New("settings can only be saved for a guild")
+
+var db *bolt.DB
+
+var guildBucket = []byte("guilds")
+
+// Settings for a single guild, persisted in the database as JSON
+type GuildSettings struct {
+	Prefix           string              `json:"prefix"`
+	VoicePreset      string              `json:"voice_preset"`
+	MaxQueueLen      int                 `json:"max_queue_len"`
+	SkipVotePercent  int                 `json:"skip_vote_percent"`
+	MaxUserTracks    int                 `json:"max_user_tracks"` // 0 for no limit
+	FairQueue        bool                `json:"fair_queue"`
+	DisabledCommands []string            `json:"disabled_commands"`
+	CommandRoles     map[string][]string `json:"command_roles"` // Replaces a command's default roles
+}
+
+func DefaultGuildSettings() *GuildSettings {
+	return &GuildSettings{
+		Prefix:           DefaultPrefix,
+		VoicePreset:      DefaultVoicePreset,
+		MaxQueueLen:      DefaultMaxQueueLen,
+		SkipVotePercent:  DefaultSkipVotePercent,
+		DisabledCommands: []string{},
+		CommandRoles:     map[string][]string{},
+	}
+}
+
+// Open the database file, creating it if needed
+func Open(path string) error {
+	var err error
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(guildBucket)
+		return err
+	})
+}
+
+func Close() error {
+	if db == nil {
+		return nil
+	}
+	return db.Close()
+}
+
+/*
+Get the settings for a guild. Defaults are used for a guild with nothing saved, outside of
+guilds or if the database can't be read
+*/
+func Guild(guildID string) *GuildSettings {
+	settings := DefaultGuildSettings()
+	if db == nil || guildID == "" {
+		return settings
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(guildBucket).Get([]byte(guildID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, settings)
+	})
+	if err != nil {
+		log.Printf("Failed to read settings for guild %s: %s", guildID, err)
+		return DefaultGuildSettings()
+	}
+	return settings
+}
+
+/*
+Load a guild's settings, apply a change and save them, all in one transaction. Nothing is
+saved if the update returns an error
+*/
+func UpdateGuild(guildID string, update func(*GuildSettings) error) error {
+	if guildID == "" {
+		return ErrNoGuild
+	}
+	if db == nil {
+		return errors.New("settings database is not open")
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(guildBucket)
+		settings := DefaultGuildSettings()
+		if data := bucket.Get([]byte(guildID)); data != nil {
+			if err := json.Unmarshal(data, settings); err != nil {
+				return err
+			}
+		}
+		if err := update(settings); err != nil {
+			return err
+		}
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(guildID), data)
+	})
+}
+
+func (s *GuildSettings) IsDisabled(command string) bool {
+	return slices.Contains(s.DisabledCommands, command)
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func openTestStore(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Close()
+		db = nil
+	})
+	return path
+}
+
+func TestGuildDefaults(t *testing.T) {
+	openTestStore(t)
+	for _, guildID := range []string{"", "unsaved"} {
+		settings := Guild(guildID)
+		if settings.Prefix != DefaultPrefix || settings.MaxQueueLen != DefaultMaxQueueLen || settings.CommandRoles == nil {
+			t.Errorf("expected defaults for %q, got %+v", guildID, settings)
+		}
+	}
+	if err := UpdateGuild("", func(*GuildSettings) error { return nil }); err != ErrNoGuild {
+		t.Errorf("expected saving outside a guild to fail, got %v", err)
+	}
+}
+
+func TestUpdateGuildSaves(t *testing.T) {
+	path := openTestStore(t)
+	err := UpdateGuild("guild", func(settings *GuildSettings) error {
+		settings.Prefix = "!"
+		settings.CommandRoles["queue"] = []string{"DJ"}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Settings are kept after reopening the database
+	Close()
+	if err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	settings := Guild("guild")
+	if settings.Prefix != "!" || len(settings.CommandRoles["queue"]) != 1 {
+		t.Errorf("expected the saved settings, got %+v", settings)
+	}
+	if other := Guild("other"); other.Prefix != DefaultPrefix {
+		t.Errorf("expected other guilds to keep the defaults, got %+v", other)
+	}
+}
+
+func TestUpdateGuildErrorSavesNothing(t *testing.T) {
+	openTestStore(t)
+	failed := errors.New("invalid")
+	err := UpdateGuild("guild", func(settings *GuildSettings) error {
+		settings.Prefix = "!"
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected the update's error, got %v", err)
+	}
+	if settings := Guild("guild"); settings.Prefix != DefaultPrefix {
+		t.Errorf("expected the failed update not to be saved, got %+v", settings)
+	}
+}
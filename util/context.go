@@ -0,0 +1,176 @@
+package util
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+/*
+Where a command was invoked from and how to reply to it. Commands can come from either
+a prefixed text message or a slash command interaction.
+
+Also a context.Context carrying the command's deadline, to pass on to any long running calls
+*/
+type Context struct {
+	context.Context
+	Session     Session
+	GuildID     string
+	ChannelID   string
+	Author      *discordgo.User
+	Member      *discordgo.Member      // Nil outside of guilds, User isn't set for messages
+	Interaction *discordgo.Interaction // Nil if invoked from a text message
+	Prefix      string                 // Command prefix in use where the command was invoked
+	Line        string                 // Command as typed after the prefix, empty for interactions
+	mu          sync.Mutex
+	responded   bool
+}
+
+func NewMessageContext(session Session, msg *discordgo.MessageCreate) *Context {
+	return &Context{
+		Context:   context.Background(),
+		Session:   session,
+		GuildID:   msg.GuildID,
+		ChannelID: msg.ChannelID,
+		Author:    msg.Author,
+		Member:    msg.Member,
+	}
+}
+
+func NewInteractionContext(session Session, i *discordgo.Interaction) *Context {
+	ctx := &Context{
+		Context:     context.Background(),
+		Session:     session,
+		GuildID:     i.GuildID,
+		ChannelID:   i.ChannelID,
+		Member:      i.Member,
+		Interaction: i,
+	}
+	if i.Member != nil {
+		ctx.Author = i.Member.User
+	} else {
+		ctx.Author = i.User
+	}
+	return ctx
+}
+
+// Nickname of the author in the guild if they have one, otherwise their username
+func (c *Context) AuthorName() string {
+	if c.Member != nil && c.Member.Nick != "" {
+		return c.Member.Nick
+	}
+	return c.Author.Username
+}
+
+/*
+Send a text reply. For interactions the first reply fills in the deferred response and
+any further ones are sent as followups
+*/
+func (c *Context) Send(content string) (*discordgo.Message, error) {
+	if c.Interaction == nil {
+		return c.Session.ChannelMessageSend(c.ChannelID, content)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.responded {
+		c.responded = true
+		return c.Session.InteractionResponseEdit(c.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+	}
+	return c.Session.FollowupMessageCreate(c.Interaction, true, &discordgo.WebhookParams{
+		Content: content,
+	})
+}
+
+// Send a file as a reply, following the same rules as Send
+func (c *Context) SendFile(name string, r io.Reader) (*discordgo.Message, error) {
+	if c.Interaction == nil {
+		return c.Session.ChannelFileSend(c.ChannelID, name, r)
+	}
+	file := &discordgo.File{Name: name, Reader: r}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.responded {
+		c.responded = true
+		return c.Session.InteractionResponseEdit(c.Interaction, &discordgo.WebhookEdit{
+			Files: []*discordgo.File{file},
+		})
+	}
+	return c.Session.FollowupMessageCreate(c.Interaction, true, &discordgo.WebhookParams{
+		Files: []*discordgo.File{file},
+	})
+}
+
+// Send an embed as a reply, following the same rules as Send
+func (c *Context) SendEmbed(embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	if c.Interaction == nil {
+		return c.Session.ChannelMessageSendEmbed(c.ChannelID, embed)
+	}
+	embeds := []*discordgo.MessageEmbed{embed}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.responded {
+		c.responded = true
+		return c.Session.InteractionResponseEdit(c.Interaction, &discordgo.WebhookEdit{
+			Embeds: &embeds,
+		})
+	}
+	return c.Session.FollowupMessageCreate(c.Interaction, true, &discordgo.WebhookParams{
+		Embeds: embeds,
+	})
+}
+
+/*
+Send a text reply with components such as buttons, following the same rules as Send. When
+the command came from a component on one of the bot's messages, that message is replaced
+*/
+func (c *Context) SendComponents(content string, components []discordgo.MessageComponent) (*discordgo.Message, error) {
+	if c.Interaction == nil {
+		return c.Session.ChannelMessageSendComplex(c.ChannelID, &discordgo.MessageSend{
+			Content:    content,
+			Components: components,
+		})
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.responded {
+		c.responded = true
+		return c.Session.InteractionResponseEdit(c.Interaction, &discordgo.WebhookEdit{
+			Content:    &content,
+			Components: &components,
+		})
+	}
+	return c.Session.FollowupMessageCreate(c.Interaction, true, &discordgo.WebhookParams{
+		Content:    content,
+		Components: components,
+	})
+}
+
+// Edit a message previously sent with Send
+func (c *Context) Edit(message *discordgo.Message, content string) (*discordgo.Message, error) {
+	return c.Session.ChannelMessageEdit(message.ChannelID, message.ID, content)
+}
+
+// Delete a message previously sent with Send
+func (c *Context) Delete(message *discordgo.Message) error {
+	return c.Session.ChannelMessageDelete(message.ChannelID, message.ID)
+}
+
+/*
+Clean up the deferred interaction response if the handler never replied. For components the
+response is the message they're on, which is left alone
+*/
+func (c *Context) Finish() {
+	if c.Interaction == nil || c.Interaction.Type == discordgo.InteractionMessageComponent {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.responded {
+		c.responded = true
+		c.Session.InteractionResponseDelete(c.Interaction)
+	}
+}
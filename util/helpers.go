@@ -15,3 +15,12 @@ func RandomHex(size int) (string, error) {
 	}
 	return fmt.Sprintf("%x", buf), nil
 }
+
+// Shorten text to a length limit in characters, marking that it was cut off
+func Truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-3]) + "..."
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// A maximum number of uses for a key within a sliding window of time
+type Limit struct {
+	Key    string
+	Max    int
+	Window time.Duration
+}
+
+// Tracks recent uses of keys to enforce limits on them
+type RateLimiter struct {
+	mu   sync.Mutex
+	uses map[string][]time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{uses: make(map[string][]time.Time)}
+}
+
+/*
+Record a use against every limit if none of them have been reached. Otherwise nothing is
+recorded and the time to wait until all of them would allow it is returned
+*/
+func (r *RateLimiter) Allow(now time.Time, limits ...Limit) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var wait time.Duration
+	for _, limit := range limits {
+		uses := r.prune(limit.Key, now, limit.Window)
+		if len(uses) >= limit.Max {
+			// Wait for enough of the oldest uses to leave the window
+			until := uses[len(uses)-limit.Max].Add(limit.Window).Sub(now)
+			if until > wait {
+				wait = until
+			}
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, limit := range limits {
+		r.uses[limit.Key] = append(r.uses[limit.Key], now)
+	}
+	return 0
+}
+
+// Drop uses of a key that are outside the window, returning the rest
+func (r *RateLimiter) prune(key string, now time.Time, window time.Duration) []time.Time {
+	uses := r.uses[key]
+	i := 0
+	for i < len(uses) && now.Sub(uses[i]) >= window {
+		i++
+	}
+	uses = uses[i:]
+	if len(uses) == 0 {
+		delete(r.uses, key)
+	} else {
+		r.uses[key] = uses
+	}
+	return uses
+}
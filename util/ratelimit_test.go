@@ -0,0 +1,58 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWindow(t *testing.T) {
+	limiter := NewRateLimiter()
+	start := time.Now()
+	limit := Limit{Key: "user", Max: 2, Window: 10 * time.Second}
+
+	for i := 0; i < 2; i++ {
+		if wait := limiter.Allow(start.Add(time.Duration(i)*time.Second), limit); wait != 0 {
+			t.Fatalf("use %d was limited, wait %s", i+1, wait)
+		}
+	}
+	// The oldest use leaves the window 10 seconds after it was made
+	if wait := limiter.Allow(start.Add(4*time.Second), limit); wait != 6*time.Second {
+		t.Errorf("expected to wait 6s, got %s", wait)
+	}
+	// Denied uses aren't recorded, so they don't push the wait back
+	if wait := limiter.Allow(start.Add(5*time.Second), limit); wait != 5*time.Second {
+		t.Errorf("expected to wait 5s, got %s", wait)
+	}
+	if wait := limiter.Allow(start.Add(10*time.Second), limit); wait != 0 {
+		t.Errorf("expected a use once the oldest left the window, wait %s", wait)
+	}
+	if wait := limiter.Allow(start.Add(10*time.Second), limit); wait != time.Second {
+		t.Errorf("expected to wait for the second use to leave, got %s", wait)
+	}
+}
+
+func TestRateLimiterCombinedLimits(t *testing.T) {
+	limiter := NewRateLimiter()
+	now := time.Now()
+	guild := Limit{Key: "guild", Max: 2, Window: time.Minute}
+	alice := Limit{Key: "alice", Max: 1, Window: 10 * time.Second}
+	bob := Limit{Key: "bob", Max: 5, Window: time.Minute}
+
+	if wait := limiter.Allow(now, alice, guild); wait != 0 {
+		t.Fatalf("first use was limited, wait %s", wait)
+	}
+	// Alice's own limit is reached, so the guild's use isn't recorded either
+	if wait := limiter.Allow(now, alice, guild); wait != 10*time.Second {
+		t.Errorf("expected alice to wait 10s, got %s", wait)
+	}
+	if wait := limiter.Allow(now, bob, guild); wait != 0 {
+		t.Errorf("expected bob to use the guild's second use, wait %s", wait)
+	}
+	// The guild's limit applies to everyone, and the longest wait is given
+	if wait := limiter.Allow(now.Add(20*time.Second), alice, guild); wait != 40*time.Second {
+		t.Errorf("expected the guild limit to make alice wait 40s, got %s", wait)
+	}
+	if wait := limiter.Allow(now.Add(time.Minute), alice, guild); wait != 0 {
+		t.Errorf("expected a use once the window passed, wait %s", wait)
+	}
+}
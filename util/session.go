@@ -0,0 +1,99 @@
+package util
+
+import (
+	"io"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+/*
+The Discord session calls the bot makes, so handlers can be run against a fake session in
+tests. DiscordSession implements it with a real connection
+*/
+type Session interface {
+	BotUserID() string
+	StateGuild(guildID string) (*discordgo.Guild, error)
+	StateChannel(channelID string) (*discordgo.Channel, error)
+	ChannelVoiceJoin(guildID, channelID string, mute, deaf bool) (VoiceConnection, error)
+
+	ChannelMessageSend(
+		channelID string, content string, options ...discordgo.RequestOption,
+	) (*discordgo.Message, error)
+	ChannelMessageSendEmbed(
+		channelID string, embed *discordgo.MessageEmbed, options ...discordgo.RequestOption,
+	) (*discordgo.Message, error)
+	ChannelFileSend(
+		channelID, name string, r io.Reader, options ...discordgo.RequestOption,
+	) (*discordgo.Message, error)
+	ChannelMessageSendComplex(
+		channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption,
+	) (*discordgo.Message, error)
+	ChannelMessageEdit(
+		channelID, messageID, content string, options ...discordgo.RequestOption,
+	) (*discordgo.Message, error)
+	ChannelMessageEditComplex(m *discordgo.MessageEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error
+
+	InteractionRespond(
+		interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption,
+	) error
+	InteractionResponseEdit(
+		interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption,
+	) (*discordgo.Message, error)
+	InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error
+	FollowupMessageCreate(
+		interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams,
+		options ...discordgo.RequestOption,
+	) (*discordgo.Message, error)
+
+	UserChannelPermissions(userID, channelID string, options ...discordgo.RequestOption) (int64, error)
+	GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error)
+	GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error)
+}
+
+// A voice channel connection audio can be played over
+type VoiceConnection interface {
+	Speaking(speaking bool) error
+	Disconnect() error
+	// Channel to send opus frames to be played
+	Opus() chan<- []byte
+}
+
+// Session backed by a real discordgo connection
+type DiscordSession struct {
+	*discordgo.Session
+}
+
+func NewDiscordSession(session *discordgo.Session) *DiscordSession {
+	return &DiscordSession{session}
+}
+
+func (s *DiscordSession) BotUserID() string {
+	return s.State.User.ID
+}
+
+// Get a guild from the state cache, which includes voice states
+func (s *DiscordSession) StateGuild(guildID string) (*discordgo.Guild, error) {
+	return s.State.Guild(guildID)
+}
+
+// Get a channel from the state cache
+func (s *DiscordSession) StateChannel(channelID string) (*discordgo.Channel, error) {
+	return s.State.Channel(channelID)
+}
+
+func (s *DiscordSession) ChannelVoiceJoin(guildID, channelID string, mute, deaf bool) (VoiceConnection, error) {
+	vc, err := s.Session.ChannelVoiceJoin(guildID, channelID, mute, deaf)
+	if err != nil {
+		return nil, err
+	}
+	return &discordVoice{vc}, nil
+}
+
+type discordVoice struct {
+	*discordgo.VoiceConnection
+}
+
+func (v *discordVoice) Opus() chan<- []byte {
+	return v.OpusSend
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrUnclosedQuote = errors.New("unclosed quote")
+
+/*
+Split a command line into arguments like a shell would. Whitespace separates arguments,
+single or double quotes at the start of an argument group words into one and a backslash
+escapes the next character (except within single quotes). Quotes within a word such as
+"don't" are kept as they are
+*/
+func SplitArgs(line string) ([]string, error) {
+	args, _, err := splitArgs(line)
+	return args, err
+}
+
+/*
+The end of line from where the given trailing arguments start, as it was typed with any quotes
+and backslashes. False if line doesn't split into arguments ending with them
+*/
+func RawRest(line string, rest []string) (string, bool) {
+	args, starts, err := splitArgs(line)
+	if err != nil || len(rest) > len(args) {
+		return "", false
+	}
+	offset := len(args) - len(rest)
+	for i, arg := range rest {
+		if args[offset+i] != arg {
+			return "", false
+		}
+	}
+	if len(rest) == 0 {
+		return "", true
+	}
+	return strings.TrimRight(line[starts[offset]:], " \t\n"), true
+}
+
+// Split a command line into arguments along with the byte offset each one starts at
+func splitArgs(line string) ([]string, []int, error) {
+	args := []string{}
+	starts := []int{}
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	start := func(pos int) {
+		if !inArg {
+			starts = append(starts, pos)
+			inArg = true
+		}
+	}
+
+	for pos, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			start(pos)
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case (r == '"' || r == '\'') && !inArg:
+			quote = r
+			start(pos)
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			start(pos)
+		}
+	}
+	if quote != 0 {
+		return nil, nil, ErrUnclosedQuote
+	}
+	// A trailing backslash is kept as is
+	if escaped {
+		current.WriteRune('\\')
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, starts, nil
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	lines := map[string][]string{
+		"":                         {},
+		"one two":                  {"one", "two"},
+		"  one   two\t three\n":    {"one", "two", "three"},
+		`say "hello there" friend`: {"say", "hello there", "friend"},
+		`'single "quoted"' x`:      {`single "quoted"`, "x"},
+		`don't stop`:               {"don't", "stop"},
+		`one\ word`:                {"one word"},
+		`"say \"hi\""`:             {`say "hi"`},
+		`'no \escape'`:             {`no \escape`},
+		`""`:                       {""},
+		`trailing\`:                {`trailing\`},
+	}
+	for line, want := range lines {
+		if got, err := SplitArgs(line); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("SplitArgs(%q) = %q, %v, want %q", line, got, err, want)
+		}
+	}
+	for _, line := range []string{`"unclosed`, `one 'two`, `"escaped end\"`} {
+		if _, err := SplitArgs(line); err != ErrUnclosedQuote {
+			t.Errorf("expected SplitArgs(%q) to fail with an unclosed quote, got %v", line, err)
+		}
+	}
+}
+
+func TestRawRest(t *testing.T) {
+	tests := []struct {
+		line string
+		rest []string
+		want string
+		ok   bool
+	}{
+		{`say hi "there"  `, []string{"hi", "there"}, `hi "there"`, true},
+		{`say   'a b' c\ d`, []string{"a b", "c d"}, `'a b' c\ d`, true},
+		{`say hi`, []string{}, "", true},
+		{`say hi`, []string{"bye"}, "", false},
+		{`say hi`, []string{"say", "hi", "there"}, "", false},
+		{`say "hi`, []string{"hi"}, "", false},
+	}
+	for _, test := range tests {
+		if got, ok := RawRest(test.line, test.rest); got != test.want || ok != test.ok {
+			t.Errorf("RawRest(%q, %q) = %q, %t, want %q, %t", test.line, test.rest, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -1,5 +1,3 @@
 package util
 
-import "github.com/bwmarrin/discordgo"
-
-type HandlerFunc func(*discordgo.Session, *discordgo.MessageCreate, []string) error
+type HandlerFunc func(*Context, []string) error